@@ -0,0 +1,124 @@
+package client
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// CardinalityGuard drops the tags taking more than a maximum number of
+// distinct values over a sliding window, such as a UUID used as a tag by
+// mistake. The window slides in two halves: the values of a tag are those
+// seen in the current half and in the previous one. A tag comes back once
+// its values fall under the maximum again. A nil CardinalityGuard does not
+// drop anything.
+type CardinalityGuard struct {
+	max    int
+	window time.Duration
+	// now returns the current time, tests replace it to control the clock
+	now func() time.Time
+
+	mu   sync.Mutex
+	tags map[string]*tagValues
+}
+
+// tagValues tracks the values of a tag. At most max+1 values are kept per
+// half window, which is enough to tell whether the tag is over the maximum.
+type tagValues struct {
+	start time.Time
+	// values of the current half window, and of both halves
+	current map[string]struct{}
+	seen    map[string]struct{}
+	dropped bool
+}
+
+// NewCardinalityGuard returns a CardinalityGuard allowing max values per tag
+// over window, nil when max is not positive.
+func NewCardinalityGuard(max int, window time.Duration) *CardinalityGuard {
+	if max <= 0 {
+		return nil
+	}
+	return &CardinalityGuard{
+		max:    max,
+		window: window,
+		now:    time.Now,
+		tags:   make(map[string]*tagValues),
+	}
+}
+
+// Filter removes the tags over the maximum from the metrics. The metrics
+// are not modified, those losing tags are copied. Like DropTags, it must
+// run after HandleNonFinite.
+func (g *CardinalityGuard) Filter(metrics []telegraf.Metric) ([]telegraf.Metric, error) {
+	if g == nil {
+		return metrics, nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	kept := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		var drop []string
+		for k, v := range m.Tags() {
+			if g.observe(k, v, now) {
+				drop = append(drop, k)
+			}
+		}
+		if len(drop) == 0 {
+			kept = append(kept, m)
+			continue
+		}
+		dropped, err := DropTags([]telegraf.Metric{m}, drop)
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, dropped...)
+	}
+	return kept, nil
+}
+
+// observe records the value of the tag and reports whether the tag is over
+// the maximum.
+func (g *CardinalityGuard) observe(key, value string, now time.Time) bool {
+	tv, ok := g.tags[key]
+	if !ok {
+		tv = &tagValues{
+			start:   now,
+			current: make(map[string]struct{}),
+			seen:    make(map[string]struct{}),
+		}
+		g.tags[key] = tv
+	}
+
+	half := g.window / 2
+	if elapsed := now.Sub(tv.start); elapsed >= half {
+		// the current half becomes the previous one, unless it is too old
+		tv.seen = make(map[string]struct{})
+		if elapsed < 2*half {
+			for v := range tv.current {
+				tv.seen[v] = struct{}{}
+			}
+		}
+		tv.current = make(map[string]struct{})
+		tv.start = now
+	}
+
+	if len(tv.current) <= g.max {
+		tv.current[value] = struct{}{}
+	}
+	if len(tv.seen) <= g.max {
+		tv.seen[value] = struct{}{}
+	}
+
+	over := len(tv.seen) > g.max
+	if over && !tv.dropped {
+		log.Printf("W! tag %s took more than %d values in %s, dropping it", key, g.max, g.window)
+	} else if !over && tv.dropped {
+		log.Printf("I! tag %s is back under %d values in %s, writing it again", key, g.max, g.window)
+	}
+	tv.dropped = over
+	return over
+}
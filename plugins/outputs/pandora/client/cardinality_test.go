@@ -0,0 +1,53 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCardinalityGuard(t *testing.T) {
+	var g *CardinalityGuard
+	require.Nil(t, NewCardinalityGuard(0, time.Hour))
+
+	start := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	g = NewCardinalityGuard(3, time.Hour)
+	g.now = func() time.Time { return now }
+
+	write := func(id string) telegraf.Metric {
+		m, err := metric.New("req", map[string]string{"host": "h1", "id": id},
+			map[string]interface{}{"value": 1.0}, now)
+		require.NoError(t, err)
+		kept, err := g.Filter([]telegraf.Metric{m})
+		require.NoError(t, err)
+		require.Len(t, kept, 1)
+		return kept[0]
+	}
+
+	for n := 0; n < 3; n++ {
+		require.Equal(t, map[string]string{"host": "h1", "id": fmt.Sprint(n)}, write(fmt.Sprint(n)).Tags())
+	}
+	// the 4th value is one too many, the tag is dropped from then on
+	for n := 3; n < 100; n++ {
+		m := write(fmt.Sprint(n))
+		require.Equal(t, map[string]string{"host": "h1"}, m.Tags())
+		require.Equal(t, map[string]interface{}{"value": 1.0}, m.Fields())
+	}
+	// known values are dropped too while the tag is over the maximum
+	require.Equal(t, map[string]string{"host": "h1"}, write("0").Tags())
+
+	// memory stays bounded
+	require.Len(t, g.tags["id"].seen, 4)
+	require.Len(t, g.tags["id"].current, 4)
+
+	// the values slide out of the window once it passes
+	now = start.Add(31 * time.Minute)
+	require.Equal(t, map[string]string{"host": "h1"}, write("0").Tags())
+	now = start.Add(62 * time.Minute)
+	require.Equal(t, map[string]string{"host": "h1", "id": "0"}, write("0").Tags())
+}
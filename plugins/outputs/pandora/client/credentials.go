@@ -0,0 +1,91 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolveCredential returns the credential configured for the option name,
+// either inline in value, as a "$VAR" reference to an environment variable,
+// or in the file at path. Trailing whitespace is trimmed from file contents.
+func ResolveCredential(name, value, path string) (string, error) {
+	if path != "" {
+		if value != "" {
+			return "", fmt.Errorf("config.%s and config.%sFile are mutually exclusive", name, name)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("error reading config.%sFile: %s", name, err)
+		}
+		return strings.TrimRight(string(b), " \t\r\n"), nil
+	}
+	if strings.HasPrefix(value, "$") {
+		env := strings.TrimPrefix(value, "$")
+		v := os.Getenv(env)
+		if v == "" {
+			return "", fmt.Errorf("environment variable %s for config.%s is not set", env, name)
+		}
+		return v, nil
+	}
+	return value, nil
+}
+
+// Token is a security token sent along the signed requests, for temporary
+// credentials. A token read from a file is read again whenever the file
+// changes, so that a token renewed before it expires is used right away.
+type Token struct {
+	name  string
+	value string
+	path  string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewToken resolves the token configured for the option name, as
+// ResolveCredential does. It returns nil when no token is configured.
+func NewToken(name, value, path string) (*Token, error) {
+	v, err := ResolveCredential(name, value, path)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		if v == "" {
+			return nil, nil
+		}
+		return &Token{name: name, value: v}, nil
+	}
+	t := &Token{name: name, path: path}
+	if _, err := t.Get(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Get returns the token, reading its file again if it changed.
+func (t *Token) Get() (string, error) {
+	if t.path == "" {
+		return t.value, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return "", fmt.Errorf("error reading config.%sFile: %s", t.name, err)
+	}
+	if info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return t.value, nil
+	}
+	v, err := ResolveCredential(t.name, "", t.path)
+	if err != nil {
+		return "", err
+	}
+	t.value, t.modTime, t.size = v, info.ModTime(), info.Size()
+	return v, nil
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveCredential_Inline(t *testing.T) {
+	v, err := ResolveCredential("AK", "ACCESS_KEY", "")
+	require.NoError(t, err)
+	require.Equal(t, "ACCESS_KEY", v)
+}
+
+func TestResolveCredential_Env(t *testing.T) {
+	os.Setenv("PANDORA_TEST_AK", "env_key")
+	defer os.Unsetenv("PANDORA_TEST_AK")
+
+	v, err := ResolveCredential("AK", "$PANDORA_TEST_AK", "")
+	require.NoError(t, err)
+	require.Equal(t, "env_key", v)
+
+	_, err = ResolveCredential("AK", "$PANDORA_TEST_UNSET", "")
+	require.Error(t, err)
+}
+
+func TestResolveCredential_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pandora")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sk")
+	require.NoError(t, ioutil.WriteFile(path, []byte("file_key\n"), 0600))
+
+	v, err := ResolveCredential("SK", "", path)
+	require.NoError(t, err)
+	require.Equal(t, "file_key", v)
+
+	_, err = ResolveCredential("SK", "SECRET_KEY", path)
+	require.Error(t, err)
+
+	_, err = ResolveCredential("SK", "", filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestNewToken(t *testing.T) {
+	token, err := NewToken("SecurityToken", "", "")
+	require.NoError(t, err)
+	require.Nil(t, token)
+
+	token, err = NewToken("SecurityToken", "static", "")
+	require.NoError(t, err)
+	v, err := token.Get()
+	require.NoError(t, err)
+	require.Equal(t, "static", v)
+
+	_, err = NewToken("SecurityToken", "static", "/nonexistent/token")
+	require.Error(t, err)
+	_, err = NewToken("SecurityToken", "", "/nonexistent/token")
+	require.Error(t, err)
+}
+
+func TestToken_FileChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pandora")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("token1\n"), 0600))
+	token, err := NewToken("SecurityToken", "", path)
+	require.NoError(t, err)
+	v, err := token.Get()
+	require.NoError(t, err)
+	require.Equal(t, "token1", v)
+
+	// the token is renewed, with the same size
+	require.NoError(t, ioutil.WriteFile(path, []byte("token2\n"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	v, err = token.Get()
+	require.NoError(t, err)
+	require.Equal(t, "token2", v)
+
+	require.NoError(t, os.Remove(path))
+	_, err = token.Get()
+	require.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Pandora error codes the outputs react to.
+const (
+	CodeSeriesNotFound = "E7101"
+	CodeSeriesExists   = "E6302"
+	CodeRepoNotFound   = "E18102"
+	CodeSchemaMismatch = "E18111"
+	CodeExportExists   = "E18301"
+)
+
+var errorCodeRe = regexp.MustCompile(`\bE\d{4,5}\b`)
+
+// PandoraError is an error returned by Pandora, with its error code.
+type PandoraError struct {
+	Code string
+	Err  error
+}
+
+func (e *PandoraError) Error() string {
+	return e.Err.Error()
+}
+
+// ParseError returns err as a *PandoraError, or nil if it carries no Pandora
+// error code.
+func ParseError(err error) *PandoraError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*PandoraError); ok {
+		return e
+	}
+	code := errorCodeRe.FindString(err.Error())
+	if code == "" {
+		return nil
+	}
+	return &PandoraError{Code: code, Err: err}
+}
+
+// HasCode reports whether err is a Pandora error with the given code.
+func HasCode(err error, code string) bool {
+	e := ParseError(err)
+	return e != nil && e.Code == code
+}
+
+// IsRepoNotFound reports whether err means the pipeline repo does not exist.
+func IsRepoNotFound(err error) bool {
+	return HasCode(err, CodeRepoNotFound)
+}
+
+// IsSchemaMismatch reports whether err means the data does not match the
+// schema of the pipeline repo.
+func IsSchemaMismatch(err error) bool {
+	return HasCode(err, CodeSchemaMismatch)
+}
+
+// IsSeriesNotFound reports whether err means the tsdb series does not exist.
+func IsSeriesNotFound(err error) bool {
+	return HasCode(err, CodeSeriesNotFound)
+}
+
+// IsSeriesExists reports whether err means the tsdb series already exists.
+func IsSeriesExists(err error) bool {
+	return HasCode(err, CodeSeriesExists)
+}
+
+// IsExportExists reports whether err means the export already exists.
+func IsExportExists(err error) bool {
+	return HasCode(err, CodeExportExists)
+}
+
+// IsFieldTypeConflict reports whether err means a field was written with a
+// type other than the one of the series. Pandora gives no code for it.
+func IsFieldTypeConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "field type conflict")
+}
+
+// IsAuthError reports whether err means the credentials were refused, a 401
+// or 403 response.
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	m := statusCodeRe.FindStringSubmatch(err.Error())
+	return m != nil && (m[1] == "401" || m[1] == "403")
+}
+
+// IsNetworkError reports whether err happened before Pandora could answer,
+// e.g. failing to resolve or dial the endpoint.
+func IsNetworkError(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// CheckFieldConflictMode validates the on_field_conflict option: "drop"
+// drops the conflicting points, "retry_once" posts them again once and
+// "error" fails the write.
+func CheckFieldConflictMode(mode string) error {
+	switch mode {
+	case "drop", "retry_once", "error":
+		return nil
+	}
+	return fmt.Errorf("invalid on_field_conflict %q, must be one of drop, retry_once, error", mode)
+}
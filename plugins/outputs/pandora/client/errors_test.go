@@ -0,0 +1,60 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseError(t *testing.T) {
+	err := errors.New("pandora error: StatusCode=404, ErrorMessage=E18102: repo does not exist")
+	e := ParseError(err)
+	require.NotNil(t, e)
+	require.Equal(t, "E18102", e.Code)
+	require.Equal(t, err.Error(), e.Error())
+	require.Equal(t, e, ParseError(e))
+
+	require.Nil(t, ParseError(nil))
+	require.Nil(t, ParseError(errors.New("connection refused")))
+	require.Nil(t, ParseError(errors.New("E1810200 is not a code")))
+}
+
+func TestErrorPredicates(t *testing.T) {
+	tests := []struct {
+		err  error
+		is   func(error) bool
+		name string
+	}{
+		{errors.New("E18102: repo does not exist"), IsRepoNotFound, "repo not found"},
+		{errors.New("E18111: schema does not match"), IsSchemaMismatch, "schema mismatch"},
+		{errors.New("E7101: series does not exist"), IsSeriesNotFound, "series not found"},
+		{errors.New("E6302: series already exists"), IsSeriesExists, "series exists"},
+		{errors.New("E18301: export already exists"), IsExportExists, "export exists"},
+		{errors.New(`field type conflict: input field "value" is type integer`), IsFieldTypeConflict, "field type conflict"},
+		{errors.New("E401: bad token, status code: 401"), IsAuthError, "auth error"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, IsNetworkError, "network error"},
+	}
+	predicates := []func(error) bool{
+		IsRepoNotFound, IsSchemaMismatch, IsSeriesNotFound,
+		IsSeriesExists, IsExportExists, IsFieldTypeConflict,
+		IsAuthError, IsNetworkError,
+	}
+
+	for n, tt := range tests {
+		require.True(t, tt.is(tt.err), tt.name)
+		require.False(t, tt.is(nil), tt.name)
+		for m, is := range predicates {
+			if m != n {
+				require.False(t, is(tt.err), "%s matched predicate %d", tt.name, m)
+			}
+		}
+	}
+
+	unknown := errors.New("E9999: unknown error")
+	for _, is := range predicates {
+		require.False(t, is(unknown))
+	}
+	require.True(t, HasCode(unknown, "E9999"))
+}
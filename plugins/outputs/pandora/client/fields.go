@@ -0,0 +1,143 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// RenameFields renames the fields of the metrics found in renames, a field
+// renamed to the name of another field replaces it. The metrics are not
+// modified, those with such fields are copied. Like AddDefaultTags, it must
+// run after HandleNonFinite.
+func RenameFields(metrics []telegraf.Metric, renames map[string]string) ([]telegraf.Metric, error) {
+	if len(renames) == 0 {
+		return metrics, nil
+	}
+	renamed := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		fields := m.Fields()
+		found := false
+		for k := range fields {
+			if _, ok := renames[k]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			renamed = append(renamed, m)
+			continue
+		}
+
+		out := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			if _, ok := renames[k]; !ok {
+				out[k] = v
+			}
+		}
+		for k, v := range fields {
+			if to, ok := renames[k]; ok {
+				out[to] = v
+			}
+		}
+		renamedMetric, err := metric.New(m.Name(), m.Tags(), out, m.Time(), m.Type())
+		if err != nil {
+			return nil, err
+		}
+		renamed = append(renamed, renamedMetric)
+	}
+	return renamed, nil
+}
+
+// DropFieldless drops the metrics without fields, which would make malformed
+// records. The other metrics are returned in order.
+func DropFieldless(metrics []telegraf.Metric) []telegraf.Metric {
+	var kept []telegraf.Metric
+	for n, m := range metrics {
+		if len(m.Fields()) > 0 {
+			if kept != nil {
+				kept = append(kept, m)
+			}
+			continue
+		}
+		if kept == nil {
+			kept = make([]telegraf.Metric, n, len(metrics))
+			copy(kept, metrics[:n])
+		}
+	}
+	if kept == nil {
+		return metrics
+	}
+	return kept
+}
+
+// FieldFilter keeps the fields of metrics matching its include globs, if
+// any, and none of its exclude globs.
+type FieldFilter struct {
+	include filter.Filter
+	exclude filter.Filter
+}
+
+// NewFieldFilter compiles the include and exclude globs. It returns nil,
+// which keeps all fields, when both are empty.
+func NewFieldFilter(include, exclude []string) (*FieldFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := &FieldFilter{}
+	var err error
+	if len(include) > 0 {
+		if f.include, err = filter.Compile(include); err != nil {
+			return nil, fmt.Errorf("error compiling config.FieldInclude: %s", err)
+		}
+	}
+	if len(exclude) > 0 {
+		if f.exclude, err = filter.Compile(exclude); err != nil {
+			return nil, fmt.Errorf("error compiling config.FieldExclude: %s", err)
+		}
+	}
+	return f, nil
+}
+
+func (f *FieldFilter) keep(field string) bool {
+	if f.include != nil && !f.include.Match(field) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.Match(field)
+}
+
+// Filter removes the fields not to keep from the metrics, and drops the
+// metrics left without fields. The metrics are not modified, those with such
+// fields are copied. Like AddDefaultTags, it must run after HandleNonFinite.
+func (f *FieldFilter) Filter(metrics []telegraf.Metric) ([]telegraf.Metric, error) {
+	if f == nil {
+		return metrics, nil
+	}
+	kept := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		fields := m.Fields()
+		removed := false
+		for k := range fields {
+			if !f.keep(k) {
+				delete(fields, k)
+				removed = true
+			}
+		}
+		if !removed {
+			kept = append(kept, m)
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		filtered, err := metric.New(m.Name(), m.Tags(), fields, m.Time(), m.Type())
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, filtered)
+	}
+	return kept, nil
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenameFields(t *testing.T) {
+	m1, err := metric.New("system",
+		map[string]string{"host": "h1"},
+		map[string]interface{}{"load.1": 1.0, "load 5": 5.0, "uptime": int64(10)},
+		time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("system", map[string]string{"host": "h1"}, map[string]interface{}{"uptime": int64(20)}, time.Unix(1, 0))
+	require.NoError(t, err)
+	original := m1.String()
+
+	renamed, err := RenameFields([]telegraf.Metric{m1, m2}, map[string]string{"load.1": "load1", "load 5": "load5"})
+	require.NoError(t, err)
+	require.Len(t, renamed, 2)
+	require.Equal(t, map[string]interface{}{"load1": 1.0, "load5": 5.0, "uptime": int64(10)}, renamed[0].Fields())
+	require.Equal(t, map[string]string{"host": "h1"}, renamed[0].Tags())
+	require.Equal(t, map[string]interface{}{"uptime": int64(20)}, renamed[1].Fields())
+	require.Equal(t, original, m1.String())
+}
+
+func TestFieldFilter(t *testing.T) {
+	f, err := NewFieldFilter(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, f)
+
+	newMetrics := func() []telegraf.Metric {
+		m1, err := metric.New("cpu", map[string]string{"host": "h1"},
+			map[string]interface{}{"usage_user": 1.0, "usage_idle": 2.0, "time_user": 3.0},
+			time.Unix(1, 0))
+		require.NoError(t, err)
+		m2, err := metric.New("cpu", map[string]string{"host": "h1"},
+			map[string]interface{}{"time_user": 3.0}, time.Unix(2, 0))
+		require.NoError(t, err)
+		return []telegraf.Metric{m1, m2}
+	}
+
+	// pass only
+	f, err = NewFieldFilter([]string{"usage_*"}, nil)
+	require.NoError(t, err)
+	metrics := newMetrics()
+	original := metrics[0].String()
+	filtered, err := f.Filter(metrics)
+	require.NoError(t, err)
+	require.Len(t, filtered, 1)
+	require.Equal(t, map[string]interface{}{"usage_user": 1.0, "usage_idle": 2.0}, filtered[0].Fields())
+	require.Equal(t, map[string]string{"host": "h1"}, filtered[0].Tags())
+	require.Equal(t, original, metrics[0].String())
+
+	// drop only
+	f, err = NewFieldFilter(nil, []string{"usage_idle", "time_*"})
+	require.NoError(t, err)
+	filtered, err = f.Filter(newMetrics())
+	require.NoError(t, err)
+	require.Len(t, filtered, 1)
+	require.Equal(t, map[string]interface{}{"usage_user": 1.0}, filtered[0].Fields())
+
+	// the globs excluded take precedence
+	f, err = NewFieldFilter([]string{"usage_*"}, []string{"*_idle"})
+	require.NoError(t, err)
+	filtered, err = f.Filter(newMetrics())
+	require.NoError(t, err)
+	require.Len(t, filtered, 1)
+	require.Equal(t, map[string]interface{}{"usage_user": 1.0}, filtered[0].Fields())
+
+	_, err = NewFieldFilter([]string{"usage_["}, nil)
+	require.Error(t, err)
+}
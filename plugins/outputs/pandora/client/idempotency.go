@@ -0,0 +1,80 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// IdempotencyKeys holds the idempotency keys of the batches being posted,
+// by the hash of their body, for the transport to send along the posts. A
+// batch gets a new random key when it starts and keeps it through all its
+// retries, so that a batch posted again, even with the same bytes, is not
+// taken for a retry. A nil IdempotencyKeys does not hold any key.
+type IdempotencyKeys struct {
+	mu   sync.Mutex
+	keys map[[sha256.Size]byte]*batchKey
+}
+
+type batchKey struct {
+	key  string
+	refs int
+}
+
+// Start gives the batch body a new key, returned with the func to call once
+// the batch and its retries are done. A batch with the same body started by
+// another writer while the first one is still posted, to another repo,
+// shares its key.
+func (k *IdempotencyKeys) Start(body []byte) (key string, done func()) {
+	if k == nil {
+		return "", func() {}
+	}
+	sum := sha256.Sum256(body)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys == nil {
+		k.keys = make(map[[sha256.Size]byte]*batchKey)
+	}
+	b, ok := k.keys[sum]
+	if !ok {
+		b = &batchKey{key: newKey()}
+		k.keys[sum] = b
+	}
+	b.refs++
+
+	return b.key, func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if b.refs--; b.refs == 0 {
+			delete(k.keys, sum)
+		}
+	}
+}
+
+// Key returns the key of the batch body being posted, empty if none was
+// started.
+func (k *IdempotencyKeys) Key(body []byte) string {
+	if k == nil {
+		return ""
+	}
+	sum := sha256.Sum256(body)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if b, ok := k.keys[sum]; ok {
+		return b.key
+	}
+	return ""
+}
+
+// newKey returns a random 128-bit key, empty if the random source failed,
+// in which case the batch is posted without key.
+func newKey() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	k := &IdempotencyKeys{}
+	require.Equal(t, "", k.Key([]byte("a=1")))
+
+	key, done := k.Start([]byte("a=1"))
+	require.Len(t, key, 32)
+	require.Equal(t, key, k.Key([]byte("a=1")))
+	require.Equal(t, "", k.Key([]byte("a=2")))
+
+	// the same body posted meanwhile to another repo shares the key
+	shared, doneShared := k.Start([]byte("a=1"))
+	require.Equal(t, key, shared)
+	done()
+	require.Equal(t, key, k.Key([]byte("a=1")))
+	doneShared()
+	require.Equal(t, "", k.Key([]byte("a=1")))
+
+	// a new batch of the same bytes gets a new key
+	next, done := k.Start([]byte("a=1"))
+	require.NotEqual(t, key, next)
+	done()
+
+	var none *IdempotencyKeys
+	key, done = none.Start([]byte("a=1"))
+	require.Equal(t, "", key)
+	done()
+	require.Equal(t, "", none.Key([]byte("a=1")))
+}
@@ -0,0 +1,58 @@
+package client
+
+import "sync"
+
+// Inflight bounds the bytes of the posts in flight, blocking new posts until
+// enough of the running ones are done. A nil Inflight does not bound
+// anything.
+type Inflight struct {
+	max int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+// NewInflight returns an Inflight allowing max bytes in flight, nil when max
+// is not positive.
+func NewInflight(max int64) *Inflight {
+	if max <= 0 {
+		return nil
+	}
+	f := &Inflight{max: max}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Acquire blocks until n more bytes can be in flight and returns the bytes
+// taken, to hand back to Release. A post larger than the maximum waits for
+// all others to be done and takes the whole maximum.
+func (f *Inflight) Acquire(n int) int64 {
+	if f == nil {
+		return 0
+	}
+	size := int64(n)
+	if size > f.max {
+		size = f.max
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.used+size > f.max {
+		f.cond.Wait()
+	}
+	f.used += size
+	return size
+}
+
+// Release hands back bytes taken by Acquire.
+func (f *Inflight) Release(size int64) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	f.used -= size
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
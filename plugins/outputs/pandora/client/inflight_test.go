@@ -0,0 +1,52 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflight(t *testing.T) {
+	var f *Inflight
+	f.Release(f.Acquire(100))
+	require.Nil(t, NewInflight(0))
+
+	f = NewInflight(100)
+	var (
+		mu          sync.Mutex
+		inflight    int64
+		maxInflight int64
+		wg          sync.WaitGroup
+	)
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			size := f.Acquire(40)
+			mu.Lock()
+			inflight += size
+			if inflight > maxInflight {
+				maxInflight = inflight
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			inflight -= size
+			mu.Unlock()
+			f.Release(size)
+		}()
+	}
+	wg.Wait()
+	// only two posts of 40 bytes fit in 100 bytes
+	require.Equal(t, int64(80), maxInflight)
+
+	// a post larger than the maximum still goes through, alone
+	size := f.Acquire(1000)
+	require.Equal(t, int64(100), size)
+	f.Release(size)
+	require.Equal(t, int64(0), f.used)
+}
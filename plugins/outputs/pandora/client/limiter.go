@@ -0,0 +1,44 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter spaces out calls so that at most rps of them start every second.
+// A nil Limiter does not limit anything.
+type Limiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewLimiter returns a Limiter allowing rps calls per second, nil when rps
+// is not positive.
+func NewLimiter(rps float64) *Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &Limiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+// Wait blocks until the next call is allowed.
+func (l *Limiter) Wait() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	var l *Limiter
+	l.Wait()
+	require.Nil(t, NewLimiter(0))
+
+	l = NewLimiter(50)
+	var (
+		mu     sync.Mutex
+		starts []time.Time
+		wg     sync.WaitGroup
+	)
+	for n := 0; n < 5; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Wait()
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	first, last := starts[0], starts[0]
+	for _, s := range starts {
+		if s.Before(first) {
+			first = s
+		}
+		if s.After(last) {
+			last = s
+		}
+	}
+	// 5 calls at 50 rps are spread over at least 4 intervals of 20ms
+	require.True(t, last.Sub(first) >= 75*time.Millisecond, "took %s", last.Sub(first))
+}
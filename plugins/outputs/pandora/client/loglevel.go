@@ -0,0 +1,35 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LogLevel is the verbosity of the Pandora SDK logger, set by log_level.
+// The SDKs of the outputs have level types of their own, which the outputs
+// map it to.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+// ParseLogLevel parses the log_level option: debug, info, warn or error,
+// case-insensitively. Empty means info.
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LogDebug, nil
+	case "", "info":
+		return LogInfo, nil
+	case "warn":
+		return LogWarn, nil
+	case "error":
+		return LogError, nil
+	default:
+		return LogInfo, fmt.Errorf("invalid log_level %q, must be one of debug, info, warn, error", level)
+	}
+}
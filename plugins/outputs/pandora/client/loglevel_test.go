@@ -0,0 +1,29 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		level    string
+		expected LogLevel
+	}{
+		{"", LogInfo},
+		{"debug", LogDebug},
+		{"info", LogInfo},
+		{"warn", LogWarn},
+		{"error", LogError},
+		{"DEBUG", LogDebug},
+	}
+	for _, tt := range tests {
+		level, err := ParseLogLevel(tt.level)
+		require.NoError(t, err, tt.level)
+		require.Equal(t, tt.expected, level, tt.level)
+	}
+
+	_, err := ParseLogLevel("verbose")
+	require.EqualError(t, err, `invalid log_level "verbose", must be one of debug, info, warn, error`)
+}
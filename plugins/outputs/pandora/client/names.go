@@ -0,0 +1,18 @@
+package client
+
+import "github.com/influxdata/telegraf"
+
+// PrefixMetrics returns copies of metrics with prefix prepended to their
+// names, so the prefix flows into series names and schema keys alike.
+func PrefixMetrics(metrics []telegraf.Metric, prefix string) []telegraf.Metric {
+	if prefix == "" {
+		return metrics
+	}
+	prefixed := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		m = m.Copy()
+		m.SetPrefix(prefix)
+		prefixed = append(prefixed, m)
+	}
+	return prefixed
+}
@@ -0,0 +1,27 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixMetrics(t *testing.T) {
+	m, err := metric.New("cpu", map[string]string{"host": "h1"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	metrics := []telegraf.Metric{m}
+
+	prefixed := PrefixMetrics(metrics, "prod_")
+	require.Len(t, prefixed, 1)
+	require.Equal(t, "prod_cpu", prefixed[0].Name())
+	require.Equal(t, m.Tags(), prefixed[0].Tags())
+	require.Equal(t, m.Fields(), prefixed[0].Fields())
+	// the original metrics are left untouched
+	require.Equal(t, "cpu", m.Name())
+
+	unprefixed := PrefixMetrics(metrics, "")
+	require.True(t, unprefixed[0] == m)
+}
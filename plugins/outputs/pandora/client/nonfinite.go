@@ -0,0 +1,120 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// CheckNonFiniteMode validates a float_nan_handling option.
+func CheckNonFiniteMode(mode string) error {
+	switch mode {
+	case "drop", "zero", "error":
+		return nil
+	}
+	return fmt.Errorf("invalid float_nan_handling %q, must be one of drop, zero, error", mode)
+}
+
+// HandleNonFinite applies mode to the NaN and infinite float fields of the
+// metrics, which Pandora rejects: "drop" omits the field, "zero" writes 0
+// instead and "error" fails the whole batch. Metrics left without fields are
+// dropped. The metrics are not modified, those with such fields are copied.
+func HandleNonFinite(metrics []telegraf.Metric, mode string) ([]telegraf.Metric, error) {
+	var handled []telegraf.Metric
+	for n, m := range metrics {
+		keys := nonFiniteFields(m)
+		if len(keys) == 0 {
+			if handled != nil {
+				handled = append(handled, m)
+			}
+			continue
+		}
+		if mode == "error" {
+			return nil, fmt.Errorf("measurement %s has NaN or infinite fields %v", m.Name(), keys)
+		}
+
+		if handled == nil {
+			handled = make([]telegraf.Metric, n, len(metrics))
+			copy(handled, metrics[:n])
+		}
+		fields := m.Fields()
+		for _, k := range keys {
+			if mode == "zero" {
+				fields[k] = float64(0)
+			} else {
+				delete(fields, k)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		handledMetric, err := metric.New(m.Name(), m.Tags(), fields, m.Time(), m.Type())
+		if err != nil {
+			return nil, err
+		}
+		handled = append(handled, handledMetric)
+	}
+	if handled == nil {
+		return metrics, nil
+	}
+	return handled, nil
+}
+
+var fieldKeyUnescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ")
+
+// nonFiniteFields returns the keys of the NaN and infinite float fields of m.
+// m.Fields() skips the values it cannot parse, so they are looked up in the
+// serialized fields instead.
+func nonFiniteFields(m telegraf.Metric) []string {
+	line := strings.TrimSuffix(m.String(), "\n")
+	if !strings.Contains(line, "NaN") && !strings.Contains(line, "Inf") {
+		return nil
+	}
+
+	// name and tags escape their spaces, so the fields are between the
+	// first unescaped space and the space before the timestamp
+	start := -1
+	for n := 0; n < len(line) && start < 0; n++ {
+		switch line[n] {
+		case '\\':
+			n++
+		case ' ':
+			start = n + 1
+		}
+	}
+	end := strings.LastIndexByte(line, ' ')
+	if start < 0 || end < start {
+		return nil
+	}
+	fields := line[start:end]
+
+	var keys []string
+	inQuote, begin := false, 0
+	for n := 0; n <= len(fields); n++ {
+		if n < len(fields) {
+			switch c := fields[n]; {
+			case c == '\\':
+				n++
+				continue
+			case c == '"':
+				inQuote = !inQuote
+				continue
+			case c != ',' || inQuote:
+				continue
+			}
+		}
+		kv := fields[begin:n]
+		begin = n + 1
+		eq := strings.LastIndexByte(kv, '=')
+		if eq < 0 {
+			continue
+		}
+		switch kv[eq+1:] {
+		case "NaN", "+Inf", "-Inf":
+			keys = append(keys, fieldKeyUnescaper.Replace(kv[:eq]))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func nonFiniteMetrics(t *testing.T) []telegraf.Metric {
+	var metrics []telegraf.Metric
+	for _, fields := range []map[string]interface{}{
+		{"value": 1.0},
+		{"value": 2.0, "nan": math.NaN(), "inf": math.Inf(1)},
+		{"ninf": math.Inf(-1)},
+	} {
+		m, err := metric.New("cpu", map[string]string{"host": "h1"}, fields, time.Unix(1, 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func TestHandleNonFinite_Drop(t *testing.T) {
+	metrics := nonFiniteMetrics(t)
+	original := metrics[1].String()
+	handled, err := HandleNonFinite(metrics, "drop")
+	require.NoError(t, err)
+	require.Len(t, handled, 2)
+	require.Equal(t, map[string]interface{}{"value": 1.0}, handled[0].Fields())
+	require.Equal(t, map[string]interface{}{"value": 2.0}, handled[1].Fields())
+	require.Equal(t, map[string]string{"host": "h1"}, handled[1].Tags())
+	// the original metrics are left untouched
+	require.Equal(t, original, metrics[1].String())
+}
+
+func TestHandleNonFinite_Zero(t *testing.T) {
+	handled, err := HandleNonFinite(nonFiniteMetrics(t), "zero")
+	require.NoError(t, err)
+	require.Len(t, handled, 3)
+	require.Equal(t, map[string]interface{}{"value": 2.0, "nan": 0.0, "inf": 0.0}, handled[1].Fields())
+	require.Equal(t, map[string]interface{}{"ninf": 0.0}, handled[2].Fields())
+}
+
+func TestHandleNonFinite_Error(t *testing.T) {
+	_, err := HandleNonFinite(nonFiniteMetrics(t), "error")
+	require.Error(t, err)
+}
+
+func TestHandleNonFinite_Finite(t *testing.T) {
+	metrics := nonFiniteMetrics(t)[:1]
+	for _, mode := range []string{"drop", "zero", "error"} {
+		handled, err := HandleNonFinite(metrics, mode)
+		require.NoError(t, err)
+		require.Equal(t, metrics, handled)
+	}
+}
+
+func TestCheckNonFiniteMode(t *testing.T) {
+	for _, mode := range []string{"drop", "zero", "error"} {
+		require.NoError(t, CheckNonFiniteMode(mode))
+	}
+	require.Error(t, CheckNonFiniteMode("ignore"))
+}
+
+func TestNonFiniteFields_Escaping(t *testing.T) {
+	m, err := metric.New("c pu", map[string]string{"host": "h 1"},
+		map[string]interface{}{
+			"idle time": math.NaN(),
+			"a,b":       math.Inf(-1),
+			"msg":       "x=NaN,y=+Inf",
+			"value":     1.0,
+		}, time.Unix(1, 0))
+	require.NoError(t, err)
+	fields := nonFiniteFields(m)
+	sort.Strings(fields)
+	require.Equal(t, []string{"a,b", "idle time"}, fields)
+}
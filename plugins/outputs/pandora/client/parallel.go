@@ -0,0 +1,63 @@
+package client
+
+import (
+	"strings"
+	"sync"
+)
+
+// Errors gathers the errors of several calls.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for n, err := range e {
+		msgs[n] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ForEach calls fn for every key, running at most concurrency calls at a
+// time, and waits for all of them. It returns nil if every call succeeded,
+// the error of the only failing call, or the Errors of the failing calls in
+// the order of keys.
+func ForEach(keys []string, concurrency int, fn func(key string) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(keys) {
+		concurrency = len(keys)
+	}
+
+	results := make([]error, len(keys))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				results[k] = fn(keys[k])
+			}
+		}()
+	}
+	for k := range keys {
+		work <- k
+	}
+	close(work)
+	wg.Wait()
+
+	var errs Errors
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEach(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+
+	var (
+		mu          sync.Mutex
+		done        []string
+		inflight    int
+		maxInflight int
+	)
+	err := ForEach(keys, 2, func(key string) error {
+		mu.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inflight--
+		done = append(done, key)
+		mu.Unlock()
+		return nil
+	})
+	require.NoError(t, err)
+	sort.Strings(done)
+	require.Equal(t, keys, done)
+	require.Equal(t, 2, maxInflight)
+}
+
+func TestForEach_Errors(t *testing.T) {
+	errB := errors.New("b failed")
+	errD := errors.New("d failed")
+	fail := map[string]error{"b": errB, "d": errD}
+
+	err := ForEach([]string{"a", "b", "c"}, 0, func(key string) error {
+		return fail[key]
+	})
+	require.Equal(t, errB, err)
+
+	err = ForEach([]string{"a", "b", "c", "d"}, 4, func(key string) error {
+		return fail[key]
+	})
+	require.Equal(t, Errors{errB, errD}, err)
+	require.Equal(t, "b failed; d failed", err.Error())
+
+	require.NoError(t, ForEach(nil, 4, func(string) error {
+		return errB
+	}))
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pools are the connection pools shared by the outputs, keyed by PoolKey.
+var pools = struct {
+	sync.Mutex
+	m map[string]*pool
+}{m: make(map[string]*pool)}
+
+// pool is a connection pool shared by the transports built with the same
+// PoolKey.
+type pool struct {
+	key       string
+	transport *http.Transport
+	// transports using the pool
+	refs int
+}
+
+// acquirePool returns the pool of key, setting it up with build if no
+// transport uses it yet.
+func acquirePool(key string, build func() *http.Transport) *pool {
+	pools.Lock()
+	defer pools.Unlock()
+	p, ok := pools.m[key]
+	if !ok {
+		p = &pool{key: key, transport: build()}
+		pools.m[key] = p
+	}
+	p.refs++
+	return p
+}
+
+// release drops a reference to the pool, closing its connections when no
+// transport uses it anymore.
+func (p *pool) release() {
+	pools.Lock()
+	defer pools.Unlock()
+	p.refs--
+	if p.refs > 0 {
+		return
+	}
+	delete(pools.m, p.key)
+	p.transport.CloseIdleConnections()
+}
+
+// PoolKey returns the key of the connection pool set up with the given
+// proxy, TLS options, connect timeout and idle connection limits. The
+// outputs passing it as HTTPConfig.PoolKey along the matching options share
+// their connections.
+func PoolKey(httpProxy, tlsCA, tlsCert, tlsKey string, insecureSkipVerify bool, dialTimeout time.Duration,
+	maxIdleConns, maxIdleConnsPerHost int) string {
+	return fmt.Sprintf("%q %q %q %q %t %s %d %d", httpProxy, tlsCA, tlsCert, tlsKey, insecureSkipVerify, dialTimeout,
+		maxIdleConns, maxIdleConnsPerHost)
+}
+
+// pooledTransport is a transport using a shared pool.
+type pooledTransport struct {
+	next http.RoundTripper
+	pool *pool
+	once sync.Once
+}
+
+func (t *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the shared pool, the
+// other transports using it open new ones as needed.
+func (t *pooledTransport) CloseIdleConnections() {
+	CloseIdleConnections(t.next)
+}
+
+// ReleaseTransport is done with rt, a transport built by NewTransport. The
+// connections of a shared pool are closed once all its transports are
+// released, those of other transports right away. Releasing rt more than
+// once has no effect.
+func ReleaseTransport(rt http.RoundTripper) {
+	t, ok := rt.(*pooledTransport)
+	if !ok {
+		CloseIdleConnections(rt)
+		return
+	}
+	t.once.Do(t.pool.release)
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTransport_SharedPool(t *testing.T) {
+	var mu sync.Mutex
+	var addrs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		addrs = append(addrs, r.RemoteAddr)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	get := func(rt http.RoundTripper) {
+		resp, err := (&http.Client{Transport: rt}).Get(ts.URL)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	key := PoolKey("", "", "", "", false, 0, 0, 0)
+	rt1, err := NewTransport(HTTPConfig{PoolKey: key, UserAgent: "a"})
+	require.NoError(t, err)
+	rt2, err := NewTransport(HTTPConfig{PoolKey: key, UserAgent: "b"})
+	require.NoError(t, err)
+	other, err := NewTransport(HTTPConfig{PoolKey: PoolKey("", "", "", "", true, 0, 0, 0)})
+	require.NoError(t, err)
+	defer ReleaseTransport(other)
+
+	get(rt1)
+	get(rt2)
+	get(other)
+	// the transports of the same key reuse the connection
+	require.Len(t, addrs, 3)
+	require.Equal(t, addrs[0], addrs[1])
+	require.NotEqual(t, addrs[0], addrs[2])
+
+	// releasing one transport, even twice, keeps the pool of the other
+	ReleaseTransport(rt1)
+	ReleaseTransport(rt1)
+	get(rt2)
+	require.Equal(t, addrs[0], addrs[3])
+
+	// the pool is closed with its last transport
+	ReleaseTransport(rt2)
+	pools.Lock()
+	_, ok := pools.m[key]
+	pools.Unlock()
+	require.False(t, ok)
+}
+
+func TestNewTransport_SharedPoolInvalid(t *testing.T) {
+	key := PoolKey("", "", "", "", false, 0, 0, 0)
+	_, err := NewTransport(HTTPConfig{PoolKey: key, ContentEncoding: "br"})
+	require.Error(t, err)
+
+	pools.Lock()
+	_, ok := pools.m[key]
+	pools.Unlock()
+	require.False(t, ok)
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+var retentionRe = regexp.MustCompile(`^([1-9]|[12][0-9]|30)d$`)
+
+// CheckRetention validates a series retention against the [1-30]d form
+// accepted by Pandora TSDB.
+func CheckRetention(retention string) error {
+	if !retentionRe.MatchString(retention) {
+		return fmt.Errorf("invalid series retention %q, must be in [1-30]d", retention)
+	}
+	return nil
+}
+
+// CheckRetentionOverrides validates the retentions of a retention_overrides
+// option.
+func CheckRetentionOverrides(overrides map[string]string) error {
+	for series, retention := range overrides {
+		if err := CheckRetention(retention); err != nil {
+			return fmt.Errorf("retention_overrides of %s: %s", series, err)
+		}
+	}
+	return nil
+}
+
+// RetentionDuration returns the duration of a series retention in the
+// [1-30]d form.
+func RetentionDuration(retention string) (time.Duration, error) {
+	if err := CheckRetention(retention); err != nil {
+		return 0, err
+	}
+	days, _ := strconv.Atoi(retention[:len(retention)-1])
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// DropStale drops the metrics older, at now, than the retention of their
+// series, as returned by retention for their name, which Pandora would reject
+// along their whole batch. The metrics of series without a valid retention
+// are kept. It returns the metrics kept, in order, and the number dropped.
+func DropStale(metrics []telegraf.Metric, now time.Time, retention func(series string) string) ([]telegraf.Metric, int) {
+	var kept []telegraf.Metric
+	for n, m := range metrics {
+		d, err := RetentionDuration(retention(m.Name()))
+		if err != nil || !m.Time().Before(now.Add(-d)) {
+			if kept != nil {
+				kept = append(kept, m)
+			}
+			continue
+		}
+		if kept == nil {
+			kept = make([]telegraf.Metric, n, len(metrics))
+			copy(kept, metrics[:n])
+		}
+	}
+	if kept == nil {
+		return metrics, 0
+	}
+	return kept, len(metrics) - len(kept)
+}
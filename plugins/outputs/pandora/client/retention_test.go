@@ -0,0 +1,63 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRetention(t *testing.T) {
+	for _, r := range []string{"1d", "7d", "15d", "30d"} {
+		require.NoError(t, CheckRetention(r), r)
+	}
+	for _, r := range []string{"", "0d", "31d", "7", "7h", "d", "07d"} {
+		require.Error(t, CheckRetention(r), r)
+	}
+}
+
+func TestCheckRetentionOverrides(t *testing.T) {
+	require.NoError(t, CheckRetentionOverrides(nil))
+	require.NoError(t, CheckRetentionOverrides(map[string]string{"cpu": "1d", "mem": "30d"}))
+	err := CheckRetentionOverrides(map[string]string{"cpu": "1d", "mem": "31d"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mem")
+}
+
+func TestRetentionDuration(t *testing.T) {
+	d, err := RetentionDuration("7d")
+	require.NoError(t, err)
+	require.Equal(t, 7*24*time.Hour, d)
+	_, err = RetentionDuration("31d")
+	require.Error(t, err)
+}
+
+func TestDropStale(t *testing.T) {
+	now := time.Date(2017, time.January, 31, 0, 0, 0, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for _, p := range []struct {
+		name string
+		age  time.Duration
+	}{
+		{"cpu", time.Hour},
+		{"cpu", 8 * 24 * time.Hour},
+		{"mem", 8 * 24 * time.Hour},
+		{"disk", 365 * 24 * time.Hour},
+	} {
+		m, err := metric.New(p.name, nil, map[string]interface{}{"value": 1.0}, now.Add(-p.age))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	retentions := map[string]string{"cpu": "7d", "mem": "30d"}
+
+	kept, stale := DropStale(metrics, now, func(series string) string { return retentions[series] })
+	require.Equal(t, 1, stale)
+	// disk has no retention, its points are kept
+	require.Equal(t, []telegraf.Metric{metrics[0], metrics[2], metrics[3]}, kept)
+
+	kept, stale = DropStale(metrics[2:], now, func(series string) string { return retentions[series] })
+	require.Equal(t, 0, stale)
+	require.Len(t, kept, 2)
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"time"
+)
+
+// maxBackoffShift caps the exponential growth of the retry interval.
+const maxBackoffShift = 6
+
+var statusCodeRe = regexp.MustCompile(`(?i)status ?code[=: ]+(\d{3})`)
+
+// IsRetryable reports whether a failed request is worth retrying. Network
+// errors, timeouts and 5xx responses are; Pandora application errors such as
+// a missing repo or a schema mismatch are not.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if m := statusCodeRe.FindStringSubmatch(err.Error()); m != nil {
+		return m[1][0] == '5'
+	}
+	return false
+}
+
+// Backoff returns the delay before retry number attempt (starting at 0): the
+// interval doubled for every previous attempt, half of it randomized.
+func Backoff(interval time.Duration, attempt int) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	if attempt > maxBackoffShift {
+		attempt = maxBackoffShift
+	}
+	d := interval << uint(attempt)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Retry calls fn until it succeeds, fails with an error that is not
+// retryable, or maxRetries retries have been made.
+func Retry(maxRetries int, interval time.Duration, fn func() error) error {
+	err := fn()
+	for attempt := 0; attempt < maxRetries && IsRetryable(err); attempt++ {
+		d := Backoff(interval, attempt)
+		log.Printf("W! Pandora request failed, retrying in %s: %s", d, err)
+		time.Sleep(d)
+		err = fn()
+	}
+	return err
+}
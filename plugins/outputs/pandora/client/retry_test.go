@@ -0,0 +1,71 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestIsRetryable(t *testing.T) {
+	require.False(t, IsRetryable(nil))
+	require.True(t, IsRetryable(timeoutError{}))
+	require.True(t, IsRetryable(errors.New("pandora error: StatusCode=503, ErrorMessage=service unavailable")))
+	require.False(t, IsRetryable(errors.New("pandora error: StatusCode=404, ErrorMessage=E18102: repo does not exist")))
+	require.False(t, IsRetryable(errors.New("E18111: schema does not match")))
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		d := Backoff(time.Second, attempt)
+		max := time.Second << uint(attempt)
+		if attempt > maxBackoffShift {
+			max = time.Second << maxBackoffShift
+		}
+		require.True(t, d >= max/2 && d <= max, "attempt %d: %s", attempt, d)
+	}
+	require.Equal(t, time.Duration(0), Backoff(0, 3))
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := Retry(3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return timeoutError{}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+}
+
+func TestRetry_GivesUp(t *testing.T) {
+	calls := 0
+	err := Retry(2, time.Millisecond, func() error {
+		calls++
+		return timeoutError{}
+	})
+	require.Error(t, err)
+	require.Equal(t, 3, calls)
+}
+
+func TestRetry_NotRetryable(t *testing.T) {
+	calls := 0
+	err := Retry(5, time.Millisecond, func() error {
+		calls++
+		return errors.New("E18102: repo does not exist")
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+}
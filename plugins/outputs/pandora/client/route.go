@@ -0,0 +1,29 @@
+package client
+
+import "github.com/influxdata/telegraf"
+
+// RouteMetrics groups metrics by the value of their tag, falling back to the
+// repo of their measurement in measurementRepos and then to defaultRepo, and
+// strips the tag. Repos are returned in order of appearance.
+func RouteMetrics(metrics []telegraf.Metric, tag string, measurementRepos map[string]string, defaultRepo string) ([]string, map[string][]telegraf.Metric) {
+	var repos []string
+	byRepo := make(map[string][]telegraf.Metric)
+	for _, m := range metrics {
+		repo := defaultRepo
+		if r, ok := measurementRepos[m.Name()]; ok {
+			repo = r
+		}
+		if tag != "" && m.HasTag(tag) {
+			if v := m.Tags()[tag]; v != "" {
+				repo = v
+			}
+			m = m.Copy()
+			m.RemoveTag(tag)
+		}
+		if _, ok := byRepo[repo]; !ok {
+			repos = append(repos, repo)
+		}
+		byRepo[repo] = append(byRepo[repo], m)
+	}
+	return repos, byRepo
+}
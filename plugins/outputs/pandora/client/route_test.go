@@ -0,0 +1,41 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteMetrics(t *testing.T) {
+	newMetric := func(name string, tags map[string]string) telegraf.Metric {
+		m, err := metric.New(name, tags, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+		require.NoError(t, err)
+		return m
+	}
+	tagged := newMetric("cpu", map[string]string{"host": "h1", "repo": "ops"})
+	metrics := []telegraf.Metric{
+		tagged,
+		newMetric("mem", map[string]string{"host": "h1"}),
+		newMetric("cpu", map[string]string{"host": "h2", "repo": ""}),
+		newMetric("disk", map[string]string{"host": "h1", "repo": "ops"}),
+	}
+
+	repos, byRepo := RouteMetrics(metrics, "repo", map[string]string{"mem": "system"}, "default")
+	require.Equal(t, []string{"ops", "system", "default"}, repos)
+	require.Len(t, byRepo["ops"], 2)
+	require.Len(t, byRepo["system"], 1)
+	require.Len(t, byRepo["default"], 1)
+	// the tag is stripped, an empty one too, from copies of the metrics
+	require.Equal(t, map[string]string{"host": "h1"}, byRepo["ops"][0].Tags())
+	require.Equal(t, map[string]string{"host": "h2"}, byRepo["default"][0].Tags())
+	require.Equal(t, "ops", tagged.Tags()["repo"])
+
+	// without tag, only the measurements are routed
+	repos, byRepo = RouteMetrics(metrics, "", nil, "default")
+	require.Equal(t, []string{"default"}, repos)
+	require.Len(t, byRepo["default"], 4)
+	require.True(t, byRepo["default"][0] == tagged)
+}
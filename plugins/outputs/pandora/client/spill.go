@@ -0,0 +1,149 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spillSuffix = ".spill"
+
+// Spill keeps the payloads that could not be written in files of a
+// directory, one file per payload, until they can be replayed. The oldest
+// files are removed when the directory grows past maxBytes.
+type Spill struct {
+	dir      string
+	maxBytes int64
+
+	mu  sync.Mutex
+	seq int
+}
+
+// NewSpill returns a Spill storing its files in dir, which is created on
+// the first Append. maxBytes <= 0 means no limit.
+func NewSpill(dir string, maxBytes int64) *Spill {
+	return &Spill{dir: dir, maxBytes: maxBytes}
+}
+
+// Append stores payload in a new file.
+func (s *Spill) Append(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxBytes > 0 && int64(len(payload)) > s.maxBytes {
+		return fmt.Errorf("payload of %d bytes is larger than max_spill_bytes", len(payload))
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	// names sort in the order the payloads were spilled
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spillSuffix)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, payload, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return s.truncate()
+}
+
+// Replay hands the stored payloads to fn, oldest first, and removes each
+// once fn succeeds. It stops at the first error worth retrying, see
+// IsRetryable, the remaining payloads are kept for the next replay. The
+// payloads failing with other errors, which replaying them again would not
+// fix, are removed and handed to dropped, which may be nil, with the error.
+func (s *Spill) Replay(fn func(payload []byte) error, dropped func(payload []byte, err error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		path := filepath.Join(s.dir, f.Name())
+		payload, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := fn(payload); err != nil {
+			if IsRetryable(err) {
+				return err
+			}
+			if dropped != nil {
+				dropped(payload, err)
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of stored payloads.
+func (s *Spill) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, _ := s.files()
+	return len(files)
+}
+
+// files returns the spill files, oldest first.
+func (s *Spill) files() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []os.FileInfo
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), spillSuffix) {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+// truncate removes the oldest files until the directory fits in maxBytes.
+func (s *Spill) truncate() error {
+	if s.maxBytes <= 0 {
+		return nil
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	for _, f := range files {
+		if total <= s.maxBytes {
+			break
+		}
+		log.Printf("W! spill directory %s is full, dropping %s", s.dir, f.Name())
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err != nil {
+			return err
+		}
+		total -= f.Size()
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpill_AppendReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewSpill(filepath.Join(dir, "repo"), 0)
+	require.Equal(t, 0, s.Len())
+	require.NoError(t, s.Replay(func([]byte) error {
+		t.Fatal("nothing to replay")
+		return nil
+	}, nil))
+
+	for _, p := range []string{"a", "b", "c"} {
+		require.NoError(t, s.Append([]byte(p)))
+	}
+	require.Equal(t, 3, s.Len())
+
+	// replay stops at the first failure worth retrying and keeps the rest
+	var replayed []string
+	err = s.Replay(func(p []byte) error {
+		if string(p) == "b" {
+			return errors.New("status code: 503")
+		}
+		replayed = append(replayed, string(p))
+		return nil
+	}, nil)
+	require.Error(t, err)
+	require.Equal(t, []string{"a"}, replayed)
+	require.Equal(t, 2, s.Len())
+
+	replayed = nil
+	require.NoError(t, s.Replay(func(p []byte) error {
+		replayed = append(replayed, string(p))
+		return nil
+	}, nil))
+	require.Equal(t, []string{"b", "c"}, replayed)
+	require.Equal(t, 0, s.Len())
+}
+
+func TestSpill_ReplayDropsRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewSpill(dir, 0)
+	for _, p := range []string{"a", "b", "c"} {
+		require.NoError(t, s.Append([]byte(p)))
+	}
+
+	// a payload rejected for good does not hold back the ones after it
+	rejected := errors.New("E18111: schema mismatch")
+	var replayed, dropped []string
+	require.NoError(t, s.Replay(func(p []byte) error {
+		if string(p) == "b" {
+			return rejected
+		}
+		replayed = append(replayed, string(p))
+		return nil
+	}, func(p []byte, err error) {
+		require.Equal(t, rejected, err)
+		dropped = append(dropped, string(p))
+	}))
+	require.Equal(t, []string{"a", "c"}, replayed)
+	require.Equal(t, []string{"b"}, dropped)
+	require.Equal(t, 0, s.Len())
+}
+
+func TestSpill_MaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewSpill(dir, 10)
+	require.Error(t, s.Append([]byte("more than ten bytes")))
+	for _, p := range []string{"1111", "2222", "3333"} {
+		require.NoError(t, s.Append([]byte(p)))
+	}
+
+	// the oldest payload was dropped to stay under 10 bytes
+	var replayed []string
+	require.NoError(t, s.Replay(func(p []byte) error {
+		replayed = append(replayed, string(p))
+		return nil
+	}, nil))
+	require.Equal(t, []string{"2222", "3333"}, replayed)
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// Stats are the counters of an output writing to a repo, reported by the
+// internal input as the internal_pandora measurement.
+type Stats struct {
+	PointsWritten selfstat.Stat
+	// points left without fields by the transforms of the output, older
+	// than their retention with drop_stale_points, or spilled and then
+	// rejected for good when replayed
+	PointsDropped selfstat.Stat
+	BytesSent     selfstat.Stat
+	WriteErrors   selfstat.Stat
+	Retries       selfstat.Stat
+	SchemaUpdates selfstat.Stat
+	// size and records of the payloads serialized by the writes, averaged
+	// over every collection interval, and the largest payload so far
+	PayloadBytes    selfstat.Stat
+	PayloadRecords  selfstat.Stat
+	PayloadBytesMax selfstat.Stat
+
+	repo string
+}
+
+// NewStats registers the counters of the given output writing to repo.
+// Outputs writing to the same repo share their counters.
+func NewStats(output, repo string) *Stats {
+	tags := map[string]string{
+		"output": output,
+		"repo":   repo,
+	}
+	return &Stats{
+		PointsWritten: selfstat.Register("pandora", "points_written", tags),
+		PointsDropped: selfstat.Register("pandora", "points_dropped", tags),
+		BytesSent:     selfstat.Register("pandora", "bytes_sent", tags),
+		WriteErrors:   selfstat.Register("pandora", "write_errors", tags),
+		Retries:       selfstat.Register("pandora", "retries", tags),
+		SchemaUpdates: selfstat.Register("pandora", "schema_updates", tags),
+
+		PayloadBytes:    selfstat.RegisterTiming("pandora", "payload_bytes", tags),
+		PayloadRecords:  selfstat.RegisterTiming("pandora", "payload_records", tags),
+		PayloadBytesMax: selfstat.Register("pandora", "payload_bytes_max", tags),
+
+		repo: repo,
+	}
+}
+
+// RecordPayload records the size and the number of records of the payload
+// serialized by a write.
+func (s *Stats) RecordPayload(bytes, records int) {
+	s.PayloadBytes.Incr(int64(bytes))
+	s.PayloadRecords.Incr(int64(records))
+	if int64(bytes) > s.PayloadBytesMax.Get() {
+		s.PayloadBytesMax.Set(int64(bytes))
+	}
+}
+
+// RecordDropped records the points dropped by the transforms of a write,
+// given the number of points before and after them, and logs them.
+func (s *Stats) RecordDropped(before, after int) {
+	if dropped := before - after; dropped > 0 {
+		s.PointsDropped.Incr(int64(dropped))
+		log.Printf("D! dropped %d points of repo %s left without fields", dropped, s.repo)
+	}
+}
+
+// RecordStale records the points dropped for being older than the retention
+// of their series, and logs them.
+func (s *Stats) RecordStale(stale int) {
+	if stale > 0 {
+		s.PointsDropped.Incr(int64(stale))
+		log.Printf("W! dropped %d points of repo %s older than the retention of their series", stale, s.repo)
+	}
+}
+
+// RecordSpillRejected records the points of a spilled payload, one per
+// line, dropped as their replay failed with err, which retrying would not
+// fix, and logs them.
+func (s *Stats) RecordSpillRejected(payload []byte, err error) {
+	points := bytes.Count(payload, []byte("\n"))
+	s.PointsDropped.Incr(int64(points))
+	log.Printf("E! dropped %d spilled points of repo %s rejected on replay: %s", points, s.repo, err)
+}
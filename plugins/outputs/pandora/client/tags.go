@@ -0,0 +1,117 @@
+package client
+
+import (
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// AddDefaultTags adds the tags to the metrics missing them, the tags of the
+// metrics take precedence. The metrics are not modified, those missing a tag
+// are copied. It must run after HandleNonFinite, as copying a metric loses
+// its NaN and infinite fields.
+func AddDefaultTags(metrics []telegraf.Metric, tags map[string]string) ([]telegraf.Metric, error) {
+	if len(tags) == 0 {
+		return metrics, nil
+	}
+	tagged := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		mtags := m.Tags()
+		missing := false
+		for k := range tags {
+			if _, ok := mtags[k]; !ok {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			tagged = append(tagged, m)
+			continue
+		}
+
+		for k, v := range tags {
+			if _, ok := mtags[k]; !ok {
+				mtags[k] = v
+			}
+		}
+		taggedMetric, err := metric.New(m.Name(), mtags, m.Fields(), m.Time(), m.Type())
+		if err != nil {
+			return nil, err
+		}
+		tagged = append(tagged, taggedMetric)
+	}
+	return tagged, nil
+}
+
+// DropTags removes the tags from the metrics. The metrics are not modified,
+// those with such tags are copied. Like AddDefaultTags, it must run after
+// HandleNonFinite.
+func DropTags(metrics []telegraf.Metric, keys []string) ([]telegraf.Metric, error) {
+	if len(keys) == 0 {
+		return metrics, nil
+	}
+	kept := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		tags := m.Tags()
+		dropped := false
+		for _, k := range keys {
+			if _, ok := tags[k]; ok {
+				delete(tags, k)
+				dropped = true
+			}
+		}
+		if !dropped {
+			kept = append(kept, m)
+			continue
+		}
+
+		keptMetric, err := metric.New(m.Name(), tags, m.Fields(), m.Time(), m.Type())
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, keptMetric)
+	}
+	return kept, nil
+}
+
+// RenameTags renames the tags of the metrics found in renames, a tag renamed
+// to the name of another tag replaces it. The metrics are not modified,
+// those with such tags are copied. Like AddDefaultTags, it must run after
+// HandleNonFinite.
+func RenameTags(metrics []telegraf.Metric, renames map[string]string) ([]telegraf.Metric, error) {
+	if len(renames) == 0 {
+		return metrics, nil
+	}
+	renamed := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		tags := m.Tags()
+		found := false
+		for k := range tags {
+			if _, ok := renames[k]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			renamed = append(renamed, m)
+			continue
+		}
+
+		out := make(map[string]string, len(tags))
+		for k, v := range tags {
+			if _, ok := renames[k]; !ok {
+				out[k] = v
+			}
+		}
+		for k, v := range tags {
+			if to, ok := renames[k]; ok {
+				out[to] = v
+			}
+		}
+		renamedMetric, err := metric.New(m.Name(), out, m.Fields(), m.Time(), m.Type())
+		if err != nil {
+			return nil, err
+		}
+		renamed = append(renamed, renamedMetric)
+	}
+	return renamed, nil
+}
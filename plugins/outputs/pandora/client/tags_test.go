@@ -0,0 +1,70 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddDefaultTags(t *testing.T) {
+	m1, err := metric.New("cpu", map[string]string{"host": "h1"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": "h2", "dc": "sh"}, map[string]interface{}{"value": 2.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	original := m1.String()
+
+	tagged, err := AddDefaultTags([]telegraf.Metric{m1, m2}, map[string]string{"dc": "nb"})
+	require.NoError(t, err)
+	require.Len(t, tagged, 2)
+	require.Equal(t, map[string]string{"host": "h1", "dc": "nb"}, tagged[0].Tags())
+	require.Equal(t, map[string]interface{}{"value": 1.0}, tagged[0].Fields())
+	// the tags of the metric win
+	require.Equal(t, map[string]string{"host": "h2", "dc": "sh"}, tagged[1].Tags())
+	// the original metrics are left untouched
+	require.Equal(t, original, m1.String())
+}
+
+func TestDropTags(t *testing.T) {
+	m1, err := metric.New("cpu", map[string]string{"host": "h1", "pid": "42"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": "h2"}, map[string]interface{}{"value": 2.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	original := m1.String()
+
+	kept, err := DropTags([]telegraf.Metric{m1, m2}, []string{"pid"})
+	require.NoError(t, err)
+	require.Len(t, kept, 2)
+	require.Equal(t, map[string]string{"host": "h1"}, kept[0].Tags())
+	require.Equal(t, map[string]interface{}{"value": 1.0}, kept[0].Fields())
+	require.Equal(t, map[string]string{"host": "h2"}, kept[1].Tags())
+	require.Equal(t, original, m1.String())
+}
+
+func TestRenameTags(t *testing.T) {
+	m1, err := metric.New("cpu", map[string]string{"host": "h1", "time": "t1"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": "h2"}, map[string]interface{}{"value": 2.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	original := m1.String()
+
+	renamed, err := RenameTags([]telegraf.Metric{m1, m2}, map[string]string{"time": "time_tag"})
+	require.NoError(t, err)
+	require.Len(t, renamed, 2)
+	require.Equal(t, map[string]string{"host": "h1", "time_tag": "t1"}, renamed[0].Tags())
+	require.Equal(t, map[string]interface{}{"value": 1.0}, renamed[0].Fields())
+	// metrics without such tags are passed as is
+	require.True(t, renamed[1] == m2)
+	require.Equal(t, original, m1.String())
+
+	// a tag renamed to the name of another tag replaces it
+	renamed, err = RenameTags([]telegraf.Metric{m1}, map[string]string{"time": "host"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"host": "t1"}, renamed[0].Tags())
+
+	renamed, err = RenameTags([]telegraf.Metric{m1, m2}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []telegraf.Metric{m1, m2}, renamed)
+}
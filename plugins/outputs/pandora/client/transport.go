@@ -0,0 +1,448 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPConfig holds the transport options shared by the Pandora outputs.
+type HTTPConfig struct {
+	// ContentEncoding is the encoding used for data posts, "gzip" or
+	// "identity". An empty string means "identity".
+	ContentEncoding string
+
+	// CompressionThreshold is the size of the smallest data post compressed
+	// with ContentEncoding, smaller posts are sent as is. 0 compresses all
+	// of them.
+	CompressionThreshold int
+
+	// HTTPProxy is the proxy requests are sent through. When empty the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.
+	HTTPProxy string
+
+	// TLSConfig is used for https endpoints, nil means the system defaults.
+	TLSConfig *tls.Config
+
+	// DialTimeout bounds the connection setup, 0 means no timeout.
+	DialTimeout time.Duration
+
+	// MaxIdleConns bounds the idle connections kept open, 0 means no limit.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost bounds the idle connections kept open to a host,
+	// 0 means http.DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+
+	// PoolKey, when set, makes the transports built with the same key share
+	// their connection pool, set up by the first of them. It must identify
+	// HTTPProxy, TLSConfig, DialTimeout and the idle connection limits, see
+	// the PoolKey function. The transports are released with
+	// ReleaseTransport.
+	PoolKey string
+
+	// Deadline, when set, bounds every request, from DNS resolution and
+	// connection setup to reading the response.
+	Deadline *Deadline
+
+	// RequestTimeout bounds every request on its own, like Deadline, when
+	// no Deadline is set. 0 means no timeout.
+	RequestTimeout time.Duration
+
+	// UserAgent is the User-Agent header of every request, empty keeps the
+	// one set by the SDK.
+	UserAgent string
+
+	// Headers are set on every request, see CheckHeaders for the names
+	// allowed.
+	Headers map[string]string
+
+	// SecurityToken, when set, is sent in the SecurityTokenHeader of every
+	// request.
+	SecurityToken *Token
+
+	// IdempotencyKeys, when set, holds the keys sent in the
+	// IdempotencyKeyHeader of data posts, so that a post retried after its
+	// response was lost can be told apart from a new one.
+	IdempotencyKeys *IdempotencyKeys
+}
+
+// SecurityTokenHeader is the header carrying the security token of
+// temporary credentials.
+const SecurityTokenHeader = "X-Security-Token"
+
+// IdempotencyKeyHeader is the header carrying the idempotency key of data
+// posts.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultUserAgent is the User-Agent header sent by the Pandora outputs.
+const DefaultUserAgent = "telegraf-pandora"
+
+// NewTransport builds the http.RoundTripper handed to the Pandora SDK.
+func NewTransport(config HTTPConfig) (http.RoundTripper, error) {
+	proxy := http.ProxyFromEnvironment
+	if config.HTTPProxy != "" {
+		u, err := url.Parse(config.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config.HTTPProxy: %s", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("config.HTTPProxy must be an http(s) URL with a host, got %q",
+				config.HTTPProxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	switch config.ContentEncoding {
+	case "", "identity", "gzip":
+	default:
+		return nil, fmt.Errorf("unsupported content_encoding %q, must be gzip or identity",
+			config.ContentEncoding)
+	}
+	if err := CheckHeaders(config.Headers); err != nil {
+		return nil, err
+	}
+	if config.MaxIdleConns < 0 || config.MaxIdleConnsPerHost < 0 {
+		return nil, fmt.Errorf("idle connection limits must not be negative, got %d and %d per host",
+			config.MaxIdleConns, config.MaxIdleConnsPerHost)
+	}
+
+	build := func() *http.Transport {
+		dialer := &net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		return &http.Transport{
+			Proxy:               proxy,
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     config.TLSConfig,
+			MaxIdleConns:        config.MaxIdleConns,
+			MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		}
+	}
+	var rt http.RoundTripper
+	var shared *pool
+	if config.PoolKey != "" {
+		shared = acquirePool(config.PoolKey, build)
+		rt = shared.transport
+	} else {
+		rt = build()
+	}
+
+	if config.ContentEncoding == "gzip" {
+		rt = &gzipTransport{next: rt, threshold: config.CompressionThreshold}
+	}
+
+	// the keys are found by the body before it is compressed
+	if config.IdempotencyKeys != nil {
+		rt = &idempotencyTransport{next: rt, keys: config.IdempotencyKeys}
+	}
+
+	if config.Deadline != nil || config.RequestTimeout > 0 {
+		rt = &deadlineTransport{next: rt, deadline: config.Deadline, timeout: config.RequestTimeout}
+	}
+
+	if config.UserAgent != "" {
+		rt = &userAgentTransport{next: rt, userAgent: config.UserAgent}
+	}
+
+	if len(config.Headers) > 0 {
+		rt = &headerTransport{next: rt, headers: config.Headers}
+	}
+
+	if config.SecurityToken != nil {
+		rt = &tokenTransport{next: rt, token: config.SecurityToken}
+	}
+
+	if shared != nil {
+		rt = &pooledTransport{next: rt, pool: shared}
+	}
+	return rt, nil
+}
+
+// CloseIdleConnections closes the idle connections kept by rt, if any.
+func CloseIdleConnections(rt http.RoundTripper) {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if c, ok := rt.(closeIdler); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// gzipTransport compresses the body of data posts of at least threshold
+// bytes. Control-plane requests (repo, series and export management) are
+// JSON and are sent as is.
+type gzipTransport struct {
+	next      http.RoundTripper
+	threshold int
+}
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isDataPost(req) || req.Header.Get("Content-Encoding") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < t.threshold {
+		r := cloneRequest(req)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		return t.next.RoundTrip(r)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	r := cloneRequest(req)
+	r.Body = ioutil.NopCloser(&buf)
+	r.ContentLength = int64(buf.Len())
+	r.Header.Set("Content-Encoding", "gzip")
+	return t.next.RoundTrip(r)
+}
+
+func (t *gzipTransport) CloseIdleConnections() {
+	CloseIdleConnections(t.next)
+}
+
+// isDataPost reports whether req posts data, which is sent as text, rather
+// than being a control-plane request.
+func isDataPost(req *http.Request) bool {
+	return req.Body != nil && strings.HasPrefix(req.Header.Get("Content-Type"), "text/plain")
+}
+
+// idempotencyTransport sets the IdempotencyKeyHeader of data posts to the
+// key of the batch they post, see IdempotencyKeys.Start. Posts of a body
+// no batch was started for are sent without key.
+type idempotencyTransport struct {
+	next http.RoundTripper
+	keys *IdempotencyKeys
+}
+
+func (t *idempotencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isDataPost(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r := cloneRequest(req)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	if key := t.keys.Key(body); key != "" {
+		r.Header.Set(IdempotencyKeyHeader, key)
+	}
+	return t.next.RoundTrip(r)
+}
+
+func (t *idempotencyTransport) CloseIdleConnections() {
+	CloseIdleConnections(t.next)
+}
+
+// userAgentTransport sets the User-Agent header of every request.
+type userAgentTransport struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := cloneRequest(req)
+	r.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(r)
+}
+
+func (t *userAgentTransport) CloseIdleConnections() {
+	CloseIdleConnections(t.next)
+}
+
+// reservedHeaders are set by the SDK or by the transport itself.
+var reservedHeaders = map[string]bool{
+	"Authorization":      true,
+	"Content-Encoding":   true,
+	"Content-Length":     true,
+	"Content-Type":       true,
+	"Host":               true,
+	"User-Agent":         true,
+	SecurityTokenHeader:  true,
+	IdempotencyKeyHeader: true,
+}
+
+// CheckHeaders validates the names and values of custom headers. Headers
+// set by the SDK, the User-Agent (see user_agent), the security token, the
+// idempotency key and the X-Qiniu- headers, which are part of the request
+// signature, cannot be overridden.
+func CheckHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if !isToken(name) {
+			return fmt.Errorf("invalid http_headers name %q", name)
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if reservedHeaders[canonical] || strings.HasPrefix(canonical, "X-Qiniu-") {
+			return fmt.Errorf("http_headers must not set %s", canonical)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid http_headers value of %s, must not contain line breaks", canonical)
+		}
+	}
+	return nil
+}
+
+// isToken reports whether s is a valid header name, as defined by RFC 7230.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// headerTransport sets custom headers on every request.
+type headerTransport struct {
+	next    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := cloneRequest(req)
+	for name, value := range t.headers {
+		r.Header.Set(name, value)
+	}
+	return t.next.RoundTrip(r)
+}
+
+func (t *headerTransport) CloseIdleConnections() {
+	CloseIdleConnections(t.next)
+}
+
+// tokenTransport sends the current security token with every request, so
+// that a renewed token is used without rebuilding the SDK clients.
+type tokenTransport struct {
+	next  http.RoundTripper
+	token *Token
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token.Get()
+	if err != nil {
+		return nil, err
+	}
+	r := cloneRequest(req)
+	r.Header.Set(SecurityTokenHeader, token)
+	return t.next.RoundTrip(r)
+}
+
+func (t *tokenTransport) CloseIdleConnections() {
+	CloseIdleConnections(t.next)
+}
+
+// Deadline is the point in time the requests in progress must complete by.
+// An output sets it at the start of a write and clears it at the end.
+type Deadline struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// Set sets the deadline, the zero time clears it.
+func (d *Deadline) Set(t time.Time) {
+	d.mu.Lock()
+	d.t = t
+	d.mu.Unlock()
+}
+
+// Get returns the deadline, the zero time if none is set.
+func (d *Deadline) Get() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t
+}
+
+// deadlineTransport cancels the requests still running at the deadline, or
+// timeout after they started when no deadline is set, so that a slow DNS
+// lookup or connect cannot hang a write past its timeout.
+type deadlineTransport struct {
+	next     http.RoundTripper
+	deadline *Deadline
+	timeout  time.Duration
+}
+
+func (t *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var deadline time.Time
+	if t.deadline != nil {
+		deadline = t.deadline.Get()
+	}
+	if deadline.IsZero() && t.timeout > 0 {
+		deadline = time.Now().Add(t.timeout)
+	}
+	if deadline.IsZero() {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithDeadline(req.Context(), deadline)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the response body is read under the deadline too
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (t *deadlineTransport) CloseIdleConnections() {
+	CloseIdleConnections(t.next)
+}
+
+// cancelBody releases the context of a request once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// cloneRequest returns a shallow copy of req with a deep copy of its headers,
+// since a RoundTripper must not modify the request it is given.
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	return r
+}
@@ -0,0 +1,455 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTransport_InvalidContentEncoding(t *testing.T) {
+	_, err := NewTransport(HTTPConfig{ContentEncoding: "br"})
+	require.Error(t, err)
+}
+
+func TestGzipTransport(t *testing.T) {
+	data := []byte("cpu_host=h1\tcpu_value=1\ttimestamp=1000000000\n")
+
+	var received []byte
+	var encoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		received, err = ioutil.ReadAll(gz)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	rt, err := NewTransport(HTTPConfig{ContentEncoding: "gzip"})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", ts.URL+"/v2/repos/test/data", bytes.NewReader(data))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, "gzip", encoding)
+	require.Equal(t, data, received)
+	require.Equal(t, "", req.Header.Get("Content-Encoding"))
+}
+
+func TestGzipTransport_Threshold(t *testing.T) {
+	var (
+		encodings []string
+		received  []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, encoding)
+		body := r.Body
+		if encoding == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = gz
+		}
+		data, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+		received = append(received, string(data))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	rt, err := NewTransport(HTTPConfig{ContentEncoding: "gzip", CompressionThreshold: 64})
+	require.NoError(t, err)
+
+	small := "cpu_host=h1\tcpu_value=1\ttimestamp=1000000000\n"
+	large := strings.Repeat(small, 4)
+	for _, data := range []string{small, large} {
+		req, err := http.NewRequest("POST", ts.URL+"/v2/repos/test/data", strings.NewReader(data))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "text/plain")
+
+		resp, err := (&http.Client{Transport: rt}).Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	require.Equal(t, []string{"", "gzip"}, encodings)
+	require.Equal(t, []string{small, large}, received)
+}
+
+func TestGzipTransport_SkipsJSON(t *testing.T) {
+	var encoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	rt, err := NewTransport(HTTPConfig{ContentEncoding: "gzip"})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", ts.URL+"/v2/repos/test", bytes.NewBufferString(`{"region":"nb"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, "", encoding)
+}
+
+func TestUserAgentTransport(t *testing.T) {
+	var userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	rt, err := NewTransport(HTTPConfig{UserAgent: "telegraf-test"})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", ts.URL+"/v2/repos/test", nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", "sdk")
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, "telegraf-test", userAgent)
+	require.Equal(t, "sdk", req.Header.Get("User-Agent"))
+}
+
+func TestHeaderTransport(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	rt, err := NewTransport(HTTPConfig{Headers: map[string]string{
+		"X-Tenant-Id": "t1",
+		"x-route":     "nb",
+	}})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", ts.URL+"/v2/repos/test/data", strings.NewReader("a=1"))
+	require.NoError(t, err)
+	req.Header.Set("X-Tenant-Id", "sdk")
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, "t1", header.Get("X-Tenant-Id"))
+	require.Equal(t, "nb", header.Get("X-Route"))
+	require.Equal(t, "sdk", req.Header.Get("X-Tenant-Id"))
+}
+
+func TestTokenTransport(t *testing.T) {
+	var tokens []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get(SecurityTokenHeader))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "pandora")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("token1"), 0600))
+
+	token, err := NewToken("SecurityToken", "", path)
+	require.NoError(t, err)
+	rt, err := NewTransport(HTTPConfig{SecurityToken: token})
+	require.NoError(t, err)
+	c := &http.Client{Transport: rt}
+
+	for _, v := range []string{"token1", "token2"} {
+		require.NoError(t, ioutil.WriteFile(path, []byte(v), 0600))
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(path, later, later))
+		resp, err := c.Get(ts.URL + "/v2/repos/test")
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	require.Equal(t, []string{"token1", "token2"}, tokens)
+
+	require.Error(t, CheckHeaders(map[string]string{SecurityTokenHeader: "v"}))
+}
+
+func TestCheckHeaders(t *testing.T) {
+	require.NoError(t, CheckHeaders(nil))
+	require.NoError(t, CheckHeaders(map[string]string{"X-Tenant-Id": "t1", "x_route": ""}))
+
+	for _, headers := range []map[string]string{
+		{"": "v"},
+		{"X Tenant": "v"},
+		{"X-Tenant:": "v"},
+		{"authorization": "v"},
+		{"Content-Type": "v"},
+		{"User-Agent": "v"},
+		{"x-qiniu-date": "v"},
+		{"X-Tenant-Id": "t1\r\nX-Other: v"},
+	} {
+		require.Error(t, CheckHeaders(headers), "%v", headers)
+		_, err := NewTransport(HTTPConfig{Headers: headers})
+		require.Error(t, err, "%v", headers)
+	}
+}
+
+func TestTransport_SelfSignedCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	ca, err := ioutil.TempFile("", "pandora-ca")
+	require.NoError(t, err)
+	defer os.Remove(ca.Name())
+	require.NoError(t, pem.Encode(ca, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ts.TLS.Certificates[0].Certificate[0],
+	}))
+	require.NoError(t, ca.Close())
+
+	// without the CA the self-signed certificate is rejected
+	rt, err := NewTransport(HTTPConfig{})
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: rt}).Get(ts.URL)
+	require.Error(t, err)
+
+	tlsConfig, err := internal.GetTLSConfig("", "", ca.Name(), false)
+	require.NoError(t, err)
+	rt, err = NewTransport(HTTPConfig{TLSConfig: tlsConfig})
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: rt}).Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestNewTransport_InvalidHTTPProxy(t *testing.T) {
+	for _, proxy := range []string{"://proxy", "proxy:3128", "ftp://proxy:3128", "http://"} {
+		_, err := NewTransport(HTTPConfig{HTTPProxy: proxy})
+		require.Error(t, err, proxy)
+	}
+}
+
+func TestTransport_HTTPProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	rt, err := NewTransport(HTTPConfig{HTTPProxy: proxy.URL})
+	require.NoError(t, err)
+
+	resp, err := (&http.Client{Transport: rt}).Get("http://pipeline.example.com/v2/repos")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "http://pipeline.example.com/v2/repos", proxied)
+}
+
+func TestDeadlineTransport(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	deadline := &Deadline{}
+	rt, err := NewTransport(HTTPConfig{Deadline: deadline})
+	require.NoError(t, err)
+
+	deadline.Set(time.Now().Add(100 * time.Millisecond))
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = rt.RoundTrip(req)
+	require.Error(t, err)
+	require.True(t, time.Since(start) < time.Second, "took %s", time.Since(start))
+}
+
+func TestDeadlineTransport_Cleared(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	deadline := &Deadline{}
+	rt, err := NewTransport(HTTPConfig{Deadline: deadline})
+	require.NoError(t, err)
+
+	for _, d := range []time.Time{time.Time{}, time.Now().Add(time.Second)} {
+		deadline.Set(d)
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, "ok", string(body))
+	}
+}
+
+func TestDeadlineTransport_RequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	rt, err := NewTransport(HTTPConfig{RequestTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+
+	// every request gets the timeout of its own
+	for n := 0; n < 2; n++ {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		time.Sleep(60 * time.Millisecond)
+	}
+
+	req, err := http.NewRequest("GET", ts.URL+"/slow", nil)
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = rt.RoundTrip(req)
+	require.Error(t, err)
+	require.True(t, time.Since(start) < time.Second, "took %s", time.Since(start))
+}
+
+func TestNewTransport_DialTimeout(t *testing.T) {
+	rt, err := NewTransport(HTTPConfig{DialTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+
+	// 10.255.255.1 is not routed, connecting to it hangs until the timeout
+	req, err := http.NewRequest("GET", "http://10.255.255.1:8080", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = rt.RoundTrip(req)
+	require.Error(t, err)
+	require.True(t, time.Since(start) < 2*time.Second, "took %s", time.Since(start))
+}
+
+func TestNewTransport_IdleConns(t *testing.T) {
+	// base returns the http.Transport wrapped by rt
+	base := func(rt http.RoundTripper) *http.Transport {
+		for {
+			switch t := rt.(type) {
+			case *http.Transport:
+				return t
+			case *pooledTransport:
+				rt = t.next
+			case *userAgentTransport:
+				rt = t.next
+			default:
+				return nil
+			}
+		}
+	}
+
+	rt, err := NewTransport(HTTPConfig{MaxIdleConns: 50, MaxIdleConnsPerHost: 20, UserAgent: "a"})
+	require.NoError(t, err)
+	tr := base(rt)
+	require.NotNil(t, tr)
+	require.Equal(t, 50, tr.MaxIdleConns)
+	require.Equal(t, 20, tr.MaxIdleConnsPerHost)
+
+	key := PoolKey("", "", "", "", false, 0, 50, 20)
+	rt, err = NewTransport(HTTPConfig{PoolKey: key, MaxIdleConns: 50, MaxIdleConnsPerHost: 20})
+	require.NoError(t, err)
+	defer ReleaseTransport(rt)
+	tr = base(rt)
+	require.NotNil(t, tr)
+	require.Equal(t, 50, tr.MaxIdleConns)
+	require.Equal(t, 20, tr.MaxIdleConnsPerHost)
+
+	_, err = NewTransport(HTTPConfig{MaxIdleConnsPerHost: -1})
+	require.EqualError(t, err, "idle connection limits must not be negative, got 0 and -1 per host")
+}
+
+func TestIdempotencyTransport(t *testing.T) {
+	var sent, bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sent = append(sent, r.Header.Get(IdempotencyKeyHeader))
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	keys := &IdempotencyKeys{}
+	rt, err := NewTransport(HTTPConfig{IdempotencyKeys: keys})
+	require.NoError(t, err)
+	c := &http.Client{Transport: rt}
+	post := func(contentType, body string) {
+		req, err := http.NewRequest("POST", ts.URL+"/v2/repos/test/data", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// a batch and its retry, then a new batch of the same bytes
+	_, done := keys.Start([]byte("a=1"))
+	post("text/plain", "a=1")
+	post("text/plain", "a=1")
+	done()
+	_, done = keys.Start([]byte("a=1"))
+	post("text/plain", "a=1")
+	done()
+	// no batch started
+	post("text/plain", "a=2")
+	post("application/json", `{"region":"nb"}`)
+
+	require.Len(t, sent, 5)
+	require.Len(t, sent[0], 32)
+	require.Equal(t, sent[0], sent[1])
+	require.NotEqual(t, sent[0], sent[2])
+	require.NotEmpty(t, sent[2])
+	require.Equal(t, "", sent[3])
+	require.Equal(t, "a=2", bodies[3])
+	require.Equal(t, "", sent[4])
+	require.Equal(t, `{"region":"nb"}`, bodies[4])
+
+	require.Error(t, CheckHeaders(map[string]string{IdempotencyKeyHeader: "v"}))
+}
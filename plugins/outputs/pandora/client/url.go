@@ -0,0 +1,77 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// CheckURL validates the endpoint URL of the option name: an http(s) URL
+// with a well-formed host and port. IPv6 addresses must be enclosed in
+// brackets, as in http://[::1]:8080, which the SDKs would otherwise fail on
+// with obscure errors.
+func CheckURL(name, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("error parsing config.%s: %s", name, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("config.%s scheme must be http(s), got %s", name, u.Scheme)
+	}
+	if err := checkHost(u.Host); err != nil {
+		return fmt.Errorf("invalid config.%s host %q: %s", name, u.Host, err)
+	}
+	return nil
+}
+
+// checkHost validates the host[:port] part of a URL.
+func checkHost(host string) error {
+	var port string
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return fmt.Errorf("missing ] after IPv6 address")
+		}
+		ip := host[1:end]
+		// a zone, as in [fe80::1%25eth0], is not part of the address
+		if n := strings.Index(ip, "%"); n >= 0 {
+			ip = ip[:n]
+		}
+		if parsed := net.ParseIP(ip); parsed == nil || !strings.Contains(ip, ":") {
+			return fmt.Errorf("%s is not an IPv6 address", host[1:end])
+		}
+		rest := host[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return fmt.Errorf("unexpected %q after IPv6 address", rest)
+			}
+			port = rest[1:]
+			if port == "" {
+				return fmt.Errorf("empty port")
+			}
+		}
+	} else {
+		switch strings.Count(host, ":") {
+		case 0:
+		case 1:
+			n := strings.Index(host, ":")
+			host, port = host[:n], host[n+1:]
+			if port == "" {
+				return fmt.Errorf("empty port")
+			}
+		default:
+			return fmt.Errorf("IPv6 addresses must be enclosed in brackets, as in [::1]:8080")
+		}
+		if host == "" {
+			return fmt.Errorf("missing host name")
+		}
+	}
+	if port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port %q, must be in [1-65535]", port)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckURL(t *testing.T) {
+	for _, u := range []string{
+		"https://pipeline.qiniu.com",
+		"http://10.0.0.1:8080",
+		"http://[::1]:8080",
+		"http://[2001:db8::1]",
+		"http://[fe80::1%25eth0]:8080",
+	} {
+		require.NoError(t, CheckURL("URL", u), u)
+	}
+
+	tests := []struct {
+		url string
+		err string
+	}{
+		{"ftp://pipeline.qiniu.com", "scheme must be http(s)"},
+		{"http://::1:8080", "must be enclosed in brackets"},
+		{"http://2001:db8::1", "must be enclosed in brackets"},
+		{"http://:8080", "missing host name"},
+		{"http://", "missing host name"},
+		{"http://pipeline.qiniu.com:0", "invalid port"},
+		{"http://pipeline.qiniu.com:99999", "invalid port"},
+	}
+	for _, tt := range tests {
+		err := CheckURL("URL", tt.url)
+		require.Error(t, err, tt.url)
+		require.Contains(t, err.Error(), tt.err, tt.url)
+	}
+
+	// recent url.Parse versions reject these as well
+	require.Error(t, checkHost("[10.0.0.1]:8080"))
+	require.Error(t, checkHost("[::1"))
+	require.Error(t, checkHost("[::1]x"))
+}
@@ -4,14 +4,18 @@ import (
 	"bytes"
 	"fmt"
 	"log"
-	"net/url"
+	"net/http"
+	"path/filepath"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/internal"
-	"github.com/influxdata/telegraf/metric"
 	"github.com/influxdata/telegraf/plugins/outputs"
+	"github.com/influxdata/telegraf/plugins/outputs/pandora/client"
 
 	"qiniu.com/pandora/pipeline"
 	"qiniu.com/pandora/tsdb"
@@ -19,23 +23,152 @@ import (
 	sdkbase "qiniu.com/pandora/base"
 )
 
+// postChunkBytes bounds the size of a post, and so the memory needed to
+// serialize a batch.
+const postChunkBytes = 1024 * 1024
+
 type PandoraTSDB struct {
 	// URL is only for backwards compatability
 	URL              string            `toml:"url"`
 	AK               string            `toml:"ak"`
 	SK               string            `toml:"sk"`
+	AKFile           string            `toml:"ak_file"`
+	SKFile           string            `toml:"sk_file"`
 	Repo             string            `toml:"repo"`
-	RetentionPolicy  string            `toml:"retention_policy`
-	AutoCreateSeries bool              `toml:"auto_create_series`
+	RepoTag          string            `toml:"repo_tag"`
+	RetentionPolicy  string            `toml:"retention_policy"`
+	AutoCreateSeries bool              `toml:"auto_create_series"`
 	Timeout          internal.Duration `toml:"timeout"`
+	// Endpoints written to instead of url, the writes succeed once
+	// min_success of them accept them, 0 meaning all
+	Endpoints  []string `toml:"endpoints"`
+	MinSuccess int      `toml:"min_success"`
+	// Retention of the series of some measurements, overriding
+	// retention_policy
+	RetentionOverrides map[string]string `toml:"retention_overrides"`
+	// Repos of some measurements, keyed by measurement name, overriding repo
+	MeasurementRepos map[string]string `toml:"measurement_repos"`
+	// Prefix prepended to measurement names
+	NamePrefix string `toml:"name_prefix"`
+	// Name of the series of a point, a template over its tags, defaults to
+	// the measurement name
+	SeriesNameTemplate string `toml:"series_name_template"`
+	// Replacement of the control characters of series names
+	SeriesNameReplacement string `toml:"series_name_replacement"`
+	// Verbosity of the Pandora SDK logger: debug, info, warn or error
+	LogLevel string `toml:"log_level"`
+	// Retries of a write failing with a network error or a 5xx response
+	MaxRetries    int               `toml:"max_retries"`
+	RetryInterval internal.Duration `toml:"retry_interval"`
+	// Send a key made for every batch along its data posts, the same on the
+	// retries of the batch
+	IdempotentWrites bool `toml:"idempotent_writes"`
+	// Timeout of the connection setup, timeout bounds the writes
+	ConnectTimeout internal.Duration `toml:"connect_timeout"`
+	// Idle connections kept open for the next requests, 0 means no limit
+	// overall and Go's default of 2 per host
+	MaxIdleConns        int `toml:"max_idle_conns"`
+	MaxIdleConnsPerHost int `toml:"max_idle_conns_per_host"`
+	// Proxy for requests to Pandora, defaults to the environment's proxy
+	HTTPProxy string `toml:"http_proxy"`
+	// User-Agent header of the requests to Pandora
+	UserAgent string `toml:"user_agent"`
+	// Number of the repos selected by repo_tag written in parallel
+	WriteConcurrency int `toml:"write_concurrency"`
+	// Security token of temporary credentials, or file holding it, read
+	// again whenever it changes
+	SecurityToken     string `toml:"security_token"`
+	SecurityTokenFile string `toml:"security_token_file"`
+	// Headers set on every request to Pandora
+	HTTPHeaders map[string]string `toml:"http_headers"`
+	// Upper bound of the control-plane calls per second, 0 means no limit
+	ControlPlaneRPS float64 `toml:"control_plane_rps"`
+	// Upper bound of the bytes of the data posts in flight, 0 means no limit
+	MaxInflightBytes int64 `toml:"max_inflight_bytes"`
+	// What to do with NaN and infinite float fields: drop, zero or error
+	FloatNaNHandling string `toml:"float_nan_handling"`
+	// What to do with points conflicting with the field types:
+	// drop, retry_once or error
+	OnFieldConflict string `toml:"on_field_conflict"`
+	// Number of series created in parallel by auto_create_series
+	SeriesCreateConcurrency int `toml:"series_create_concurrency"`
+	// Directory keeping the points that could not be written, replayed once
+	// writes succeed again. Empty disables spilling
+	SpillDirectory string `toml:"spill_directory"`
+	// Upper bound of the size of the spilled points of a repo, the oldest
+	// points are dropped past it. 0 means no limit
+	MaxSpillBytes int64 `toml:"max_spill_bytes"`
+	// Tags added to the metrics missing them
+	DefaultTags map[string]string `toml:"default_tags"`
+	// Tags removed from the metrics, before default_tags are added
+	DropTags []string `toml:"drop_tags"`
+	// Upper bound of the distinct values of a tag over tag_values_window,
+	// tags going past it are dropped. 0 means no limit
+	MaxTagValues int `toml:"max_tag_values"`
+	// Window over which the distinct values of a tag are counted
+	TagValuesWindow internal.Duration `toml:"tag_values_window"`
+	// New names of fields, keyed by their current name
+	FieldRename map[string]string `toml:"field_rename"`
+	// New names of tags, keyed by their current name
+	TagRename map[string]string `toml:"tag_rename"`
+	// Globs of the fields written, all if empty
+	FieldInclude []string `toml:"field_include"`
+	// Globs of the fields not written
+	FieldExclude []string `toml:"field_exclude"`
+	// Drop the points older than the retention of their series
+	DropStalePoints bool `toml:"drop_stale_points"`
+
+	// Path to CA file
+	TLSCA string `toml:"tls_ca"`
+	// Path to host cert file
+	TLSCert string `toml:"tls_cert"`
+	// Path to cert key file
+	TLSKey string `toml:"tls_key"`
+	// Use TLS but skip chain & host verification
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+
+	// credentials resolved from ak/sk or ak_file/sk_file
+	ak, sk string
+	token  *client.Token
 
 	client tsdb.TsdbAPI
+
+	transport http.RoundTripper
+	// deadline of the write in progress, enforced by transport
+	deadline *client.Deadline
+	// idempotency keys of the batches being posted, sent by transport
+	idempotency *client.IdempotencyKeys
+
+	seriesNameTmpl *template.Template
+
+	// series known to exist, so that they are not created again
+	createdSeries map[string]struct{}
+
+	// writers of the repos selected by repo_tag, keyed by repo name
+	repoWriters map[string]*PandoraTSDB
+
+	stats *client.Stats
+	// limits the control-plane calls, shared by the writers of all repos
+	limiter *client.Limiter
+	// bounds the bytes of the data posts in flight, shared by the writers of
+	// all repos
+	inflight *client.Inflight
+	// drops the tags with too many values, shared by the writers of all repos
+	cardinality *client.CardinalityGuard
+	fieldFilter *client.FieldFilter
+
+	spill *client.Spill
 }
 
 var sampleConfig = `
  # Configuration for PandoraTSDB server to send metrics to
   [[outputs.pandora]]
   url = "http://localhost:8086" # required
+  ## Endpoints written to instead of url, e.g. in two regions for
+  ## redundancy, with repos set up alike. Every write goes to all of them and
+  ## succeeds when at least min_success of them accept it, all by default.
+  # endpoints = ["https://tsdb-a.example.com", "https://tsdb-b.example.com"]
+  # min_success = 1
   ## The target repo for metrics (telegraf will create it if not exists).
   repo = "telegraf" # required
   
@@ -46,39 +179,358 @@ var sampleConfig = `
   ## Write timeout (for the PandoraTSDB client), formatted as a string.
   ## If not provided, will default to 5s. 0s means no timeout (not recommended).
   timeout = "5s"
+  ## Timeout of the connection setup, formatted as a string. 0s means no
+  ## timeout.
+  # connect_timeout = "5s"
+  ## Idle connections kept open for the next requests. The endpoint being a
+  ## single host, both bound the same connections.
+  # max_idle_conns = 100
+  # max_idle_conns_per_host = 100
+  ## Prefix prepended to measurement names, and so to the series and schema
+  ## keys they map to.
+  # name_prefix = "prod_"
+  ## Name of the series the points are written to, rendered with the tags
+  ## of every point, as in {{.device}}. Points missing a tag of the template
+  ## go to the series named after their measurement.
+  # series_name_template = "disk_{{.device}}"
+  ## Replacement of the control characters of series names, whose leading
+  ## and trailing spaces are trimmed. Points left without a name are dropped.
+  # series_name_replacement = "_"
+  ## Verbosity of the Pandora client logger, can be: "debug", "info", "warn", "error".
+  # log_level = "info"
+  ## Number of times a write failing with a network error or a 5xx response is
+  ## retried, with exponential backoff starting at retry_interval.
+  # max_retries = 0
+  # retry_interval = "1s"
+  ## Send a key made for every batch in the Idempotency-Key header of its
+  ## posts, so that Pandora can drop a retried post whose first response
+  ## was lost.
+  # idempotent_writes = false
+  ## HTTP proxy for requests to Pandora. If not provided, the HTTP_PROXY and
+  ## HTTPS_PROXY environment variables are used.
+  # http_proxy = "http://proxy.example.com:3128"
+  ## User-Agent header of the requests to Pandora.
+  # user_agent = "telegraf-pandora"
+  ## Upper bound of the series creations and updates sent to Pandora
+  ## per second, data posts are not limited. 0 means no limit.
+  # control_plane_rps = 5.0
+  ## Upper bound of the bytes of the data posts in flight, writes wait for
+  ## the running posts past it. 0 means no limit.
+  # max_inflight_bytes = 0
+  ## What to do with NaN and infinite float fields, which Pandora rejects:
+  ## "drop" omits the field, "zero" writes 0 instead, "error" fails the write.
+  # float_nan_handling = "drop"
+  ## What to do with points whose fields conflict with the types of their
+  ## series: "drop" drops them, "retry_once" posts them again once before
+  ## dropping them, "error" fails the write to retry it later.
+  # on_field_conflict = "drop"
+  ## Tag whose value selects the repo a metric is written to, metrics without
+  ## it go to repo. The tag itself is not written.
+  # repo_tag = "tenant"
+  ## Number of the repos selected by repo_tag written in parallel, the
+  ## points of a repo are still written in order.
+  # write_concurrency = 4
+  ## Number of series created in parallel when auto_create_series is set.
+  # series_create_concurrency = 4
+  ## Directory keeping the points that could not be written once retries are
+  ## exhausted, replayed oldest first on the next successful write. Every
+  ## repo is spilled to its own subdirectory, holding at most max_spill_bytes.
+  # spill_directory = "/var/lib/telegraf/pandora"
+  # max_spill_bytes = 104857600
+  ## Tags removed from every metric, e.g. to keep high cardinality tags out
+  ## of Pandora.
+  # drop_tags = ["pid"]
+  ## Tags taking more than max_tag_values distinct values over
+  ## tag_values_window are dropped until they fall back under it.
+  # max_tag_values = 1000
+  # tag_values_window = "1h"
+  ## Globs of the fields written, after field_rename, fields matching
+  ## field_exclude are not. Metrics left without fields are not written.
+  # field_include = ["usage_*"]
+  # field_exclude = ["usage_guest*"]
+  ## Drop the points older than the retention of their series (see
+  ## retention_policy), which Pandora rejects along their whole batch.
+  # drop_stale_points = false
   ak = "ACCESS_KEY"
   sk = "SECRET_KEY"
+  ## The keys can also reference environment variables, as in "$PANDORA_AK",
+  ## or be read from files instead.
+  # ak_file = "/etc/telegraf/pandora_ak"
+  # sk_file = "/etc/telegraf/pandora_sk"
+  ## Security token of temporary credentials, sent along ak and sk. When
+  ## read from a file, the file is read again whenever it changes, so that a
+  ## renewed token is used right away.
+  # security_token = "$PANDORA_SECURITY_TOKEN"
+  # security_token_file = "/etc/telegraf/pandora_token"
+
+  ## Optional TLS Config
+  # tls_ca = "/etc/telegraf/ca.pem"
+  # tls_cert = "/etc/telegraf/cert.pem"
+  # tls_key = "/etc/telegraf/key.pem"
+  ## Use TLS but skip chain & host verification
+  # insecure_skip_verify = false
+
+  ## Tags added to every metric, the tags of the metric take precedence.
+  # [outputs.pandora.default_tags]
+  #   dc = "nb"
+
+  ## Fields renamed before writing, e.g. to make them valid Pandora keys.
+  # [outputs.pandora.field_rename]
+  #   "load.1" = "load1"
+
+  ## Tags renamed before writing, e.g. to keep them off the keys Pandora
+  ## reserves.
+  # [outputs.pandora.tag_rename]
+  #   time = "time_tag"
+
+  ## Retention of the series of some measurements, overriding retention_policy.
+  # [outputs.pandora.retention_overrides]
+  #   cpu = "30d"
+
+  ## Repos of some measurements, the others go to repo. repo_tag takes
+  ## precedence.
+  # [outputs.pandora.measurement_repos]
+  #   syslog = "logs"
+
+  ## Headers set on every request to Pandora, e.g. for the gateways in front
+  ## of it. Authorization, User-Agent and X-Qiniu- headers cannot be set.
+  # [outputs.pandora.http_headers]
+  #   X-Tenant-Id = "tenant"
 `
 
-func (i *PandoraTSDB) Connect() error {
-	log.Println(i.URL)
-	u, err := url.Parse(i.URL)
+// Init validates the configuration, so that a misconfigured output fails at
+// startup rather than on its first write.
+func (i *PandoraTSDB) Init() error {
+	i.URL = strings.TrimRight(strings.TrimSpace(i.URL), "/")
+	if len(i.Endpoints) > 0 {
+		if i.URL != "" {
+			return fmt.Errorf("config.URL must not be set along config.Endpoints")
+		}
+		for n, endpoint := range i.Endpoints {
+			i.Endpoints[n] = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+			if err := client.CheckURL("Endpoints", i.Endpoints[n]); err != nil {
+				return err
+			}
+		}
+	} else {
+		if i.URL == "" {
+			return fmt.Errorf("config.URL is required")
+		}
+		if err := client.CheckURL("URL", i.URL); err != nil {
+			return err
+		}
+	}
+	if i.MinSuccess < 0 || i.MinSuccess > len(i.endpoints()) {
+		return fmt.Errorf("config.MinSuccess must be between 0 and the %d endpoints, got %d",
+			len(i.endpoints()), i.MinSuccess)
+	}
+	if i.Repo == "" {
+		return fmt.Errorf("config.Repo is required")
+	}
+	ak, err := client.ResolveCredential("AK", i.AK, i.AKFile)
+	if err != nil {
+		return err
+	}
+	if ak == "" {
+		return fmt.Errorf("config.AK is required")
+	}
+	sk, err := client.ResolveCredential("SK", i.SK, i.SKFile)
+	if err != nil {
+		return err
+	}
+	if sk == "" {
+		return fmt.Errorf("config.SK is required")
+	}
+	i.ak, i.sk = ak, sk
+	token, err := client.NewToken("SecurityToken", i.SecurityToken, i.SecurityTokenFile)
+	if err != nil {
+		return err
+	}
+	i.token = token
+	if i.Timeout.Duration < 0 {
+		return fmt.Errorf("config.Timeout must not be negative, got %s", i.Timeout.Duration)
+	}
+	if i.ConnectTimeout.Duration < 0 {
+		return fmt.Errorf("config.ConnectTimeout must not be negative, got %s", i.ConnectTimeout.Duration)
+	}
+	if i.MaxIdleConns < 0 {
+		return fmt.Errorf("config.MaxIdleConns must not be negative, got %d", i.MaxIdleConns)
+	}
+	if i.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("config.MaxIdleConnsPerHost must not be negative, got %d", i.MaxIdleConnsPerHost)
+	}
+	for measurement, repo := range i.MeasurementRepos {
+		if repo == "" {
+			return fmt.Errorf("config.MeasurementRepos must not map %s to an empty repo", measurement)
+		}
+	}
+	if i.WriteConcurrency < 0 {
+		return fmt.Errorf("config.WriteConcurrency must not be negative, got %d", i.WriteConcurrency)
+	}
+	if i.ControlPlaneRPS < 0 {
+		return fmt.Errorf("config.ControlPlaneRPS must not be negative, got %v", i.ControlPlaneRPS)
+	}
+	if i.MaxInflightBytes < 0 {
+		return fmt.Errorf("config.MaxInflightBytes must not be negative, got %d", i.MaxInflightBytes)
+	}
+	i.inflight = client.NewInflight(i.MaxInflightBytes)
+	if i.MaxTagValues < 0 {
+		return fmt.Errorf("config.MaxTagValues must not be negative, got %d", i.MaxTagValues)
+	}
+	if i.MaxTagValues > 0 && i.TagValuesWindow.Duration <= 0 {
+		return fmt.Errorf("config.TagValuesWindow must be positive, got %s", i.TagValuesWindow.Duration)
+	}
+	i.cardinality = client.NewCardinalityGuard(i.MaxTagValues, i.TagValuesWindow.Duration)
+	f, err := client.NewFieldFilter(i.FieldInclude, i.FieldExclude)
 	if err != nil {
-		return fmt.Errorf("error parsing config.URL: %s", err)
+		return err
+	}
+	i.fieldFilter = f
+	if err := client.CheckRetentionOverrides(i.RetentionOverrides); err != nil {
+		return err
+	}
+	if err := client.CheckHeaders(i.HTTPHeaders); err != nil {
+		return err
 	}
-	if u.Scheme != "http" && u.Scheme != "https" {
-		return fmt.Errorf("config.URL scheme must be http(s), got %s", u.Scheme)
+	if strings.IndexFunc(i.SeriesNameReplacement, func(r rune) bool {
+		return unicode.IsSpace(r) || invalidSeriesRune(r)
+	}) >= 0 {
+		return fmt.Errorf("config.SeriesNameReplacement must not hold spaces or control characters, got %q",
+			i.SeriesNameReplacement)
 	}
-	log.Println(u.String())
-	cfg := pipeline.NewConfig().
-		WithAccessKeySecretKey(i.AK, i.SK).
-		WithEndpoint(i.URL).
-		WithLogger(sdkbase.NewDefaultLogger()).
-		WithLoggerLevel(sdkbase.LogDebug).
-		WithResponseTimeout(i.Timeout.Duration)
+	i.seriesNameTmpl = nil
+	if i.SeriesNameTemplate != "" {
+		tmpl, err := template.New("series_name").Option("missingkey=error").Parse(i.SeriesNameTemplate)
+		if err != nil {
+			return fmt.Errorf("error parsing config.SeriesNameTemplate: %s", err)
+		}
+		i.seriesNameTmpl = tmpl
+	}
+	if i.MaxSpillBytes < 0 {
+		return fmt.Errorf("config.MaxSpillBytes must not be negative, got %d", i.MaxSpillBytes)
+	}
+	if i.FloatNaNHandling == "" {
+		i.FloatNaNHandling = "drop"
+	}
+	if err := client.CheckNonFiniteMode(i.FloatNaNHandling); err != nil {
+		return err
+	}
+	if i.OnFieldConflict == "" {
+		i.OnFieldConflict = "drop"
+	}
+	if err := client.CheckFieldConflictMode(i.OnFieldConflict); err != nil {
+		return err
+	}
+	return nil
+}
 
-	// 生成client实例
-	client, err := tsdb.New(cfg)
+func (i *PandoraTSDB) Connect() error {
+	if err := i.Init(); err != nil {
+		return err
+	}
+	level, err := client.ParseLogLevel(i.LogLevel)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	i.client = client
+	logLevel := sdkLogLevels[level]
+	tlsConfig, err := internal.GetTLSConfig(
+		i.TLSCert, i.TLSKey, i.TLSCA, i.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	if i.transport != nil {
+		client.ReleaseTransport(i.transport)
+		i.transport = nil
+	}
+	// the outputs set up alike share their connections
+	poolKey := client.PoolKey(i.HTTPProxy, i.TLSCA, i.TLSCert, i.TLSKey,
+		i.InsecureSkipVerify, i.ConnectTimeout.Duration, i.MaxIdleConns, i.MaxIdleConnsPerHost)
+	deadline := &client.Deadline{}
+	var idempotency *client.IdempotencyKeys
+	if i.IdempotentWrites {
+		idempotency = &client.IdempotencyKeys{}
+	}
+	transport, err := client.NewTransport(client.HTTPConfig{
+		HTTPProxy:           i.HTTPProxy,
+		TLSConfig:           tlsConfig,
+		Deadline:            deadline,
+		DialTimeout:         i.ConnectTimeout.Duration,
+		MaxIdleConns:        i.MaxIdleConns,
+		MaxIdleConnsPerHost: i.MaxIdleConnsPerHost,
+		PoolKey:             poolKey,
+		UserAgent:           i.UserAgent,
+		Headers:             i.HTTPHeaders,
+		SecurityToken:       i.token,
+		IdempotencyKeys:     idempotency,
+	})
+	if err != nil {
+		return err
+	}
+	i.transport = transport
+	i.deadline = deadline
+	i.idempotency = idempotency
+	endpoints := i.endpoints()
+	clients := make([]tsdb.TsdbAPI, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		cfg := pipeline.NewConfig().
+			WithAccessKeySecretKey(i.ak, i.sk).
+			WithEndpoint(endpoint).
+			WithLogger(sdkbase.NewDefaultLogger()).
+			WithLoggerLevel(logLevel).
+			WithResponseTimeout(i.Timeout.Duration).
+			WithTransport(transport)
+
+		// 生成client实例
+		c, err := tsdb.New(cfg)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, c)
+	}
+	if len(clients) == 1 {
+		i.client = clients[0]
+	} else {
+		minSuccess := i.MinSuccess
+		if minSuccess == 0 {
+			minSuccess = len(clients)
+		}
+		i.client = &quorumClient{
+			TsdbAPI:    clients[0],
+			endpoints:  endpoints,
+			clients:    clients,
+			minSuccess: minSuccess,
+		}
+	}
+	i.limiter = client.NewLimiter(i.ControlPlaneRPS)
+	i.createdSeries = make(map[string]struct{})
+	i.repoWriters = nil
 
 	return nil
 }
 
+// endpoints returns the endpoints written to, url unless endpoints is set.
+func (i *PandoraTSDB) endpoints() []string {
+	if len(i.Endpoints) > 0 {
+		return i.Endpoints
+	}
+	return []string{i.URL}
+}
+
+// sdkLogLevels maps the log_level option to the Pandora SDK logger levels.
+var sdkLogLevels = map[client.LogLevel]sdkbase.LogLevelType{
+	client.LogDebug: sdkbase.LogDebug,
+	client.LogInfo:  sdkbase.LogInfo,
+	client.LogWarn:  sdkbase.LogWarn,
+	client.LogError: sdkbase.LogError,
+}
+
 func (i *PandoraTSDB) Close() error {
+	if i.transport != nil {
+		client.ReleaseTransport(i.transport)
+	}
+	i.client = nil
+	i.transport = nil
+	i.repoWriters = nil
 	return nil
 }
 
@@ -90,47 +542,338 @@ func (i *PandoraTSDB) Description() string {
 	return "Configuration for PandoraTSDB server to send metrics to"
 }
 
-// Choose a random server in the cluster to write to until a successful write
-// occurs, logging each unsuccessful. If all servers fail, return error.
-func (i *PandoraTSDB) Write(metrics []telegraf.Metric) error {
-	bufsize := 0
+// nameSeries returns copies of metrics named after their series, the
+// series_name_template rendered with their tags and prefixed by name_prefix.
+// Metrics missing a tag of the template keep their name.
+func (i *PandoraTSDB) nameSeries(metrics []telegraf.Metric) []telegraf.Metric {
+	if i.seriesNameTmpl == nil {
+		return metrics
+	}
+	named := make([]telegraf.Metric, 0, len(metrics))
+	var buf bytes.Buffer
 	for _, m := range metrics {
-		bufsize += m.Len()
+		buf.Reset()
+		if err := i.seriesNameTmpl.Execute(&buf, m.Tags()); err != nil || buf.Len() == 0 {
+			log.Printf("D! no series name for a point of %s, written to the series of its measurement: %v", m.Name(), err)
+			named = append(named, m)
+			continue
+		}
+		m = m.Copy()
+		m.SetName(i.NamePrefix + buf.String())
+		named = append(named, m)
+	}
+	return named
+}
+
+// Write posts the metrics to their repo, the value of their repo_tag or repo
+// when the tag is not set or missing. Up to write_concurrency repos are
+// written at a time, the errors of all of them are returned.
+func (i *PandoraTSDB) Write(metrics []telegraf.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if i.deadline != nil && i.Timeout.Duration > 0 {
+		i.deadline.Set(time.Now().Add(i.Timeout.Duration))
+		defer i.deadline.Set(time.Time{})
+	}
+
+	if i.RepoTag == "" && len(i.MeasurementRepos) == 0 {
+		return i.write(metrics)
+	}
+
+	// the writers are looked up before the repos are written in parallel
+	repos, byRepo := client.RouteMetrics(metrics, i.RepoTag, i.MeasurementRepos, i.Repo)
+	writers := make(map[string]*PandoraTSDB, len(repos))
+	for _, repo := range repos {
+		writers[repo] = i.repoWriter(repo)
+	}
+	return client.ForEach(repos, i.WriteConcurrency, func(repo string) error {
+		return writers[repo].write(byRepo[repo])
+	})
+}
+
+// repoWriter returns the output writing to repo. It shares the client and
+// the configuration of i, but keeps its own set of created series.
+func (i *PandoraTSDB) repoWriter(repo string) *PandoraTSDB {
+	if repo == i.Repo {
+		return i
+	}
+	if w, ok := i.repoWriters[repo]; ok {
+		return w
+	}
+	if i.repoWriters == nil {
+		i.repoWriters = make(map[string]*PandoraTSDB)
+	}
+	w := *i
+	w.Repo = repo
+	w.createdSeries = nil
+	w.repoWriters = nil
+	w.stats = nil
+	w.spill = nil
+	i.repoWriters[repo] = &w
+	return &w
+}
+
+// prepare applies the transforms configured to the metrics before they are
+// serialized, and drops the metrics that cannot be written. The metrics are
+// passed as is through the transforms not configured.
+func (i *PandoraTSDB) prepare(metrics []telegraf.Metric) ([]telegraf.Metric, error) {
+	before := len(metrics)
+	metrics = client.PrefixMetrics(metrics, i.NamePrefix)
+	metrics, err := client.HandleNonFinite(metrics, i.FloatNaNHandling)
+	if err != nil {
+		return nil, err
+	}
+	metrics = client.DropFieldless(metrics)
+	metrics, err = client.DropTags(metrics, i.DropTags)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err = i.cardinality.Filter(metrics)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err = client.AddDefaultTags(metrics, i.DefaultTags)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err = client.RenameTags(metrics, i.TagRename)
+	if err != nil {
+		return nil, err
 	}
-	r := metric.NewReader(metrics)
-	p := make([]byte, bufsize)
-	n, err := r.Read(p)
+	metrics, err = client.RenameFields(metrics, i.FieldRename)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err = i.fieldFilter.Filter(metrics)
+	if err != nil {
+		return nil, err
+	}
+	i.repoStats().RecordDropped(before, len(metrics))
+	return metrics, nil
+}
+
+func (i *PandoraTSDB) write(metrics []telegraf.Metric) error {
+	metrics, err := i.prepare(metrics)
 	if err != nil {
 		return err
 	}
+	if len(metrics) == 0 {
+		return nil
+	}
+	metrics = i.nameSeries(metrics)
+	metrics = i.normalizeSeries(metrics)
+	if len(metrics) == 0 {
+		return nil
+	}
+	if i.DropStalePoints {
+		var stale int
+		metrics, stale = client.DropStale(metrics, time.Now(), i.seriesRetention)
+		i.repoStats().RecordStale(stale)
+		if len(metrics) == 0 {
+			return nil
+		}
+	}
+	size := 0
+	err = serializeChunks(metrics, postChunkBytes, func(p []byte, count int) error {
+		size += len(p)
+		return i.writeChunk(p, count)
+	})
+	i.repoStats().RecordPayload(size, len(metrics))
+	return err
+}
+
+// writeChunk posts serialized points, count of them, to the repo.
+func (i *PandoraTSDB) writeChunk(p []byte, count int) error {
 	// This will get set to nil if a successful write occurs
-	err = fmt.Errorf("Could not write to any PandoraTSDB server in cluster")
+	err := fmt.Errorf("Could not write to any PandoraTSDB server in cluster")
 
-	if e := i.client.PostPointsFromBytes(&tsdb.PostPointsFromBytesInput{
-		RepoName: i.Repo,
-		Buffer:   p[:n],
-	}); e != nil {
+	e := i.post(p)
+	if e != nil {
+		i.repoStats().WriteErrors.Incr(1)
 		log.Printf("E! PandoraTSDB Output Error: %s", e)
-		if strings.Contains(e.Error(), "field type conflict") {
-			log.Printf("E! Field type conflict, dropping conflicted points: %s", e)
-			// setting err to nil, otherwise we will keep retrying and points
-			// w/ conflicting types will get stuck in the buffer forever.
+		if client.IsRetryable(e) && i.spillPoints(p) {
 			err = nil
-		} else if strings.Contains(e.Error(), "E7101") && i.AutoCreateSeries {
-			log.Println("I! Seires does not exists, start to create series")
-			createSeries(i.Repo, i.RetentionPolicy, p[:n], i.client)
+		} else if client.IsFieldTypeConflict(e) {
+			err = i.onFieldConflict(p, count, e, err)
+		} else if client.IsSeriesNotFound(e) && i.AutoCreateSeries {
+			log.Printf("I! Series does not exist, start to create series")
+			// the points are posted again, once, when all their series
+			// could be created and some were missing
+			created := len(i.createdSeries)
+			if i.createSeries(p) == nil && len(i.createdSeries) > created {
+				e = i.post(p)
+				if e != nil {
+					i.repoStats().WriteErrors.Incr(1)
+					log.Printf("E! PandoraTSDB Output Error after creating series: %s", e)
+				} else {
+					i.written(count)
+					err = nil
+				}
+			}
 		}
 		// Log write failure
 	} else {
+		i.written(count)
 		err = nil
 	}
 
 	return err
 }
 
+// onFieldConflict applies on_field_conflict to the points, count of them,
+// whose post failed with the field type conflict e, and returns the error of
+// the write, err when it fails.
+func (i *PandoraTSDB) onFieldConflict(p []byte, count int, e, err error) error {
+	switch i.OnFieldConflict {
+	case "error":
+		log.Printf("E! Field type conflict, keeping the points to retry them: %s", e)
+		return err
+	case "retry_once":
+		log.Printf("W! Field type conflict, posting the points again: %s", e)
+		if e = i.post(p); e == nil {
+			i.written(count)
+			return nil
+		}
+		i.repoStats().WriteErrors.Incr(1)
+	}
+	log.Printf("E! Field type conflict, dropping conflicted points: %s", e)
+	// setting err to nil, otherwise we will keep retrying and points
+	// w/ conflicting types will get stuck in the buffer forever.
+	return nil
+}
+
+// written records count points written, and replays the spilled points now
+// that the repo takes writes again.
+func (i *PandoraTSDB) written(count int) {
+	i.repoStats().PointsWritten.Incr(int64(count))
+	i.replaySpill()
+}
+
+// serializeChunks serializes the metrics into chunks of at most max bytes
+// and hands every chunk, with the number of metrics in it, to fn. The chunks
+// share one buffer, so that a large batch never has to be held serialized
+// as a whole; fn must not keep the chunk. A metric larger than max makes a
+// chunk on its own, and max <= 0 disables splitting. It stops at the first
+// error of fn.
+func serializeChunks(metrics []telegraf.Metric, max int, fn func(p []byte, count int) error) error {
+	var buf []byte
+	count := 0
+	for _, m := range metrics {
+		size := m.Len()
+		if max > 0 && count > 0 && len(buf)+size > max {
+			if err := fn(buf, count); err != nil {
+				return err
+			}
+			buf, count = buf[:0], 0
+		}
+		if cap(buf)-len(buf) < size {
+			// the buffer is reused by the next chunks, so only grow it
+			// past max for a metric larger than max
+			c := 2*cap(buf) + size
+			if max > 0 && c > max && len(buf)+size <= max {
+				c = max
+			}
+			grown := make([]byte, len(buf), c)
+			copy(grown, buf)
+			buf = grown
+		}
+		n := m.SerializeTo(buf[len(buf) : len(buf)+size])
+		buf = buf[:len(buf)+n]
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+	return fn(buf, count)
+}
+
+// post writes the points to the repo, retrying transient failures.
+func (i *PandoraTSDB) post(p []byte) error {
+	stats := i.repoStats()
+	attempts := 0
+	size := i.inflight.Acquire(len(p))
+	// the retries, and the endpoints of a quorum, send the key of the batch
+	_, done := i.idempotency.Start(p)
+	err := client.Retry(i.MaxRetries, i.RetryInterval.Duration, func() error {
+		attempts++
+		return i.client.PostPointsFromBytes(&tsdb.PostPointsFromBytesInput{
+			RepoName: i.Repo,
+			Buffer:   p,
+		})
+	})
+	done()
+	i.inflight.Release(size)
+	stats.Retries.Incr(int64(attempts - 1))
+	if err != nil {
+		return err
+	}
+	stats.BytesSent.Incr(int64(len(p)))
+	return nil
+}
+
+// repoStats returns the counters of the repo, registered on first use.
+func (i *PandoraTSDB) repoStats() *client.Stats {
+	if i.stats == nil {
+		i.stats = client.NewStats("pandora", i.Repo)
+	}
+	return i.stats
+}
+
+// repoSpill returns the spill of the repo, nil when spilling is disabled.
+func (i *PandoraTSDB) repoSpill() *client.Spill {
+	if i.SpillDirectory == "" {
+		return nil
+	}
+	if i.spill == nil {
+		i.spill = client.NewSpill(filepath.Join(i.SpillDirectory, i.Repo), i.MaxSpillBytes)
+	}
+	return i.spill
+}
+
+// spillPoints keeps points that could not be written in the spill directory
+// and reports whether they were kept.
+func (i *PandoraTSDB) spillPoints(p []byte) bool {
+	spill := i.repoSpill()
+	if spill == nil {
+		return false
+	}
+	if err := spill.Append(p); err != nil {
+		log.Printf("E! spill points of repo %s fail: %s", i.Repo, err)
+		return false
+	}
+	log.Printf("W! spilled %d bytes of repo %s, they will be replayed on the next successful write", len(p), i.Repo)
+	return true
+}
+
+// replaySpill writes the points spilled by the previous writes, oldest first.
+func (i *PandoraTSDB) replaySpill() {
+	spill := i.repoSpill()
+	if spill == nil {
+		return
+	}
+	if err := spill.Replay(i.post, i.repoStats().RecordSpillRejected); err != nil {
+		log.Printf("E! replay spilled points of repo %s fail: %s", i.Repo, err)
+	}
+}
+
 func newPandoraTSDB() *PandoraTSDB {
 	return &PandoraTSDB{
-		Timeout: internal.Duration{Duration: time.Second * 5},
+		Timeout:             internal.Duration{Duration: time.Second * 5},
+		RetryInterval:       internal.Duration{Duration: time.Second},
+		ConnectTimeout:      internal.Duration{Duration: time.Second * 5},
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		FloatNaNHandling:    "drop",
+		OnFieldConflict:     "drop",
+		UserAgent:           client.DefaultUserAgent,
+		WriteConcurrency:    4,
+		ControlPlaneRPS:     5,
+		MaxSpillBytes:       100 * 1024 * 1024,
+		TagValuesWindow:     internal.Duration{Duration: time.Hour},
+
+		SeriesCreateConcurrency: 4,
+		SeriesNameReplacement:   "_",
 	}
 }
 
@@ -138,24 +881,135 @@ func init() {
 	outputs.Add("pandora", func() telegraf.Output { return newPandoraTSDB() })
 }
 
-func createSeries(repo, retention string, points []byte, client tsdb.TsdbAPI) (err error) {
-	series := getSeries(points)
-	for _, s := range series {
-		log.Printf("I! create series:%v, retention:%v for repo:%v", s, retention, repo)
-		err = client.CreateSeries(&tsdb.CreateSeriesInput{
-			RepoName:   repo,
-			SeriesName: s,
-			Retention:  retention,
-		})
-		if err != nil {
-			log.Printf("E! create series fail, %v", err)
+// seriesRetention returns the retention of the series created for the
+// measurement.
+func (i *PandoraTSDB) seriesRetention(series string) string {
+	if retention, ok := i.RetentionOverrides[series]; ok {
+		return retention
+	}
+	return i.RetentionPolicy
+}
+
+// createSeries creates the series of the points that were not created yet,
+// series_create_concurrency at a time. It returns the first error met.
+func (i *PandoraTSDB) createSeries(points []byte) error {
+	if i.createdSeries == nil {
+		i.createdSeries = make(map[string]struct{})
+	}
+
+	var pending []string
+	seen := make(map[string]struct{})
+	for _, s := range getSeries(points, i.SeriesNameReplacement) {
+		if _, ok := i.createdSeries[s]; ok {
+			continue
 		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		pending = append(pending, s)
 	}
 
-	return
+	concurrency := i.SeriesCreateConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(pending) {
+		concurrency = len(pending)
+	}
+
+	stats := i.repoStats()
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	work := make(chan string)
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range work {
+				retention := i.seriesRetention(s)
+				log.Printf("I! create series:%v, retention:%v for repo:%v", s, retention, i.Repo)
+				i.limiter.Wait()
+				err := i.client.CreateSeries(&tsdb.CreateSeriesInput{
+					RepoName:   i.Repo,
+					SeriesName: s,
+					Retention:  retention,
+				})
+
+				mu.Lock()
+				if err != nil {
+					log.Printf("E! create series fail, %v", err)
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					i.createdSeries[s] = struct{}{}
+					stats.SchemaUpdates.Incr(1)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, s := range pending {
+		work <- s
+	}
+	close(work)
+	wg.Wait()
+
+	return firstErr
 }
 
-func getSeries(points []byte) (series []string) {
+// normalizeSeries normalizes the series names of the metrics, see
+// normalizeSeriesName, and drops the metrics left without a name.
+func (i *PandoraTSDB) normalizeSeries(metrics []telegraf.Metric) []telegraf.Metric {
+	normalized := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		name := normalizeSeriesName(m.Name(), i.SeriesNameReplacement)
+		if name == "" {
+			log.Printf("W! dropping a point of repo %s, its series name %q is empty once normalized", i.Repo, m.Name())
+			i.repoStats().PointsDropped.Incr(1)
+			continue
+		}
+		if name != m.Name() {
+			m = m.Copy()
+			m.SetName(name)
+		}
+		normalized = append(normalized, m)
+	}
+	return normalized
+}
+
+// invalidSeriesRune reports whether r is not allowed in series names.
+func invalidSeriesRune(r rune) bool {
+	return unicode.IsControl(r)
+}
+
+// normalizeSeriesName trims the leading and trailing spaces of a series
+// name and replaces its control characters with replacement.
+func normalizeSeriesName(name, replacement string) string {
+	name = strings.TrimFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || invalidSeriesRune(r)
+	})
+	if strings.IndexFunc(name, invalidSeriesRune) < 0 {
+		return name
+	}
+	var buf bytes.Buffer
+	for _, r := range name {
+		if invalidSeriesRune(r) {
+			buf.WriteString(replacement)
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// getSeries returns the series names of the points, normalized with
+// replacement. The lines whose name is empty once normalized are skipped.
+func getSeries(points []byte, replacement string) (series []string) {
 
 	series = make([]string, 0)
 	lines := bytes.Split(points, []byte("\n"))
@@ -163,11 +1017,32 @@ func getSeries(points []byte) (series []string) {
 		if len(line) == 0 {
 			continue
 		}
-		ss := bytes.Split(line, []byte(","))
-		if len(ss) > 1 {
-			series = append(series, string(ss[0]))
+		if name := normalizeSeriesName(measurement(line), replacement); name != "" {
+			series = append(series, name)
 		}
 	}
 
 	return
 }
+
+// measurement returns the unescaped measurement name of a line-protocol
+// line. The name ends at the first unescaped comma, or at the first
+// unescaped space when the point has no tags. As in the line protocol, only
+// commas and spaces are escaped in measurement names.
+func measurement(line []byte) string {
+	var name []byte
+	for j := 0; j < len(line); j++ {
+		switch c := line[j]; c {
+		case '\\':
+			if j+1 < len(line) && (line[j+1] == ',' || line[j+1] == ' ') {
+				j++
+			}
+			name = append(name, line[j])
+		case ',', ' ':
+			return string(name)
+		default:
+			name = append(name, c)
+		}
+	}
+	return ""
+}
@@ -1,16 +1,33 @@
 package pandora
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/plugins/outputs/pandora/client"
 	"github.com/influxdata/telegraf/testutil"
+	"github.com/influxdata/toml"
 
 	"reflect"
 
 	"github.com/stretchr/testify/require"
+
+	"qiniu.com/pandora/tsdb"
 )
 
 func TestHTTPConnectError_InvalidURL(t *testing.T) {
@@ -23,6 +40,19 @@ func TestHTTPConnectError_InvalidURL(t *testing.T) {
 
 }
 
+func TestConfigDecode(t *testing.T) {
+	i := newPandoraTSDB()
+	err := toml.Unmarshal([]byte(`
+url = "https://tsdb.qiniu.com"
+repo = "telegraf"
+auto_create_series = true
+retention_policy = "3d"
+`), i)
+	require.NoError(t, err)
+	require.True(t, i.AutoCreateSeries)
+	require.Equal(t, "3d", i.RetentionPolicy)
+}
+
 func TestHTTPError_DatabaseNotFound(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
@@ -41,6 +71,8 @@ func TestHTTPError_DatabaseNotFound(t *testing.T) {
 	i := PandoraTSDB{
 		URL:  ts.URL,
 		Repo: "test",
+		AK:   "ak",
+		SK:   "sk",
 	}
 
 	err := i.Connect()
@@ -65,6 +97,8 @@ func TestHTTPError_FieldTypeConflict(t *testing.T) {
 	i := PandoraTSDB{
 		URL:  ts.URL,
 		Repo: "test",
+		AK:   "ak",
+		SK:   "sk",
 	}
 
 	err := i.Connect()
@@ -76,10 +110,1301 @@ func TestHTTPError_FieldTypeConflict(t *testing.T) {
 
 func Test_createSeries(t *testing.T) {
 	points := []byte("cpu,host=h1 value=123\ngpu,region=g1 value=123\ntest,host=h1 value=123\nmem,host=h1 value=123")
-	series := getSeries(points)
+	series := getSeries(points, "_")
 	exp := []string{"cpu", "gpu", "test", "mem"}
 	if !reflect.DeepEqual(series, exp) {
 		t.Error(series, exp)
 	}
 	t.Log(series)
 }
+
+func TestGetSeries_Tagless(t *testing.T) {
+	points := []byte("cpu,host=h1 value=1\nuptime value=2 1500000000\nmem,host=h1 used=3\nload load1=0.5\n")
+	require.Equal(t, []string{"cpu", "uptime", "mem", "load"}, getSeries(points, "_"))
+}
+
+func TestGetSeries_Escaped(t *testing.T) {
+	points := []byte(`my\,metric,host=h1 value=1
+my\ metric value=2
+back\slash,host=h1 value=3
+cpu,host=a\,b value=4
+`)
+	require.Equal(t, []string{"my,metric", "my metric", `back\slash`, "cpu"}, getSeries(points, "_"))
+}
+
+func TestGetSeries_Normalized(t *testing.T) {
+	points := []byte("\\ \\ ,host=h1 value=1\n\tcpu,host=h1 value=2\nmem\x01used,host=h1 value=3\n")
+	require.Equal(t, []string{"cpu", "mem_used"}, getSeries(points, "_"))
+	require.Equal(t, []string{"cpu", "memused"}, getSeries(points, ""))
+}
+
+func TestWrite_SeriesNameNormalized(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.Repo = "normalized_test"
+	i.client = client
+
+	var metrics []telegraf.Metric
+	for _, name := range []string{"  ", " cpu\tload "} {
+		m, err := metric.New(name, map[string]string{"host": "h1"},
+			map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+	require.Len(t, client.posts, 1)
+	require.Equal(t, "cpu_load,host=h1 value=1 1000000000\n", string(client.posts[0]))
+	require.Equal(t, int64(1), i.repoStats().PointsDropped.Get())
+
+	i = newTestPandoraTSDB()
+	i.SeriesNameReplacement = " "
+	require.EqualError(t, i.Init(), `config.SeriesNameReplacement must not hold spaces or control characters, got " "`)
+}
+
+func TestWrite_RetriesTransientErrors(t *testing.T) {
+	failures := 2
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts < failures {
+			attempts++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	i := newTestPandoraTSDB()
+	i.URL = ts.URL
+	i.Repo = "test"
+	i.MaxRetries = 3
+	i.RetryInterval.Duration = time.Millisecond
+
+	require.NoError(t, i.Connect())
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Equal(t, failures, attempts)
+	require.NoError(t, i.Close())
+}
+
+func TestWrite_IdempotentWritesViaServer(t *testing.T) {
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(client.IdempotencyKeyHeader)
+		if key == "" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		keys = append(keys, key)
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	i := newTestPandoraTSDB()
+	i.URL = ts.URL
+	i.Repo = "test"
+	i.MaxRetries = 1
+	i.RetryInterval.Duration = time.Millisecond
+	i.IdempotentWrites = true
+
+	require.NoError(t, i.Connect())
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.NoError(t, i.Close())
+
+	// the retry sends the key of the first batch, the next batch, of the
+	// same bytes, a new one
+	require.Len(t, keys, 3)
+	require.Equal(t, keys[0], keys[1])
+	require.NotEqual(t, keys[1], keys[2])
+}
+
+func TestConnectCloseConnect(t *testing.T) {
+	i := newTestPandoraTSDB()
+	i.Repo = "test"
+
+	require.NoError(t, i.Connect())
+	require.NoError(t, i.Close())
+	require.Nil(t, i.client)
+	require.Nil(t, i.transport)
+	require.NoError(t, i.Connect())
+	require.NoError(t, i.Close())
+}
+
+func TestPrepare(t *testing.T) {
+	serialize := func(metrics []telegraf.Metric) string {
+		var out string
+		require.NoError(t, serializeChunks(metrics, 0, func(p []byte, count int) error {
+			out += string(p)
+			return nil
+		}))
+		return out
+	}
+	m, err := metric.New("cpu", map[string]string{"time": "t1", "pid": "42"},
+		map[string]interface{}{"load.1": 0.5}, time.Unix(1, 0))
+	require.NoError(t, err)
+	metrics := []telegraf.Metric{m}
+
+	// the metrics are passed as is without transforms
+	i := newTestPandoraTSDB()
+	require.NoError(t, i.Init())
+	prepared, err := i.prepare(metrics)
+	require.NoError(t, err)
+	require.True(t, prepared[0] == m)
+	untransformed := serialize(prepared)
+	require.Equal(t, m.String(), untransformed)
+
+	i.NamePrefix = "prod_"
+	i.DropTags = []string{"pid"}
+	i.TagRename = map[string]string{"time": "time_tag"}
+	i.FieldRename = map[string]string{"load.1": "load1"}
+	prepared, err = i.prepare(metrics)
+	require.NoError(t, err)
+	require.Equal(t, "prod_cpu,time_tag=t1 load1=0.5 1000000000\n", serialize(prepared))
+	require.Equal(t, untransformed, serialize(metrics))
+}
+
+func TestSerializeChunks(t *testing.T) {
+	var metrics []telegraf.Metric
+	size := 0
+	for n := 0; n < 10; n++ {
+		m, err := metric.New("cpu", map[string]string{"host": "h1"}, map[string]interface{}{"value": float64(n)}, time.Unix(int64(n), 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+		size = m.Len()
+	}
+
+	var chunks []string
+	var counts []int
+	collect := func(p []byte, count int) error {
+		chunks = append(chunks, string(p))
+		counts = append(counts, count)
+		return nil
+	}
+
+	// a small batch makes a single chunk
+	require.NoError(t, serializeChunks(metrics, 0, collect))
+	require.Len(t, chunks, 1)
+	require.Equal(t, []int{10}, counts)
+	var all string
+	for _, m := range metrics {
+		all += m.String()
+	}
+	require.Equal(t, all, chunks[0])
+
+	chunks, counts = nil, nil
+	require.NoError(t, serializeChunks(metrics, 3*size, collect))
+	require.Equal(t, []int{3, 3, 3, 1}, counts)
+	require.Equal(t, all, strings.Join(chunks, ""))
+
+	// a metric larger than max makes a chunk on its own
+	chunks, counts = nil, nil
+	require.NoError(t, serializeChunks(metrics[:2], size/2, collect))
+	require.Equal(t, []int{1, 1}, counts)
+
+	// stops at the first error
+	calls := 0
+	err := serializeChunks(metrics, 3*size, func([]byte, int) error {
+		calls++
+		return errors.New("unavailable")
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+}
+
+func largeBatch(t testing.TB, points int) []telegraf.Metric {
+	metrics := make([]telegraf.Metric, 0, points)
+	for n := 0; n < points; n++ {
+		m, err := metric.New("cpu",
+			map[string]string{"host": fmt.Sprintf("h%d", n%100)},
+			map[string]interface{}{"value": float64(n)},
+			time.Unix(int64(n), 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func TestWrite_LargeBatchIsChunked(t *testing.T) {
+	metrics := largeBatch(t, 100000)
+	size := 0
+	for _, m := range metrics {
+		size += m.Len()
+	}
+	require.True(t, size > 2*postChunkBytes)
+
+	client := &mockTsdbClient{}
+	i := newTestPandoraTSDB()
+	i.client = client
+	// the counters are shared by the tests writing to the same repo
+	points := i.repoStats().PointsWritten.Get()
+	require.NoError(t, i.Write(metrics))
+
+	// the batch is never serialized as a whole
+	written := 0
+	for _, input := range client.postInputs {
+		require.True(t, cap(input.Buffer) <= postChunkBytes, "buffer of %d bytes", cap(input.Buffer))
+		written += len(input.Buffer)
+	}
+	require.True(t, len(client.posts) > 1)
+	require.Equal(t, size, written)
+	require.Equal(t, int64(100000), i.repoStats().PointsWritten.Get()-points)
+}
+
+func BenchmarkWrite_100kPoints(b *testing.B) {
+	metrics := largeBatch(b, 100000)
+	i := newTestPandoraTSDB()
+	i.client = discardTsdbClient{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i.Write(metrics)
+	}
+}
+
+func TestConnectError_InvalidHTTPProxy(t *testing.T) {
+	i := newTestPandoraTSDB()
+	i.HTTPProxy = "proxy:3128"
+
+	err := i.Connect()
+	require.Error(t, err)
+}
+
+type mockTsdbClient struct {
+	tsdb.TsdbAPI
+
+	postErr      error
+	postRepoErrs map[string]error
+	// errors of the first posts, in order, returned before postErr
+	postErrs           []error
+	posts              [][]byte
+	postInputs         []*tsdb.PostPointsFromBytesInput
+	createSeriesInputs []*tsdb.CreateSeriesInput
+	createSeriesErr    error
+
+	// calls are made concurrently, CreateSeries takes createSeriesDelay and
+	// PostPointsFromBytes postDelay, both track the peak number of their
+	// calls in flight
+	mu                sync.Mutex
+	createSeriesDelay time.Duration
+	inflight          int
+	maxInflight       int
+	postDelay         time.Duration
+	postsInflight     int
+	maxPostsInflight  int
+}
+
+func (m *mockTsdbClient) PostPointsFromBytes(input *tsdb.PostPointsFromBytesInput) error {
+	m.mu.Lock()
+	m.postsInflight++
+	if m.postsInflight > m.maxPostsInflight {
+		m.maxPostsInflight = m.postsInflight
+	}
+	m.mu.Unlock()
+
+	time.Sleep(m.postDelay)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.postsInflight--
+	// the buffer is reused once the call returns
+	m.posts = append(m.posts, append([]byte(nil), input.Buffer...))
+	m.postInputs = append(m.postInputs, input)
+	if err := m.postRepoErrs[input.RepoName]; err != nil {
+		return err
+	}
+	if len(m.postErrs) > 0 {
+		err := m.postErrs[0]
+		m.postErrs = m.postErrs[1:]
+		return err
+	}
+	return m.postErr
+}
+
+// discardTsdbClient accepts every post without keeping anything.
+type discardTsdbClient struct {
+	tsdb.TsdbAPI
+}
+
+func (discardTsdbClient) PostPointsFromBytes(*tsdb.PostPointsFromBytesInput) error {
+	return nil
+}
+
+func (m *mockTsdbClient) CreateSeries(input *tsdb.CreateSeriesInput) error {
+	m.mu.Lock()
+	m.createSeriesInputs = append(m.createSeriesInputs, input)
+	m.inflight++
+	if m.inflight > m.maxInflight {
+		m.maxInflight = m.inflight
+	}
+	m.mu.Unlock()
+
+	time.Sleep(m.createSeriesDelay)
+
+	m.mu.Lock()
+	m.inflight--
+	m.mu.Unlock()
+	return m.createSeriesErr
+}
+
+func TestWrite_NamePrefix(t *testing.T) {
+	client := &mockTsdbClient{postErr: errors.New("E7101: series does not exist")}
+
+	i := newPandoraTSDB()
+	i.Repo = "test"
+	i.NamePrefix = "prod_"
+	i.AutoCreateSeries = true
+	i.client = client
+
+	metrics := testutil.MockMetrics()
+	require.Error(t, i.Write(metrics))
+	// posted again once the series is created
+	require.Len(t, client.posts, 2)
+	require.True(t, strings.HasPrefix(string(client.posts[0]), "prod_test1,tag1=value1 "))
+	require.Len(t, client.createSeriesInputs, 1)
+	require.Equal(t, "prod_test1", client.createSeriesInputs[0].SeriesName)
+	// the metrics handed to the output are left untouched
+	require.Equal(t, "test1", metrics[0].Name())
+}
+
+func newTestPandoraTSDB() *PandoraTSDB {
+	i := newPandoraTSDB()
+	i.URL = "https://tsdb.qiniu.com"
+	i.Repo = "test"
+	i.AK = "ak"
+	i.SK = "sk"
+	return i
+}
+
+func TestInit(t *testing.T) {
+	i := newTestPandoraTSDB()
+	i.URL = " https://tsdb.qiniu.com/ "
+	require.NoError(t, i.Init())
+	require.Equal(t, "https://tsdb.qiniu.com", i.URL)
+	i.URL = "http://[::1]:8080"
+	require.NoError(t, i.Init())
+
+	tests := []struct {
+		field  string
+		modify func(*PandoraTSDB)
+	}{
+		{"URL", func(i *PandoraTSDB) { i.URL = "" }},
+		{"URL", func(i *PandoraTSDB) { i.URL = "ftp://tsdb.qiniu.com" }},
+		{"URL", func(i *PandoraTSDB) { i.URL = "http://::1:8080" }},
+		{"Repo", func(i *PandoraTSDB) { i.Repo = "" }},
+		{"AK", func(i *PandoraTSDB) { i.AK = "" }},
+		{"SK", func(i *PandoraTSDB) { i.SK = "" }},
+		{"Timeout", func(i *PandoraTSDB) { i.Timeout.Duration = -time.Second }},
+		{"ConnectTimeout", func(i *PandoraTSDB) { i.ConnectTimeout.Duration = -time.Second }},
+	}
+	for _, tt := range tests {
+		i := newTestPandoraTSDB()
+		tt.modify(i)
+		err := i.Init()
+		require.Error(t, err, tt.field)
+		require.Contains(t, err.Error(), "config."+tt.field)
+	}
+}
+
+func TestWrite_CreatesSeriesOnce(t *testing.T) {
+	client := &mockTsdbClient{postErr: errors.New("E7101: series does not exist")}
+
+	i := newTestPandoraTSDB()
+	i.AutoCreateSeries = true
+	i.client = client
+
+	for n := 0; n < 3; n++ {
+		require.Error(t, i.Write(testutil.MockMetrics()))
+	}
+	// only the write creating the series posts again
+	require.Len(t, client.posts, 4)
+	require.Len(t, client.createSeriesInputs, 1)
+	require.Equal(t, "test1", client.createSeriesInputs[0].SeriesName)
+
+	// a new connection starts over
+	require.NoError(t, i.Connect())
+	i.client = client
+	require.Error(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, client.createSeriesInputs, 2)
+}
+
+func TestWrite_RepostsAfterCreatingSeries(t *testing.T) {
+	client := &mockTsdbClient{postErrs: []error{errors.New("E7101: series does not exist")}}
+
+	i := newTestPandoraTSDB()
+	i.Repo = "repost_test"
+	i.AutoCreateSeries = true
+	i.client = client
+
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, client.createSeriesInputs, 1)
+	require.Len(t, client.posts, 2)
+	require.Equal(t, client.posts[0], client.posts[1])
+	require.Equal(t, int64(1), i.repoStats().PointsWritten.Get())
+
+	// the points are not posted again when the series cannot be created
+	client = &mockTsdbClient{postErr: errors.New("E7101: series does not exist")}
+	client.createSeriesErr = errors.New("E7102: invalid series name")
+	i = newTestPandoraTSDB()
+	i.AutoCreateSeries = true
+	i.client = client
+
+	require.Error(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, client.createSeriesInputs, 1)
+	require.Len(t, client.posts, 1)
+}
+
+func TestWrite_MaxInflightBytes(t *testing.T) {
+	for _, max := range []int64{0, 30} {
+		client := &mockTsdbClient{postDelay: 20 * time.Millisecond}
+
+		i := newTestPandoraTSDB()
+		i.RepoTag = "tenant"
+		i.MaxInflightBytes = max
+		require.NoError(t, i.Init())
+		i.client = client
+
+		// the repos are written in parallel, every post is 24 bytes and only
+		// one of them fits under the bound at a time
+		var metrics []telegraf.Metric
+		for n := 0; n < 4; n++ {
+			m, err := metric.New("cpu",
+				map[string]string{"tenant": fmt.Sprintf("r%d", n)},
+				map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+			require.NoError(t, err)
+			metrics = append(metrics, m)
+		}
+		require.NoError(t, i.Write(metrics))
+
+		require.Len(t, client.posts, 4)
+		if max == 0 {
+			require.True(t, client.maxPostsInflight > 1, "max_inflight_bytes=0")
+		} else {
+			require.Equal(t, 1, client.maxPostsInflight, "max_inflight_bytes=%d", max)
+		}
+	}
+
+	i := newTestPandoraTSDB()
+	i.MaxInflightBytes = -1
+	require.EqualError(t, i.Init(), "config.MaxInflightBytes must not be negative, got -1")
+}
+
+func TestWrite_OnFieldConflict(t *testing.T) {
+	conflict := errors.New(`field type conflict: input field "value" is type integer`)
+	for _, tc := range []struct {
+		mode    string
+		errs    []error
+		posts   int
+		written int64
+		err     bool
+	}{
+		{"drop", []error{conflict}, 1, 0, false},
+		{"retry_once", []error{conflict}, 2, 1, false},
+		{"retry_once", []error{conflict, conflict}, 2, 0, false},
+		{"error", []error{conflict}, 1, 0, true},
+	} {
+		client := &mockTsdbClient{postErrs: tc.errs}
+
+		i := newTestPandoraTSDB()
+		i.Repo = "field_conflict_" + tc.mode
+		i.OnFieldConflict = tc.mode
+		require.NoError(t, i.Init())
+		i.client = client
+		written := i.repoStats().PointsWritten.Get()
+
+		err := i.Write(testutil.MockMetrics())
+		require.Equal(t, tc.err, err != nil, tc.mode)
+		require.Len(t, client.posts, tc.posts, tc.mode)
+		require.Equal(t, tc.written, i.repoStats().PointsWritten.Get()-written, tc.mode)
+	}
+
+	i := newTestPandoraTSDB()
+	i.OnFieldConflict = "ignore"
+	require.EqualError(t, i.Init(), `invalid on_field_conflict "ignore", must be one of drop, retry_once, error`)
+}
+
+func TestCreateSeries_RetentionOverrides(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.RetentionPolicy = "7d"
+	i.RetentionOverrides = map[string]string{"cpu": "30d", "mem": "1d"}
+	i.client = client
+	require.NoError(t, i.Init())
+
+	require.NoError(t, i.createSeries([]byte("cpu,host=h1 value=1\nmem,host=h1 value=1\ndisk,host=h1 value=1\n")))
+	retentions := make(map[string]string)
+	for _, input := range client.createSeriesInputs {
+		retentions[input.SeriesName] = input.Retention
+	}
+	require.Equal(t, map[string]string{"cpu": "30d", "mem": "1d", "disk": "7d"}, retentions)
+
+	i.RetentionOverrides["mem"] = "31d"
+	require.Error(t, i.Init())
+}
+
+func TestCreateSeries_Concurrency(t *testing.T) {
+	var points bytes.Buffer
+	for n := 0; n < 20; n++ {
+		fmt.Fprintf(&points, "m%d,host=h1 value=1\n", n)
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		client := &mockTsdbClient{createSeriesDelay: 5 * time.Millisecond}
+
+		i := newTestPandoraTSDB()
+		i.SeriesCreateConcurrency = concurrency
+		i.client = client
+
+		require.NoError(t, i.createSeries(points.Bytes()))
+		require.Len(t, client.createSeriesInputs, 20)
+		require.Len(t, i.createdSeries, 20)
+		require.True(t, client.maxInflight <= concurrency, "%d in flight", client.maxInflight)
+		if concurrency == 1 {
+			for n, input := range client.createSeriesInputs {
+				require.Equal(t, fmt.Sprintf("m%d", n), input.SeriesName)
+			}
+		}
+	}
+}
+
+func TestWrite_RepoTag(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.RepoTag = "tenant"
+	// a single writer keeps the order of the posts across repos
+	i.WriteConcurrency = 1
+	i.client = client
+
+	var metrics []telegraf.Metric
+	for _, tenant := range []string{"a", "b", "a"} {
+		m, err := metric.New("cpu",
+			map[string]string{"host": "h1", "tenant": tenant},
+			map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+
+	require.Len(t, client.postInputs, 2)
+	require.Equal(t, "a", client.postInputs[0].RepoName)
+	require.Equal(t, "b", client.postInputs[1].RepoName)
+	for _, input := range client.postInputs {
+		require.NotContains(t, string(input.Buffer), "tenant")
+	}
+	require.Equal(t, 2, strings.Count(string(client.postInputs[0].Buffer), "cpu,host=h1"))
+}
+
+func TestWrite_MeasurementRepos(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.MeasurementRepos = map[string]string{"cpu": "hosts", "mem": "hosts", "syslog": "logs"}
+	// a single writer keeps the order of the posts across repos
+	i.WriteConcurrency = 1
+	require.NoError(t, i.Init())
+	i.client = client
+
+	var metrics []telegraf.Metric
+	for _, name := range []string{"cpu", "syslog", "mem", "disk"} {
+		m, err := metric.New(name, map[string]string{"host": "h1"},
+			map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+
+	require.Len(t, client.postInputs, 3)
+	require.Equal(t, "hosts", client.postInputs[0].RepoName)
+	require.Equal(t, "logs", client.postInputs[1].RepoName)
+	require.Equal(t, "test", client.postInputs[2].RepoName)
+	require.Contains(t, string(client.postInputs[0].Buffer), "cpu,host=h1")
+	require.Contains(t, string(client.postInputs[0].Buffer), "mem,host=h1")
+	require.Contains(t, string(client.postInputs[1].Buffer), "syslog,host=h1")
+	require.Contains(t, string(client.postInputs[2].Buffer), "disk,host=h1")
+}
+
+func TestWrite_RepoTagConcurrency(t *testing.T) {
+	client := &mockTsdbClient{postRepoErrs: map[string]error{
+		"r2": errors.New("E7102: invalid point"),
+		"r4": errors.New("E7103: invalid point"),
+	}}
+
+	i := newTestPandoraTSDB()
+	i.RepoTag = "tenant"
+	i.WriteConcurrency = 3
+	i.client = client
+
+	var metrics []telegraf.Metric
+	for n := 0; n < 6; n++ {
+		for _, value := range []float64{1, 2} {
+			m, err := metric.New("cpu",
+				map[string]string{"tenant": fmt.Sprintf("r%d", n)},
+				map[string]interface{}{"value": value}, time.Unix(int64(value), 0))
+			require.NoError(t, err)
+			metrics = append(metrics, m)
+		}
+	}
+	err := i.Write(metrics)
+	require.Error(t, err)
+	require.Equal(t, 2, strings.Count(err.Error(), "Could not write"))
+
+	// every repo got its points, in order, despite the failing ones
+	posts := make(map[string]string)
+	for n, input := range client.postInputs {
+		posts[input.RepoName] += string(client.posts[n])
+	}
+	require.Len(t, posts, 6)
+	for repo, data := range posts {
+		require.Equal(t, 2, strings.Count(data, "value="), repo)
+		require.True(t, strings.Index(data, "value=1") < strings.Index(data, "value=2"), repo)
+	}
+}
+
+func TestWrite_FloatNaNHandling(t *testing.T) {
+	m, err := metric.New("cpu", map[string]string{"host": "h1"},
+		map[string]interface{}{"idle": math.NaN(), "value": 1.0},
+		time.Unix(1, 0))
+	require.NoError(t, err)
+
+	tests := []struct {
+		mode     string
+		expected map[string]interface{}
+	}{
+		{"drop", map[string]interface{}{"value": 1.0}},
+		{"zero", map[string]interface{}{"idle": 0.0, "value": 1.0}},
+	}
+	for _, tt := range tests {
+		client := &mockTsdbClient{}
+		i := newTestPandoraTSDB()
+		i.FloatNaNHandling = tt.mode
+		i.client = client
+
+		require.NoError(t, i.Write([]telegraf.Metric{m}), tt.mode)
+		require.Len(t, client.posts, 1, tt.mode)
+		written, err := metric.Parse(client.posts[0])
+		require.NoError(t, err, tt.mode)
+		require.Len(t, written, 1, tt.mode)
+		require.Equal(t, tt.expected, written[0].Fields(), tt.mode)
+	}
+
+	client := &mockTsdbClient{}
+	i := newTestPandoraTSDB()
+	i.FloatNaNHandling = "error"
+	i.client = client
+	require.Error(t, i.Write([]telegraf.Metric{m}))
+	require.Empty(t, client.posts)
+}
+
+func TestWrite_NaNOnlyPointDropped(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.Repo = "dropped_test"
+	i.client = client
+
+	nan, err := metric.New("cpu", map[string]string{"host": "h1"},
+		map[string]interface{}{"idle": math.NaN()}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m, err := metric.New("cpu", map[string]string{"host": "h1"},
+		map[string]interface{}{"idle": 1.0}, time.Unix(2, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{nan, m}))
+
+	require.Len(t, client.posts, 1)
+	written, err := metric.Parse(client.posts[0])
+	require.NoError(t, err)
+	require.Len(t, written, 1)
+	require.Equal(t, time.Unix(2, 0), written[0].Time())
+	require.Equal(t, int64(1), i.repoStats().PointsDropped.Get())
+
+	// nothing is posted when all points are dropped
+	require.NoError(t, i.Write([]telegraf.Metric{nan}))
+	require.Len(t, client.posts, 1)
+	require.Equal(t, int64(2), i.repoStats().PointsDropped.Get())
+}
+
+func TestWrite_DropStalePoints(t *testing.T) {
+	client := &mockTsdbClient{}
+	now := time.Now()
+
+	i := newTestPandoraTSDB()
+	i.DropStalePoints = true
+	i.RetentionPolicy = "7d"
+	i.client = client
+
+	fresh, err := metric.New("cpu", map[string]string{"host": "h1"},
+		map[string]interface{}{"value": 1.0}, now.Add(-time.Minute))
+	require.NoError(t, err)
+	old, err := metric.New("cpu", map[string]string{"host": "h1"},
+		map[string]interface{}{"value": 2.0}, now.Add(-365*24*time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{old, fresh, old}))
+
+	require.Len(t, client.posts, 1)
+	written, err := metric.Parse(client.posts[0])
+	require.NoError(t, err)
+	require.Len(t, written, 1)
+	require.Equal(t, map[string]interface{}{"value": 1.0}, written[0].Fields())
+
+	// nothing is posted when all points are stale
+	require.NoError(t, i.Write([]telegraf.Metric{old}))
+	require.Len(t, client.posts, 1)
+}
+
+func TestWrite_Stats(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.Repo = "stats_test"
+	i.client = client
+
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	stats := i.repoStats()
+	require.Equal(t, int64(1), stats.PointsWritten.Get())
+	require.Equal(t, int64(len(client.posts[0])), stats.BytesSent.Get())
+	require.Equal(t, int64(0), stats.WriteErrors.Get())
+
+	client.postErr = errors.New("E7101: series does not exist")
+	i.AutoCreateSeries = true
+	require.Error(t, i.Write(testutil.MockMetrics()))
+	require.Equal(t, int64(1), stats.PointsWritten.Get())
+	// the points are posted again once the series is created
+	require.Equal(t, int64(2), stats.WriteErrors.Get())
+	require.Equal(t, int64(1), stats.SchemaUpdates.Get())
+	require.Equal(t, map[string]string{"output": "pandora", "repo": "stats_test"}, stats.PointsWritten.Tags())
+}
+
+func TestWrite_PayloadStats(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.Repo = "payload_stats_test"
+	i.client = client
+
+	var metrics []telegraf.Metric
+	for n := 0; n < 3; n++ {
+		m, err := metric.New("cpu", map[string]string{"host": "h1"},
+			map[string]interface{}{"value": float64(n)}, time.Unix(int64(n), 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+	require.NoError(t, i.Write(metrics[:1]))
+	require.Len(t, client.posts, 2)
+
+	stats := i.repoStats()
+	first, second := len(client.posts[0]), len(client.posts[1])
+	require.Equal(t, int64(first+second)/2, stats.PayloadBytes.Get())
+	require.Equal(t, int64(2), stats.PayloadRecords.Get())
+	require.Equal(t, int64(first), stats.PayloadBytesMax.Get())
+}
+
+func TestWrite_SeriesNameTemplate(t *testing.T) {
+	client := &mockTsdbClient{postErr: errors.New("E7101: series does not exist")}
+
+	i := newTestPandoraTSDB()
+	i.NamePrefix = "prod_"
+	i.SeriesNameTemplate = "disk_{{.device}}"
+	i.AutoCreateSeries = true
+	require.NoError(t, i.Init())
+	i.client = client
+
+	var metrics []telegraf.Metric
+	for _, tags := range []map[string]string{
+		{"device": "sda", "host": "h1"},
+		{"device": "sdb", "host": "h1"},
+		{"host": "h1"},
+	} {
+		m, err := metric.New("disk", tags,
+			map[string]interface{}{"used": 1.0}, time.Unix(1, 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.Error(t, i.Write(metrics))
+
+	require.Len(t, client.posts, 2)
+	lines := strings.Split(strings.TrimSpace(string(client.posts[0])), "\n")
+	require.Len(t, lines, 3)
+	// the order of the tags in a line is not fixed, only check the names
+	require.True(t, strings.HasPrefix(lines[0], "prod_disk_sda,"), lines[0])
+	require.True(t, strings.HasPrefix(lines[1], "prod_disk_sdb,"), lines[1])
+	require.True(t, strings.HasPrefix(lines[2], "prod_disk,host=h1 "), lines[2])
+
+	var series []string
+	for _, input := range client.createSeriesInputs {
+		series = append(series, input.SeriesName)
+	}
+	sort.Strings(series)
+	require.Equal(t, []string{"prod_disk", "prod_disk_sda", "prod_disk_sdb"}, series)
+	// the metrics handed to the output are left untouched
+	require.Equal(t, "disk", metrics[0].Name())
+
+	i = newTestPandoraTSDB()
+	i.SeriesNameTemplate = "disk_{{.device"
+	require.Error(t, i.Init())
+}
+
+func TestWrite_DefaultTags(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.DefaultTags = map[string]string{"dc": "nb"}
+	i.client = client
+
+	m1, err := metric.New("cpu", map[string]string{"host": "h1"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("mem", map[string]string{"host": "h1", "dc": "sh"}, map[string]interface{}{"value": 2.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m1, m2}))
+
+	require.Len(t, client.posts, 1)
+	written, err := metric.Parse(client.posts[0])
+	require.NoError(t, err)
+	require.Len(t, written, 2)
+	require.Equal(t, map[string]string{"host": "h1", "dc": "nb"}, written[0].Tags())
+	require.Equal(t, map[string]string{"host": "h1", "dc": "sh"}, written[1].Tags())
+}
+
+func TestWrite_FieldFilter(t *testing.T) {
+	newMetrics := func() []telegraf.Metric {
+		m1, err := metric.New("system", map[string]string{"host": "h1"},
+			map[string]interface{}{"load.1": 1.0, "uptime": int64(10)}, time.Unix(1, 0))
+		require.NoError(t, err)
+		m2, err := metric.New("system", map[string]string{"host": "h1"},
+			map[string]interface{}{"uptime": int64(20)}, time.Unix(2, 0))
+		require.NoError(t, err)
+		return []telegraf.Metric{m1, m2}
+	}
+
+	// pass only, matching the renamed fields
+	client := &mockTsdbClient{}
+	i := newTestPandoraTSDB()
+	i.FieldRename = map[string]string{"load.1": "load1"}
+	i.FieldInclude = []string{"load*"}
+	require.NoError(t, i.Init())
+	i.client = client
+	require.NoError(t, i.Write(newMetrics()))
+	require.Len(t, client.posts, 1)
+	written, err := metric.Parse(client.posts[0])
+	require.NoError(t, err)
+	require.Len(t, written, 1)
+	require.Equal(t, map[string]interface{}{"load1": 1.0}, written[0].Fields())
+
+	// drop only
+	client = &mockTsdbClient{}
+	i = newTestPandoraTSDB()
+	i.FieldExclude = []string{"uptime"}
+	require.NoError(t, i.Init())
+	i.client = client
+	require.NoError(t, i.Write(newMetrics()))
+	require.Len(t, client.posts, 1)
+	written, err = metric.Parse(client.posts[0])
+	require.NoError(t, err)
+	require.Len(t, written, 1)
+	require.Equal(t, map[string]interface{}{"load.1": 1.0}, written[0].Fields())
+}
+
+func TestWrite_MaxTagValues(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.MaxTagValues = 2
+	require.NoError(t, i.Init())
+	i.client = client
+
+	for n := 0; n < 4; n++ {
+		m, err := metric.New("req", map[string]string{"host": "h1", "id": fmt.Sprint(n)},
+			map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+		require.NoError(t, err)
+		require.NoError(t, i.Write([]telegraf.Metric{m}))
+	}
+
+	require.Len(t, client.posts, 4)
+	var tags []map[string]string
+	for _, post := range client.posts {
+		written, err := metric.Parse(post)
+		require.NoError(t, err)
+		require.Len(t, written, 1)
+		tags = append(tags, written[0].Tags())
+	}
+	require.Equal(t, []map[string]string{
+		{"host": "h1", "id": "0"},
+		{"host": "h1", "id": "1"},
+		{"host": "h1"},
+		{"host": "h1"},
+	}, tags)
+
+	i = newTestPandoraTSDB()
+	i.MaxTagValues = -1
+	require.EqualError(t, i.Init(), "config.MaxTagValues must not be negative, got -1")
+}
+
+// tagsOnlyMetric is a metric left without fields, which metric.New refuses
+// to build.
+type tagsOnlyMetric struct {
+	telegraf.Metric
+}
+
+func (m tagsOnlyMetric) Fields() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func TestWrite_Empty(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.client = client
+
+	require.NoError(t, i.Write(nil))
+	require.NoError(t, i.Write([]telegraf.Metric{}))
+	require.Empty(t, client.posts)
+}
+
+func TestWrite_SkipsPointsWithoutFields(t *testing.T) {
+	client := &mockTsdbClient{}
+
+	i := newTestPandoraTSDB()
+	i.client = client
+
+	m1, err := metric.New("cpu", map[string]string{"host": "h1"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("mem", map[string]string{"host": "h1"}, map[string]interface{}{"value": 2.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+
+	// nothing is posted for a batch of points without fields
+	require.NoError(t, i.Write([]telegraf.Metric{tagsOnlyMetric{m2}}))
+	require.Empty(t, client.posts)
+
+	require.NoError(t, i.Write([]telegraf.Metric{m1, tagsOnlyMetric{m2}}))
+	require.Len(t, client.posts, 1)
+	require.Contains(t, string(client.posts[0]), "cpu,host=h1 value=1 1000000000\n")
+	require.NotContains(t, string(client.posts[0]), "mem")
+}
+
+func TestWrite_Spill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pandora")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := &mockTsdbClient{}
+	client.postErr = errors.New("pandora error: StatusCode=503, ErrorMessage=service unavailable")
+
+	i := newTestPandoraTSDB()
+	i.SpillDirectory = dir
+	i.client = client
+
+	// the failed write is spilled rather than left in the buffer
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, client.posts, 1)
+	spilled := string(client.posts[0])
+	files, err := ioutil.ReadDir(filepath.Join(dir, i.Repo))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// and replayed once a write succeeds
+	client.postErr = nil
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, client.posts, 3)
+	require.Equal(t, spilled, string(client.posts[2]))
+	files, err = ioutil.ReadDir(filepath.Join(dir, i.Repo))
+	require.NoError(t, err)
+	require.Len(t, files, 0)
+}
+
+func TestWrite_SpillRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pandora")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	unavailable := errors.New("pandora error: StatusCode=503, ErrorMessage=service unavailable")
+	rejected := errors.New("pandora error: StatusCode=400, ErrorMessage=E18111: schema mismatch")
+	client := &mockTsdbClient{postErrs: []error{unavailable, unavailable, nil, rejected}}
+
+	i := newTestPandoraTSDB()
+	i.Repo = "spill_rejected_test"
+	i.SpillDirectory = dir
+	i.client = client
+	dropped := i.repoStats().PointsDropped.Get()
+
+	var batches [][]telegraf.Metric
+	for n := 0; n < 3; n++ {
+		m, err := metric.New("cpu", map[string]string{}, map[string]interface{}{"value": float64(n)}, time.Unix(int64(n), 0))
+		require.NoError(t, err)
+		batches = append(batches, []telegraf.Metric{m})
+	}
+	require.NoError(t, i.Write(batches[0]))
+	require.NoError(t, i.Write(batches[1]))
+
+	// the first spilled points are rejected for good on replay, they are
+	// dropped rather than holding back the points spilled after them
+	require.NoError(t, i.Write(batches[2]))
+	require.Len(t, client.posts, 5)
+	require.Equal(t, client.posts[0], client.posts[3])
+	require.Equal(t, client.posts[1], client.posts[4])
+	require.Equal(t, int64(1), i.repoStats().PointsDropped.Get()-dropped)
+	files, err := ioutil.ReadDir(filepath.Join(dir, i.Repo))
+	require.NoError(t, err)
+	require.Len(t, files, 0)
+}
+
+func TestConnect_SharedPool(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		addrs []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		addrs = append(addrs, r.RemoteAddr)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	get := func(i *PandoraTSDB) {
+		resp, err := (&http.Client{Transport: i.transport}).Get(ts.URL)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	i1 := newTestPandoraTSDB()
+	i1.URL = ts.URL
+	require.NoError(t, i1.Connect())
+	i2 := newTestPandoraTSDB()
+	i2.URL = ts.URL
+	i2.Repo = "other"
+	require.NoError(t, i2.Connect())
+	defer i2.Close()
+
+	get(i1)
+	get(i2)
+	require.Equal(t, addrs[0], addrs[1])
+
+	// the connections outlive the output closed first
+	require.NoError(t, i1.Close())
+	get(i2)
+	require.Equal(t, addrs[0], addrs[2])
+}
+
+func TestConnect_IdleConns(t *testing.T) {
+	var addrs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addrs = append(addrs, r.RemoteAddr)
+	}))
+	defer ts.Close()
+	get := func(i *PandoraTSDB) {
+		resp, err := (&http.Client{Transport: i.transport}).Get(ts.URL)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// the outputs with other idle connection limits have their own pool
+	i1 := newTestPandoraTSDB()
+	i1.URL = ts.URL
+	require.NoError(t, i1.Connect())
+	defer i1.Close()
+	i2 := newTestPandoraTSDB()
+	i2.URL = ts.URL
+	i2.MaxIdleConnsPerHost = 10
+	require.NoError(t, i2.Connect())
+	defer i2.Close()
+
+	get(i1)
+	get(i2)
+	require.NotEqual(t, addrs[0], addrs[1])
+
+	i := newTestPandoraTSDB()
+	i.MaxIdleConns = -1
+	require.EqualError(t, i.Init(), "config.MaxIdleConns must not be negative, got -1")
+	i = newTestPandoraTSDB()
+	i.MaxIdleConnsPerHost = -1
+	require.EqualError(t, i.Init(), "config.MaxIdleConnsPerHost must not be negative, got -1")
+}
+
+func TestWrite_Endpoints(t *testing.T) {
+	up := &mockTsdbClient{}
+	down := &mockTsdbClient{postErr: errors.New("E500: internal error")}
+
+	i := newTestPandoraTSDB()
+	i.client = &quorumClient{
+		TsdbAPI:    up,
+		endpoints:  []string{"https://a.example.com", "https://b.example.com"},
+		clients:    []tsdb.TsdbAPI{down, up},
+		minSuccess: 1,
+	}
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, up.posts, 1)
+	require.Equal(t, up.posts, down.posts)
+
+	i.client.(*quorumClient).minSuccess = 2
+	require.Error(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, up.posts, 2)
+}
+
+func TestWrite_EndpointsViaServer(t *testing.T) {
+	var posts int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	i := newTestPandoraTSDB()
+	i.URL = ""
+	i.Endpoints = []string{up.URL, down.URL}
+	i.MinSuccess = 1
+	require.NoError(t, i.Connect())
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Equal(t, int32(2), atomic.LoadInt32(&posts))
+
+	// all the endpoints must accept the writes by default
+	i.MinSuccess = 0
+	require.NoError(t, i.Connect())
+	require.Error(t, i.Write(testutil.MockMetrics()))
+	require.NoError(t, i.Close())
+}
+
+func TestInit_Endpoints(t *testing.T) {
+	i := newTestPandoraTSDB()
+	i.URL = ""
+	i.Endpoints = []string{" https://a.example.com/ ", "https://b.example.com"}
+	require.NoError(t, i.Init())
+	require.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, i.endpoints())
+
+	i.MinSuccess = 3
+	require.EqualError(t, i.Init(), "config.MinSuccess must be between 0 and the 2 endpoints, got 3")
+
+	i = newTestPandoraTSDB()
+	i.Endpoints = []string{"https://a.example.com"}
+	require.EqualError(t, i.Init(), "config.URL must not be set along config.Endpoints")
+
+	i = newTestPandoraTSDB()
+	i.URL = ""
+	i.Endpoints = []string{"ftp://a.example.com"}
+	require.Error(t, i.Init())
+}
+
+func TestWrite_UserAgentViaServer(t *testing.T) {
+	var userAgents []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.UserAgent())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	i := newTestPandoraTSDB()
+	i.URL = ts.URL
+	i.UserAgent = "telegraf-test"
+	require.NoError(t, i.Connect())
+	i.Write(testutil.MockMetrics())
+	require.NoError(t, i.Close())
+
+	require.NotEmpty(t, userAgents)
+	for _, userAgent := range userAgents {
+		require.Equal(t, "telegraf-test", userAgent)
+	}
+}
+
+func TestWrite_HTTPHeadersViaServer(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		tenants []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tenants = append(tenants, r.Header.Get("X-Tenant-Id"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	i := newTestPandoraTSDB()
+	i.URL = ts.URL
+	i.HTTPHeaders = map[string]string{"X-Tenant-Id": "t1"}
+	require.NoError(t, i.Init())
+	require.NoError(t, i.Connect())
+	connectRequests := len(tenants)
+	i.Write(testutil.MockMetrics())
+	require.NoError(t, i.Close())
+
+	require.True(t, len(tenants) > connectRequests)
+	for _, tenant := range tenants {
+		require.Equal(t, "t1", tenant)
+	}
+
+	i = newTestPandoraTSDB()
+	i.HTTPHeaders = map[string]string{"Authorization": "Bearer x"}
+	require.Error(t, i.Init())
+}
+
+func TestWrite_SecurityTokenFileViaServer(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		tokens []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("X-Security-Token"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "pandora")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("token1\n"), 0600))
+
+	i := newTestPandoraTSDB()
+	i.URL = ts.URL
+	i.SecurityTokenFile = path
+	require.NoError(t, i.Connect())
+	i.Write(testutil.MockMetrics())
+	require.NotEmpty(t, tokens)
+	require.Equal(t, "token1", tokens[len(tokens)-1])
+
+	// the token is renewed before it expires
+	require.NoError(t, ioutil.WriteFile(path, []byte("token2\n"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	i.Write(testutil.MockMetrics())
+	require.NoError(t, i.Close())
+	require.Equal(t, "token2", tokens[len(tokens)-1])
+}
+
+func TestWrite_DeadlineViaServer(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	i := newTestPandoraTSDB()
+	i.URL = ts.URL
+	i.Timeout.Duration = 100 * time.Millisecond
+	i.MaxRetries = 3
+	i.RetryInterval.Duration = time.Millisecond
+	require.NoError(t, i.Connect())
+
+	start := time.Now()
+	require.Error(t, i.Write(testutil.MockMetrics()))
+	require.True(t, time.Since(start) < time.Second, "took %s", time.Since(start))
+	require.NoError(t, i.Close())
+}
@@ -0,0 +1,67 @@
+package pandora
+
+import (
+	"log"
+	"sync"
+
+	"qiniu.com/pandora/tsdb"
+)
+
+// quorumClient writes to the repos of several Pandora endpoints, set up
+// alike. Points are posted and series created on all the endpoints, the
+// calls succeed when at least minSuccess of them do.
+type quorumClient struct {
+	// client of the first endpoint, for the other calls
+	tsdb.TsdbAPI
+
+	endpoints  []string
+	clients    []tsdb.TsdbAPI
+	minSuccess int
+}
+
+func (q *quorumClient) PostPointsFromBytes(input *tsdb.PostPointsFromBytesInput) error {
+	return q.each("post points to", func(c tsdb.TsdbAPI) error {
+		in := *input
+		return c.PostPointsFromBytes(&in)
+	})
+}
+
+func (q *quorumClient) CreateSeries(input *tsdb.CreateSeriesInput) error {
+	return q.each("create series on", func(c tsdb.TsdbAPI) error {
+		in := *input
+		return c.CreateSeries(&in)
+	})
+}
+
+// each calls fn on the clients of all the endpoints at once. It returns nil
+// when at least minSuccess of the calls succeed, the error of the first
+// endpoint failing otherwise, so that it can be told apart by its code.
+func (q *quorumClient) each(op string, fn func(c tsdb.TsdbAPI) error) error {
+	errs := make([]error, len(q.clients))
+	var wg sync.WaitGroup
+	for n, c := range q.clients {
+		wg.Add(1)
+		go func(n int, c tsdb.TsdbAPI) {
+			defer wg.Done()
+			errs[n] = fn(c)
+		}(n, c)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	var first error
+	for n, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		log.Printf("W! could not %s endpoint %s: %s", op, q.endpoints[n], err)
+	}
+	if succeeded >= q.minSuccess {
+		return nil
+	}
+	return first
+}
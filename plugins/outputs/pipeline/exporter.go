@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	tsdb "github.com/influxdata/influxdb/models"
+)
+
+// exportState is the state of the exports of a repo.
+type exportState struct {
+	lastSync time.Time
+	// tags and fields of the measurements exported to tsdb so far
+	keys map[string]*seriesKeys
+}
+
+// exporter syncs the exports of the repos in the background, so that slow
+// export calls do not hold back the writes. The keys of the points written
+// to a repo are merged until the exporter gets to them.
+type exporter struct {
+	// held while the exports are synced, by the exporter and by the schema
+	// updates of the writes
+	mu sync.Mutex
+
+	pendingMu sync.Mutex
+	pending   map[*Pipeline]map[string]*seriesKeys
+	// the writers with pending keys, in the order they were queued
+	queue []*Pipeline
+
+	wake chan struct{}
+	stop chan struct{}
+	// closed when the exports still queued are given up on
+	abort chan struct{}
+	done  chan struct{}
+}
+
+// startExporter starts syncing the exports in the background.
+func (i *Pipeline) startExporter() {
+	e := &exporter{
+		pending: make(map[*Pipeline]map[string]*seriesKeys),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		abort:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	i.exporter = e
+	go e.run()
+}
+
+// stopExporter stops the exporter once it synced the exports still queued,
+// unless abort is closed first. The returned channel, nil without exporter,
+// is closed once the exporter is done.
+func (i *Pipeline) stopExporter(abort <-chan struct{}) <-chan struct{} {
+	e := i.exporter
+	if e == nil {
+		return nil
+	}
+	close(e.stop)
+	go func() {
+		select {
+		case <-abort:
+			close(e.abort)
+		case <-e.done:
+		}
+	}()
+	i.exporter = nil
+	return e.done
+}
+
+// queueExports queues the sync of the exports of the measurements of the
+// points. Without an exporter, before Connect, they are synced right away.
+func (i *Pipeline) queueExports(pts tsdb.Points) {
+	e := i.exporter
+	if e == nil {
+		i.syncDueExports(i.writeClients(), pointKeys(pts))
+		return
+	}
+
+	measurements := pointKeys(pts)
+	e.pendingMu.Lock()
+	if pending, ok := e.pending[i]; ok {
+		for name, keys := range measurements {
+			if p, ok := pending[name]; ok {
+				p.merge(keys)
+			} else {
+				pending[name] = keys
+			}
+		}
+	} else {
+		e.pending[i] = measurements
+		e.queue = append(e.queue, i)
+	}
+	e.pendingMu.Unlock()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// syncDueExports syncs the exports of the measurements with the clients c
+// when export_sync_interval has passed since the last sync. The keys are
+// dropped otherwise, they are synced along the next points bringing them.
+func (i *Pipeline) syncDueExports(c controlClients, measurements map[string]*seriesKeys) {
+	now := i.timeNow()
+	if now.Sub(i.exports.lastSync) < i.ExportSyncInterval.Duration {
+		return
+	}
+	i.exports.lastSync = now
+	if err := i.syncExports(c, measurements); err != nil {
+		log.Printf("E! sync exports of repo %s fail: %s", i.Repo, err)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	for {
+		select {
+		case <-e.stop:
+			e.flush()
+			return
+		case <-e.wake:
+			e.flush()
+		}
+	}
+}
+
+// flush syncs the exports of the keys queued so far.
+func (e *exporter) flush() {
+	e.pendingMu.Lock()
+	pending, queue := e.pending, e.queue
+	e.pending = make(map[*Pipeline]map[string]*seriesKeys)
+	e.queue = nil
+	e.pendingMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for n, w := range queue {
+		select {
+		case <-e.abort:
+			log.Printf("W! giving up on the exports of %d repos at shutdown", len(queue)-n)
+			return
+		default:
+		}
+		w.syncDueExports(w.backgroundClients(), pending[w])
+	}
+}
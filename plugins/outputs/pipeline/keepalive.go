@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf/plugins/outputs/pandora/client"
+
+	"github.com/qiniu/pandora-go-sdk/pipeline"
+)
+
+// keepaliveMaxFailures is the number of failed pings in a row after which
+// the client is rebuilt.
+const keepaliveMaxFailures = 3
+
+// keepalive pings the repo every keepalive_interval, so that a stale
+// connection is found, and replaced, between writes rather than by a write.
+type keepalive struct {
+	// held by the writes and the pings, so that the client is only rebuilt
+	// between writes
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startKeepalive starts pinging the repo when keepalive_interval is set.
+func (i *Pipeline) startKeepalive() {
+	if i.KeepaliveInterval.Duration <= 0 {
+		return
+	}
+	k := &keepalive{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	i.keepalive = k
+	go i.runKeepalive(k)
+}
+
+// stopKeepalive stops pinging the repo. The returned channel, nil without
+// keepalive, is closed once the ping in progress is done.
+func (i *Pipeline) stopKeepalive() <-chan struct{} {
+	k := i.keepalive
+	if k == nil {
+		return nil
+	}
+	close(k.stop)
+	i.keepalive = nil
+	return k.done
+}
+
+func (i *Pipeline) runKeepalive(k *keepalive) {
+	defer close(k.done)
+	ticker := time.NewTicker(i.KeepaliveInterval.Duration)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+		}
+
+		k.mu.Lock()
+		err := i.ping()
+		if err == nil {
+			failures = 0
+		} else {
+			failures++
+			log.Printf("W! ping of pipeline repo %s fail, %d in a row: %s", i.Repo, failures, err)
+			if failures >= keepaliveMaxFailures {
+				log.Printf("I! reconnecting to pipeline repo %s", i.Repo)
+				if err := i.reconnect(); err != nil {
+					log.Printf("E! reconnect to pipeline repo %s fail: %s", i.Repo, err)
+				} else {
+					failures = 0
+				}
+			}
+		}
+		k.mu.Unlock()
+	}
+}
+
+// ping gets the repo, a missing repo still shows a working connection.
+func (i *Pipeline) ping() error {
+	i.limiter.Wait()
+	_, err := i.backgroundClients().pipeline.GetRepo(&pipeline.GetRepoInput{RepoName: i.Repo})
+	if err != nil && !client.IsRepoNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// reconnect rebuilds the clients, dropping their connections, and hands
+// them to the writers of the other repos. The state of the writes is kept
+// and the repo is not checked again. The exports are not synced meanwhile.
+func (i *Pipeline) reconnect() error {
+	if e := i.exporter; e != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+	}
+	if i.transport != nil {
+		client.CloseIdleConnections(i.transport)
+	}
+	if err := i.newClients(); err != nil {
+		return err
+	}
+	for _, w := range i.repoWriters {
+		w.client = i.client
+		w.tsdbClient = i.tsdbClient
+		w.logdbClient = i.logdbClient
+		w.transport = i.transport
+		w.deadline = i.deadline
+		w.bgClient = i.bgClient
+		w.bgTsdbClient = i.bgTsdbClient
+		w.bgTransport = i.bgTransport
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/plugins/outputs/pandora/client"
+
+	"github.com/qiniu/pandora-go-sdk/logdb"
+)
+
+const defaultLogdbURL = "https://logdb.qiniu.com"
+
+// logdbEndpoint returns the endpoint the logdb client is built against.
+func (i *Pipeline) logdbEndpoint() string {
+	if i.LogdbURL == "" {
+		return defaultLogdbURL
+	}
+	return i.LogdbURL
+}
+
+// splitLogdb separates the metrics of the logdb_measurements from the
+// others.
+func (i *Pipeline) splitLogdb(metrics []telegraf.Metric) (others, logs []telegraf.Metric) {
+	if i.logdbFilter == nil {
+		return metrics, nil
+	}
+	for _, m := range metrics {
+		if i.logdbFilter.Match(m.Name()) {
+			logs = append(logs, m)
+		} else {
+			others = append(others, m)
+		}
+	}
+	return others, logs
+}
+
+// writeLogdb sends the metrics as logs to the logdb_repo, one log per
+// metric holding its measurement, tags, fields and time.
+func (i *Pipeline) writeLogdb(metrics []telegraf.Metric) error {
+	metrics, err := i.prepare(metrics, i.logdbStats())
+	if err != nil || len(metrics) == 0 {
+		return err
+	}
+
+	logs := make(logdb.Logs, 0, len(metrics))
+	for _, m := range metrics {
+		logs = append(logs, i.convertLog(m))
+	}
+
+	stats := i.logdbStats()
+	attempts := 0
+	err = client.Retry(i.MaxRetries, i.RetryInterval.Duration, func() error {
+		attempts++
+		_, err := i.logdbClient.SendLog(&logdb.SendLogInput{
+			RepoName: i.LogdbRepo,
+			Logs:     logs,
+		})
+		return err
+	})
+	stats.Retries.Incr(int64(attempts - 1))
+	if err != nil {
+		stats.WriteErrors.Incr(1)
+		err = fmt.Errorf("send logs to logdb repo %s fail: %s", i.LogdbRepo, err)
+		log.Printf("E! %s", err)
+		return err
+	}
+	stats.PointsWritten.Incr(int64(len(logs)))
+	return nil
+}
+
+// convertLog turns a metric into a log. Keys are sanitized like schema keys,
+// without the measurement prefix; a field takes precedence over a tag of the
+// same name.
+func (i *Pipeline) convertLog(m telegraf.Metric) map[string]interface{} {
+	l := make(map[string]interface{}, len(m.Tags())+len(m.Fields())+2)
+	l["measurement"] = m.Name()
+	for k, v := range m.Tags() {
+		l[i.logKey(k)] = v
+	}
+	for k, v := range m.Fields() {
+		l[i.logKey(k)] = v
+	}
+	l[i.TimestampKey] = m.Time().Format(time.RFC3339Nano)
+	return l
+}
+
+func (i *Pipeline) logKey(key string) string {
+	if validKeyPart(key) {
+		return key
+	}
+	var buf bytes.Buffer
+	writeSanitized(&buf, key, i.SanitizeReplacement)
+	return buf.String()
+}
+
+// logdbStats returns the counters of the logdb repo, registered on first
+// use.
+func (i *Pipeline) logdbStats() *client.Stats {
+	if i.logStats == nil {
+		i.logStats = client.NewStats("pipeline", i.LogdbRepo)
+	}
+	return i.logStats
+}
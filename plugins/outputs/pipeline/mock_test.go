@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/qiniu/pandora-go-sdk/logdb"
+	"github.com/qiniu/pandora-go-sdk/pipeline"
+	tsdbSdk "github.com/qiniu/pandora-go-sdk/tsdb"
+)
+
+// mockPipelineClient is a fake pipeline.PipelineAPI. It records every call
+// and its input, and returns the error registered in errs for the method
+// name, or in postErrs for the repo of a post, after the errors queued in
+// postErrSeq for the first posts. Calling a method it does not implement
+// panics. It is safe for concurrent use.
+type mockPipelineClient struct {
+	pipeline.PipelineAPI
+
+	mu       sync.Mutex
+	errs     map[string]error
+	postErrs map[string]error
+	calls    []string
+	// errors of the first posts, in order
+	postErrSeq []error
+	// when set, CreateExport waits for it to be closed
+	exportBlock chan struct{}
+	// GetRepo returns neither a repo nor an error
+	nilRepo bool
+	// when set, called with the method name on every call
+	onCall func(method string)
+
+	repoSchema         []pipeline.RepoSchemaEntry
+	posts              [][]byte
+	postInputs         []*pipeline.PostDataFromBytesInput
+	createRepoInputs   []*pipeline.CreateRepoInput
+	updateRepoInputs   []*pipeline.UpdateRepoInput
+	createExportInputs []*pipeline.CreateExportInput
+	updateExportInputs []*pipeline.UpdateExportInput
+}
+
+func newMockPipelineClient() *mockPipelineClient {
+	return &mockPipelineClient{
+		errs:     make(map[string]error),
+		postErrs: make(map[string]error),
+	}
+}
+
+func (m *mockPipelineClient) call(method string) error {
+	if m.onCall != nil {
+		m.onCall(method)
+	}
+	m.calls = append(m.calls, method)
+	return m.errs[method]
+}
+
+// count returns how many times method was called.
+func (m *mockPipelineClient) count(method string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return countCalls(m.calls, method)
+}
+
+func (m *mockPipelineClient) PostDataFromBytes(input *pipeline.PostDataFromBytesInput) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.posts = append(m.posts, input.Buffer)
+	m.postInputs = append(m.postInputs, input)
+	if err := m.call("PostDataFromBytes"); err != nil {
+		return err
+	}
+	if len(m.postErrSeq) > 0 {
+		err := m.postErrSeq[0]
+		m.postErrSeq = m.postErrSeq[1:]
+		return err
+	}
+	return m.postErrs[input.RepoName]
+}
+
+func (m *mockPipelineClient) GetRepo(input *pipeline.GetRepoInput) (*pipeline.GetRepoOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.call("GetRepo")
+	if err != nil {
+		return nil, err
+	}
+	if m.nilRepo {
+		return nil, nil
+	}
+	return &pipeline.GetRepoOutput{Schema: m.repoSchema}, nil
+}
+
+func (m *mockPipelineClient) CreateRepo(input *pipeline.CreateRepoInput) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createRepoInputs = append(m.createRepoInputs, input)
+	return m.call("CreateRepo")
+}
+
+func (m *mockPipelineClient) UpdateRepo(input *pipeline.UpdateRepoInput) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateRepoInputs = append(m.updateRepoInputs, input)
+	return m.call("UpdateRepo")
+}
+
+func (m *mockPipelineClient) CreateExport(input *pipeline.CreateExportInput) error {
+	if m.exportBlock != nil {
+		<-m.exportBlock
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createExportInputs = append(m.createExportInputs, input)
+	return m.call("CreateExport")
+}
+
+func (m *mockPipelineClient) UpdateExport(input *pipeline.UpdateExportInput) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateExportInputs = append(m.updateExportInputs, input)
+	return m.call("UpdateExport")
+}
+
+// mockTsdbClient is a fake tsdbSdk.TsdbAPI, see mockPipelineClient.
+type mockTsdbClient struct {
+	tsdbSdk.TsdbAPI
+
+	mu    sync.Mutex
+	errs  map[string]error
+	calls []string
+
+	createRepoInputs   []*tsdbSdk.CreateRepoInput
+	createSeriesInputs []*tsdbSdk.CreateSeriesInput
+}
+
+func newMockTsdbClient() *mockTsdbClient {
+	return &mockTsdbClient{errs: make(map[string]error)}
+}
+
+func (m *mockTsdbClient) call(method string) error {
+	m.calls = append(m.calls, method)
+	return m.errs[method]
+}
+
+func (m *mockTsdbClient) count(method string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return countCalls(m.calls, method)
+}
+
+func (m *mockTsdbClient) CreateRepo(input *tsdbSdk.CreateRepoInput) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createRepoInputs = append(m.createRepoInputs, input)
+	return m.call("CreateRepo")
+}
+
+func (m *mockTsdbClient) CreateSeries(input *tsdbSdk.CreateSeriesInput) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createSeriesInputs = append(m.createSeriesInputs, input)
+	return m.call("CreateSeries")
+}
+
+// mockLogdbClient is a fake logdb.LogdbAPI, see mockPipelineClient.
+type mockLogdbClient struct {
+	logdb.LogdbAPI
+
+	mu      sync.Mutex
+	sendErr error
+	inputs  []*logdb.SendLogInput
+}
+
+func (m *mockLogdbClient) SendLog(input *logdb.SendLogInput) (*logdb.SendLogOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputs = append(m.inputs, input)
+	if m.sendErr != nil {
+		return nil, m.sendErr
+	}
+	return &logdb.SendLogOutput{Success: len(input.Logs), Total: len(input.Logs)}, nil
+}
+
+func countCalls(calls []string, method string) int {
+	n := 0
+	for _, c := range calls {
+		if c == method {
+			n++
+		}
+	}
+	return n
+}
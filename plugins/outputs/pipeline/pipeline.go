@@ -1,95 +1,935 @@
 package pipeline
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
-	"net/url"
+	"math"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	tsdb "github.com/influxdata/influxdb/models"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
 	"github.com/influxdata/telegraf/internal"
 	"github.com/influxdata/telegraf/metric"
 	"github.com/influxdata/telegraf/plugins/outputs"
+	"github.com/influxdata/telegraf/plugins/outputs/pandora/client"
 
 	"github.com/qiniu/pandora-go-sdk/pipeline"
 
 	sdkbase "github.com/qiniu/pandora-go-sdk/base"
+	"github.com/qiniu/pandora-go-sdk/logdb"
 	tsdbSdk "github.com/qiniu/pandora-go-sdk/tsdb"
 )
 
 type Pipeline struct {
 	// URL is only for backwards compatability
-	URL            string            `toml:"url"`
-	AK             string            `toml:"ak"`
-	SK             string            `toml:"sk"`
-	Repo           string            `toml:"repo"`
-	AutoCreateRepo bool              `toml:"auto_create_repo`
-	Timeout        internal.Duration `toml:"timeout"`
+	URL            string `toml:"url"`
+	TsdbURL        string `toml:"tsdb_url"`
+	AK             string `toml:"ak"`
+	SK             string `toml:"sk"`
+	AKFile         string `toml:"ak_file"`
+	SKFile         string `toml:"sk_file"`
+	Repo           string `toml:"repo"`
+	TsdbRepo       string `toml:"tsdb_repo"`
+	RepoTag        string `toml:"repo_tag"`
+	Region         string `toml:"region"`
+	AutoCreateRepo bool   `toml:"auto_create_repo"`
+	// Create the tsdb repo along the repos auto created, defaults to true
+	AutoCreateTsdbRepo bool `toml:"auto_create_tsdb_repo"`
+	// LogDB endpoint and repo the logdb_measurements are sent to instead
+	LogdbURL          string   `toml:"logdb_url"`
+	LogdbRepo         string   `toml:"logdb_repo"`
+	LogdbMeasurements []string `toml:"logdb_measurements"`
+	// Schema type of the tags of auto created repos: string, long or float
+	DefaultTagType string `toml:"default_tag_type"`
+	// Register boolean fields as strings in the schema of auto created repos
+	BoolAsString bool `toml:"bool_as_string"`
+	// How the schema type of fields is inferred from their values: strict,
+	// numeric_as_float or all_string
+	TypeInference string `toml:"type_inference"`
+	// Keys of the repo schema registered as required
+	RequiredFields []string `toml:"required_fields"`
+	// Schema types of some fields, keyed by field name, used instead of the
+	// type of their values
+	FieldTypes map[string]string `toml:"field_types"`
+	// Check that the repo exists, or create it, when connecting
+	CheckRepoOnConnect bool `toml:"check_repo_on_connect"`
+	// Encoding of data posts: gzip or identity
+	ContentEncoding string `toml:"content_encoding"`
+	// Size of the smallest data post compressed, 0 compresses all of them
+	CompressionThresholdBytes int `toml:"compression_threshold_bytes"`
+	// Precision of the timestamp column: ns, us, ms or s
+	TimestampUnits string `toml:"timestamp_units"`
+	// Name of the timestamp column
+	TimestampKey string `toml:"timestamp_key"`
+	// Replaces the characters Pandora does not allow in schema keys
+	SanitizeReplacement string `toml:"sanitize_replacement"`
+	// Name of the exports to tsdb, a template with {{.Series}} and {{.Repo}}
+	ExportNameTemplate string `toml:"export_name_template"`
+	// Where new exports start reading the repo: oldest or newest
+	ExportWhence string `toml:"export_whence"`
+	// How long the repo schema fetched from Pandora is reused, 0 disables caching
+	SchemaCacheTTL internal.Duration `toml:"schema_cache_ttl"`
+	// Minimum interval between two syncs of the exports to tsdb
+	ExportSyncInterval internal.Duration `toml:"export_sync_interval"`
+	// How long schema updates are on hold after a failed one, doubling with
+	// every failure in a row. 0 retries on every write
+	SchemaRetryInterval internal.Duration `toml:"schema_retry_interval"`
+	// Retention of the tsdb series created for exports, in [1-30]d
+	SeriesRetention string            `toml:"series_retention"`
+	Timeout         internal.Duration `toml:"timeout"`
+	// Retention of the tsdb series of some measurements, overriding
+	// series_retention
+	RetentionOverrides map[string]string `toml:"retention_overrides"`
+	// Repos of some measurements, keyed by measurement name, overriding repo
+	MeasurementRepos map[string]string `toml:"measurement_repos"`
+	// Prefix prepended to measurement names
+	NamePrefix string `toml:"name_prefix"`
+	// Verbosity of the Pandora SDK logger: debug, info, warn or error
+	LogLevel string `toml:"log_level"`
+	// Retries of a write failing with a network error or a 5xx response
+	MaxRetries    int               `toml:"max_retries"`
+	RetryInterval internal.Duration `toml:"retry_interval"`
+	// Send a key made for every batch along its data posts, the same on the
+	// retries of the batch
+	IdempotentWrites bool `toml:"idempotent_writes"`
+	// Timeout of the connection setup, timeout bounds the writes
+	ConnectTimeout internal.Duration `toml:"connect_timeout"`
+	// Idle connections kept open for the next requests, 0 means no limit
+	// overall and Go's default of 2 per host
+	MaxIdleConns        int `toml:"max_idle_conns"`
+	MaxIdleConnsPerHost int `toml:"max_idle_conns_per_host"`
+	// Interval between the pings of the repo checking the connection, 0
+	// disables pinging
+	KeepaliveInterval internal.Duration `toml:"keepalive_interval"`
+	// Upper bound of the wait for the background work when closing, 0 means
+	// no bound
+	ShutdownTimeout internal.Duration `toml:"shutdown_timeout"`
+	// Upper bound of the random delay of the first schema and export changes
+	// after connecting, 0 disables it
+	StartupJitter internal.Duration `toml:"startup_jitter"`
+	// Proxy for requests to Pandora, defaults to the environment's proxy
+	HTTPProxy string `toml:"http_proxy"`
+	// User-Agent header of the requests to Pandora
+	UserAgent string `toml:"user_agent"`
+	// Number of the repos selected by repo_tag written in parallel
+	WriteConcurrency int `toml:"write_concurrency"`
+	// Security token of temporary credentials, or file holding it, read
+	// again whenever it changes
+	SecurityToken     string `toml:"security_token"`
+	SecurityTokenFile string `toml:"security_token_file"`
+	// Headers set on every request to Pandora
+	HTTPHeaders map[string]string `toml:"http_headers"`
+	// Upper bound of the control-plane calls per second, 0 means no limit
+	ControlPlaneRPS float64 `toml:"control_plane_rps"`
+	// Upper bound of the bytes of the data posts in flight, 0 means no limit
+	MaxInflightBytes int64 `toml:"max_inflight_bytes"`
+	// What to do with NaN and infinite float fields: drop, zero or error
+	FloatNaNHandling string `toml:"float_nan_handling"`
+	// What to do with points conflicting with the field types or the schema:
+	// drop, retry_once or error
+	OnFieldConflict string `toml:"on_field_conflict"`
+	// Upper bound of the size of a single post, 0 means no limit
+	MaxRequestBytes int `toml:"max_request_bytes"`
+	// Upper bounds of the metrics serialized at once, larger writes are
+	// split. 0 means no limit
+	MaxBatchMetrics int `toml:"max_batch_metrics"`
+	MaxBatchBytes   int `toml:"max_batch_bytes"`
+	// Post the points of a write oldest first rather than as received
+	SortPoints bool `toml:"sort_points"`
+	// Log the data that would be posted instead of writing anything to Pandora
+	DryRun bool `toml:"dry_run"`
+	// Measurements whose points are logged at debug level
+	DebugMeasurements []string `toml:"debug_measurements"`
+	// Fields whose values are masked in the logs
+	RedactFields []string `toml:"redact_fields"`
+	// Directory keeping the data that could not be written, replayed once
+	// writes succeed again. Empty disables spilling
+	SpillDirectory string `toml:"spill_directory"`
+	// Upper bound of the size of the spilled data of a repo, the oldest data
+	// is dropped past it. 0 means no limit
+	MaxSpillBytes int64 `toml:"max_spill_bytes"`
+	// Tags added to the metrics missing them
+	DefaultTags map[string]string `toml:"default_tags"`
+	// Tags removed from the metrics, before default_tags are added
+	DropTags []string `toml:"drop_tags"`
+	// Upper bound of the distinct values of a tag over tag_values_window,
+	// tags going past it are dropped. 0 means no limit
+	MaxTagValues int `toml:"max_tag_values"`
+	// Window over which the distinct values of a tag are counted
+	TagValuesWindow internal.Duration `toml:"tag_values_window"`
+	// New names of fields, keyed by their current name
+	FieldRename map[string]string `toml:"field_rename"`
+	// Globs of the fields written, all if empty
+	FieldInclude []string `toml:"field_include"`
+	// Globs of the fields not written
+	FieldExclude []string `toml:"field_exclude"`
+	// Drop the points older than the retention of their series
+	DropStalePoints bool `toml:"drop_stale_points"`
+
+	// Path to CA file
+	TLSCA string `toml:"tls_ca"`
+	// Path to host cert file
+	TLSCert string `toml:"tls_cert"`
+	// Path to cert key file
+	TLSKey string `toml:"tls_key"`
+	// Use TLS but skip chain & host verification
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+
+	// credentials resolved from ak/sk or ak_file/sk_file
+	ak, sk string
+	token  *client.Token
 
 	client pipeline.PipelineAPI
 
 	tsdbClient tsdbSdk.TsdbAPI
+
+	logdbClient logdb.LogdbAPI
+	logdbFilter filter.Filter
+	logStats    *client.Stats
+
+	transport http.RoundTripper
+	// deadline of the write in progress, enforced by transport
+	deadline *client.Deadline
+	// idempotency keys of the batches being posted, sent by transport; kept
+	// across reconnects for the posts still in progress
+	idempotency *client.IdempotencyKeys
+
+	// clients of the exporter and the keepalive, see backgroundClients
+	bgClient     pipeline.PipelineAPI
+	bgTsdbClient tsdbSdk.TsdbAPI
+	bgTransport  http.RoundTripper
+
+	exportNameTmpl *template.Template
+
+	schemaCache    []pipeline.RepoSchemaEntry
+	schemaCachedAt time.Time
+
+	exports *exportState
+	// schema updates failed in a row, and when they may be tried again
+	schemaFailures int
+	schemaRetryAt  time.Time
+	// now returns the current time and sleep waits, tests replace them to
+	// control the clock
+	now   func() time.Time
+	sleep func(time.Duration)
+	// the schema and export changes wait until then, see startup_jitter
+	changesAfter time.Time
+
+	keepalive *keepalive
+	exporter  *exporter
+	// newClientsFunc replaces the building of the clients in tests
+	newClientsFunc func() error
+
+	// writers of the repos selected by repo_tag, keyed by repo name
+	repoWriters map[string]*Pipeline
+
+	stats *client.Stats
+	// limits the control-plane calls, shared by the writers of all repos
+	limiter *client.Limiter
+	// bounds the bytes of the data posts in flight, shared by the writers of
+	// all repos
+	inflight *client.Inflight
+	// drops the tags with too many values, shared by the writers of all repos
+	cardinality *client.CardinalityGuard
+	fieldFilter *client.FieldFilter
+	redactRe    *regexp.Regexp
+
+	spill *client.Spill
 }
 
 var sampleConfig = `
  # Configuration for Pandora Pipeline server to send metrics to
   [[outputs.pipeline]]
   url = "https://pipeline.qiniu.com" # required
+  ## The Pandora TSDB endpoint that exports write to.
+  ## If not provided, will default to "https://tsdb.qiniu.com".
+  # tsdb_url = "https://tsdb.qiniu.com"
   ## The target repo for metrics (telegraf will create it if not exists).
   repo = "monitor" # required
+  ## The Pandora TSDB repo that exports write to, defaults to repo.
+  # tsdb_repo = "monitor_tsdb"
+  ## The Pandora region that auto created repos live in.
+  # region = "nb"
   ## 是否自动创建repo以及自动根据数据源中新增字段更新repo schema
   auto_create_repo = false
+  ## Create the tsdb repo along the repos auto created, disable it when the
+  ## tsdb repo is provisioned otherwise.
+  # auto_create_tsdb_repo = true
+  ## Schema type registered for tags when auto_create_repo updates the repo
+  ## schema, can be: "string", "long", "float".
+  # default_tag_type = "string"
+  ## Register boolean fields as strings rather than booleans when
+  ## auto_create_repo updates the repo schema, for repos created that way.
+  # bool_as_string = false
+  ## How the schema type of fields is inferred from their values when
+  ## auto_create_repo updates the repo schema: "strict" maps integers to
+  ## long and floats to float, "numeric_as_float" maps all numbers to float
+  ## and "all_string" registers every field as a string.
+  # type_inference = "strict"
+  ## Keys of the repo schema registered as required when auto_create_repo
+  ## adds them, named measurement_field as written. Pandora then rejects
+  ## the records missing them, including those of other measurements.
+  # required_fields = ["cpu_usage_idle"]
+  ## Check that the repo exists when connecting, creating it right away when
+  ## auto_create_repo is set, instead of on the first failing write.
+  # check_repo_on_connect = true
+  ## How long the repo schema fetched from Pandora is reused before it is
+  ## fetched again when new fields show up. 0s disables caching.
+  # schema_cache_ttl = "5m"
+  ## 自动创建的tsdb series的retention，支持的retention为[1-30]d
+  # series_retention = "7d"
+  ## Name of the export created for every series, {{.Series}} and {{.Repo}}
+  ## are replaced by the series and the repo names.
+  # export_name_template = "export_{{.Series}}_toTSDB"
+  ## Where new exports start reading the repo: "oldest" exports the data
+  ## already in the repo too, "newest" only the data written afterwards.
+  # export_whence = "oldest"
+  ## Minimum interval between two syncs of the exports of new series and
+  ## fields to tsdb.
+  # export_sync_interval = "60s"
+  ## How long schema updates are on hold after a failed one, the write error
+  ## is returned instead. The interval doubles with every failure in a row, up
+  ## to 1h. 0s retries on every write.
+  # schema_retry_interval = "30s"
   ## Write timeout (for the Pandora client), formatted as a string.
   ## If not provided, will default to 5s. 0s means no timeout (not recommended).
   timeout = "5s"
+  ## Timeout of the connection setup, formatted as a string. 0s means no
+  ## timeout.
+  # connect_timeout = "5s"
+  ## Idle connections kept open for the next requests. The endpoint being a
+  ## single host, both bound the same connections.
+  # max_idle_conns = 100
+  # max_idle_conns_per_host = 100
+  ## Interval between pings of the repo between writes, the clients are
+  ## rebuilt after 3 failed pings in a row, e.g. once a NAT dropped the
+  ## connections. Disabled by default.
+  # keepalive_interval = "1m"
+  ## How long closing waits for the exports still queued and the ping in
+  ## progress. 0s waits for them however long they take.
+  # shutdown_timeout = "10s"
+  ## Upper bound of the random delay of the first schema and export changes
+  ## after connecting, so that agents started together against a new repo
+  ## do not all create it at once. 0s disables the delay.
+  # startup_jitter = "5s"
+  ## Prefix prepended to measurement names, and so to the series and schema
+  ## keys they map to.
+  # name_prefix = "prod_"
+  ## Compress data posts, can be: "gzip", "identity".
+  # content_encoding = "identity"
+  ## Size of the smallest data post compressed with content_encoding,
+  ## smaller posts are sent as is. 0 compresses all of them.
+  # compression_threshold_bytes = 0
+  ## Precision of the written timestamps, can be: "ns", "us", "ms", "s".
+  # timestamp_units = "ns"
+  ## Name of the timestamp column in the repo and the exports.
+  # timestamp_key = "timestamp"
+  ## Replaces the characters of tag and field names that Pandora does not
+  ## allow in schema keys, anything but letters, digits and underscores.
+  # sanitize_replacement = "_"
+  ## Verbosity of the Pandora client logger, can be: "debug", "info", "warn", "error".
+  # log_level = "info"
+  ## Number of times a write failing with a network error or a 5xx response is
+  ## retried, with exponential backoff starting at retry_interval.
+  # max_retries = 0
+  # retry_interval = "1s"
+  ## Send a key made for every batch in the Idempotency-Key header of its
+  ## posts, so that Pandora can drop a retried post whose first response
+  ## was lost.
+  # idempotent_writes = false
+  ## HTTP proxy for requests to Pandora. If not provided, the HTTP_PROXY and
+  ## HTTPS_PROXY environment variables are used.
+  # http_proxy = "http://proxy.example.com:3128"
+  ## User-Agent header of the requests to Pandora.
+  # user_agent = "telegraf-pandora"
+  ## Upper bound of the repo, series and export creations and updates sent to Pandora
+  ## per second, data posts are not limited. 0 means no limit.
+  # control_plane_rps = 5.0
+  ## Upper bound of the bytes of the data posts in flight, writes wait for
+  ## the running posts past it. 0 means no limit.
+  # max_inflight_bytes = 0
+  ## What to do with NaN and infinite float fields, which Pandora rejects:
+  ## "drop" omits the field, "zero" writes 0 instead, "error" fails the write.
+  # float_nan_handling = "drop"
+  ## What to do with points not matching the repo schema: "drop" drops them,
+  ## "retry_once" posts them again once after updating the schema when
+  ## auto_create_repo is set, "error" fails the write to retry it later.
+  # on_field_conflict = "drop"
+  ## Tag whose value selects the repo a metric is written to, metrics without
+  ## it go to repo. The tag itself is not written.
+  # repo_tag = "tenant"
+  ## Measurements sent as logs to a Pandora LogDB repo instead of the repo,
+  ## as glob patterns. The LogDB repo must exist.
+  # logdb_url = "https://logdb.qiniu.com"
+  # logdb_repo = "monitor_logs"
+  # logdb_measurements = ["syslog", "audit_*"]
+  ## Number of the repos selected by repo_tag written in parallel, the
+  ## points of a repo are still written in order.
+  # write_concurrency = 4
+  ## Upper bound of the size of a single post, larger writes are split at
+  ## record boundaries. 0 means no limit.
+  # max_request_bytes = 0
+  ## Upper bounds of the number and line protocol size of the metrics
+  ## serialized at once, larger writes are split into batches written one
+  ## after the other. A metric larger than max_batch_bytes is dropped. 0
+  ## means no limit.
+  # max_batch_metrics = 0
+  # max_batch_bytes = 33554432
+  ## Post the points of every write in timestamp order, oldest first, rather
+  ## than in the order they are received. Points at the same time keep it.
+  # sort_points = false
+  ## Log the data that would be posted, at debug level, instead of writing
+  ## it or changing repos and exports.
+  # dry_run = false
+  ## Measurements whose points are logged at debug level before they are
+  ## written, name_prefix included.
+  # debug_measurements = ["nginx"]
+  ## Fields whose values are masked in the logs, the points of
+  ## debug_measurements and dry_run included. They are written as is.
+  # redact_fields = ["password"]
+  ## Directory keeping the data that could not be written once retries are
+  ## exhausted, replayed oldest first on the next successful write. Every
+  ## repo is spilled to its own subdirectory, holding at most max_spill_bytes.
+  # spill_directory = "/var/lib/telegraf/pipeline"
+  # max_spill_bytes = 104857600
+  ## Tags removed from every metric, e.g. to keep high cardinality tags out
+  ## of Pandora.
+  # drop_tags = ["pid"]
+  ## Tags taking more than max_tag_values distinct values over
+  ## tag_values_window are dropped until they fall back under it.
+  # max_tag_values = 1000
+  # tag_values_window = "1h"
+  ## Globs of the fields written, after field_rename, fields matching
+  ## field_exclude are not. Metrics left without fields are not written.
+  # field_include = ["usage_*"]
+  # field_exclude = ["usage_guest*"]
+  ## Drop the points older than the retention of their series (see
+  ## series_retention), which Pandora rejects along their whole batch.
+  # drop_stale_points = false
   ak = "ACCESS_KEY"
   sk = "SECRET_KEY"
+  ## The keys can also reference environment variables, as in "$PANDORA_AK",
+  ## or be read from files instead.
+  # ak_file = "/etc/telegraf/pandora_ak"
+  # sk_file = "/etc/telegraf/pandora_sk"
+  ## Security token of temporary credentials, sent along ak and sk. When
+  ## read from a file, the file is read again whenever it changes, so that a
+  ## renewed token is used right away.
+  # security_token = "$PANDORA_SECURITY_TOKEN"
+  # security_token_file = "/etc/telegraf/pandora_token"
+
+  ## Optional TLS Config
+  # tls_ca = "/etc/telegraf/ca.pem"
+  # tls_cert = "/etc/telegraf/cert.pem"
+  # tls_key = "/etc/telegraf/key.pem"
+  ## Use TLS but skip chain & host verification
+  # insecure_skip_verify = false
+
+  ## Tags added to every metric, the tags of the metric take precedence.
+  # [outputs.pipeline.default_tags]
+  #   dc = "nb"
+
+  ## Fields renamed before writing, e.g. to make them valid Pandora keys.
+  # [outputs.pipeline.field_rename]
+  #   "load.1" = "load1"
+
+  ## Retention of the series of some measurements, overriding series_retention.
+  # [outputs.pipeline.retention_overrides]
+  #   cpu = "30d"
+
+  ## Repos of some measurements, the others go to repo. repo_tag takes
+  ## precedence.
+  # [outputs.pipeline.measurement_repos]
+  #   syslog = "logs"
+
+  ## Headers set on every request to Pandora, e.g. for the gateways in front
+  ## of it. Authorization, User-Agent and X-Qiniu- headers cannot be set.
+  # [outputs.pipeline.http_headers]
+  #   X-Tenant-Id = "tenant"
+
+  ## Schema types of some fields when auto_create_repo updates the repo
+  ## schema, e.g. for fields holding ints or floats from one point to another.
+  ## Can be: "long", "float", "string", "boolean".
+  # [outputs.pipeline.field_types]
+  #   usage = "float"
 `
 
+const (
+	defaultTsdbURL            = "https://tsdb.qiniu.com"
+	defaultSeriesRetention    = "7d"
+	defaultExportNameTemplate = "export_{{.Series}}_toTSDB"
+)
+
+// timestampDivisors converts nanosecond timestamps to the timestamp_units.
+var timestampDivisors = map[string]int64{
+	"ns": 1,
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+}
+
+// tsdbEndpoint returns the endpoint the tsdb client is built against.
+func (i *Pipeline) tsdbEndpoint() string {
+	if i.TsdbURL == "" {
+		return defaultTsdbURL
+	}
+	return i.TsdbURL
+}
+
+// seriesRetention returns the retention of the tsdb series created for
+// the measurement.
+func (i *Pipeline) seriesRetention(seriesName string) string {
+	if retention, ok := i.RetentionOverrides[seriesName]; ok {
+		return retention
+	}
+	return i.SeriesRetention
+}
+
+// tsdbRepo returns the tsdb repo the exports write to.
+func (i *Pipeline) tsdbRepo() string {
+	if i.TsdbRepo == "" {
+		return i.Repo
+	}
+	return i.TsdbRepo
+}
+
+// Init validates the configuration, so that a misconfigured output fails at
+// startup rather than on its first write.
+func (i *Pipeline) Init() error {
+	i.URL = strings.TrimRight(strings.TrimSpace(i.URL), "/")
+	if i.URL == "" {
+		return fmt.Errorf("config.URL is required")
+	}
+	if err := client.CheckURL("URL", i.URL); err != nil {
+		return err
+	}
+	if i.Repo == "" {
+		return fmt.Errorf("config.Repo is required")
+	}
+	ak, err := client.ResolveCredential("AK", i.AK, i.AKFile)
+	if err != nil {
+		return err
+	}
+	if ak == "" {
+		return fmt.Errorf("config.AK is required")
+	}
+	sk, err := client.ResolveCredential("SK", i.SK, i.SKFile)
+	if err != nil {
+		return err
+	}
+	if sk == "" {
+		return fmt.Errorf("config.SK is required")
+	}
+	i.ak, i.sk = ak, sk
+	token, err := client.NewToken("SecurityToken", i.SecurityToken, i.SecurityTokenFile)
+	if err != nil {
+		return err
+	}
+	i.token = token
+	if i.Timeout.Duration < 0 {
+		return fmt.Errorf("config.Timeout must not be negative, got %s", i.Timeout.Duration)
+	}
+	if i.ConnectTimeout.Duration < 0 {
+		return fmt.Errorf("config.ConnectTimeout must not be negative, got %s", i.ConnectTimeout.Duration)
+	}
+	if i.MaxBatchMetrics < 0 {
+		return fmt.Errorf("config.MaxBatchMetrics must not be negative, got %d", i.MaxBatchMetrics)
+	}
+	if i.MaxBatchBytes < 0 {
+		return fmt.Errorf("config.MaxBatchBytes must not be negative, got %d", i.MaxBatchBytes)
+	}
+	if i.MaxIdleConns < 0 {
+		return fmt.Errorf("config.MaxIdleConns must not be negative, got %d", i.MaxIdleConns)
+	}
+	if i.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("config.MaxIdleConnsPerHost must not be negative, got %d", i.MaxIdleConnsPerHost)
+	}
+	if i.CompressionThresholdBytes < 0 {
+		return fmt.Errorf("config.CompressionThresholdBytes must not be negative, got %d", i.CompressionThresholdBytes)
+	}
+	if i.StartupJitter.Duration < 0 {
+		return fmt.Errorf("config.StartupJitter must not be negative, got %s", i.StartupJitter.Duration)
+	}
+	if i.ShutdownTimeout.Duration < 0 {
+		return fmt.Errorf("config.ShutdownTimeout must not be negative, got %s", i.ShutdownTimeout.Duration)
+	}
+	if i.KeepaliveInterval.Duration < 0 {
+		return fmt.Errorf("config.KeepaliveInterval must not be negative, got %s", i.KeepaliveInterval.Duration)
+	}
+	for measurement, repo := range i.MeasurementRepos {
+		if repo == "" {
+			return fmt.Errorf("config.MeasurementRepos must not map %s to an empty repo", measurement)
+		}
+	}
+	if i.WriteConcurrency < 0 {
+		return fmt.Errorf("config.WriteConcurrency must not be negative, got %d", i.WriteConcurrency)
+	}
+	if i.ControlPlaneRPS < 0 {
+		return fmt.Errorf("config.ControlPlaneRPS must not be negative, got %v", i.ControlPlaneRPS)
+	}
+	i.logdbFilter = nil
+	if i.LogdbRepo != "" {
+		if len(i.LogdbMeasurements) == 0 {
+			return fmt.Errorf("config.LogdbMeasurements must be set along config.LogdbRepo")
+		}
+		f, err := filter.Compile(i.LogdbMeasurements)
+		if err != nil {
+			return fmt.Errorf("error compiling config.LogdbMeasurements: %s", err)
+		}
+		i.logdbFilter = f
+	}
+	if i.MaxInflightBytes < 0 {
+		return fmt.Errorf("config.MaxInflightBytes must not be negative, got %d", i.MaxInflightBytes)
+	}
+	i.inflight = client.NewInflight(i.MaxInflightBytes)
+	if i.MaxTagValues < 0 {
+		return fmt.Errorf("config.MaxTagValues must not be negative, got %d", i.MaxTagValues)
+	}
+	if i.MaxTagValues > 0 && i.TagValuesWindow.Duration <= 0 {
+		return fmt.Errorf("config.TagValuesWindow must be positive, got %s", i.TagValuesWindow.Duration)
+	}
+	i.cardinality = client.NewCardinalityGuard(i.MaxTagValues, i.TagValuesWindow.Duration)
+	f, err := client.NewFieldFilter(i.FieldInclude, i.FieldExclude)
+	if err != nil {
+		return err
+	}
+	i.fieldFilter = f
+	redactRe, err := compileRedactFields(i.RedactFields)
+	if err != nil {
+		return err
+	}
+	i.redactRe = redactRe
+	if i.MaxSpillBytes < 0 {
+		return fmt.Errorf("config.MaxSpillBytes must not be negative, got %d", i.MaxSpillBytes)
+	}
+	if !validKeyPart(i.SanitizeReplacement) {
+		return fmt.Errorf("invalid sanitize_replacement %q, must only hold letters, digits and underscores", i.SanitizeReplacement)
+	}
+	if i.SchemaRetryInterval.Duration < 0 {
+		return fmt.Errorf("config.SchemaRetryInterval must not be negative, got %s", i.SchemaRetryInterval.Duration)
+	}
+	if i.FloatNaNHandling == "" {
+		i.FloatNaNHandling = "drop"
+	}
+	if err := client.CheckNonFiniteMode(i.FloatNaNHandling); err != nil {
+		return err
+	}
+	if i.OnFieldConflict == "" {
+		i.OnFieldConflict = "drop"
+	}
+	if err := client.CheckFieldConflictMode(i.OnFieldConflict); err != nil {
+		return err
+	}
+	if err := client.CheckURL("TsdbURL", i.tsdbEndpoint()); err != nil {
+		return err
+	}
+	if i.SeriesRetention == "" {
+		i.SeriesRetention = defaultSeriesRetention
+	}
+	if err := client.CheckRetention(i.SeriesRetention); err != nil {
+		return err
+	}
+	if err := client.CheckRetentionOverrides(i.RetentionOverrides); err != nil {
+		return err
+	}
+	if err := client.CheckHeaders(i.HTTPHeaders); err != nil {
+		return err
+	}
+	if i.ExportNameTemplate == "" {
+		i.ExportNameTemplate = defaultExportNameTemplate
+	}
+	tmpl, err := template.New("export_name").Parse(i.ExportNameTemplate)
+	if err != nil {
+		return fmt.Errorf("error parsing config.ExportNameTemplate: %s", err)
+	}
+	i.exportNameTmpl = tmpl
+	if i.ExportWhence == "" {
+		i.ExportWhence = "oldest"
+	}
+	switch i.ExportWhence {
+	case "oldest", "newest":
+	default:
+		return fmt.Errorf("invalid export_whence %q, must be one of oldest, newest", i.ExportWhence)
+	}
+	if i.TimestampUnits == "" {
+		i.TimestampUnits = "ns"
+	}
+	if _, ok := timestampDivisors[i.TimestampUnits]; !ok {
+		return fmt.Errorf("invalid timestamp_units %q, must be one of ns, us, ms, s", i.TimestampUnits)
+	}
+	if i.TimestampKey == "" {
+		i.TimestampKey = "timestamp"
+	}
+	if i.DefaultTagType == "" {
+		i.DefaultTagType = "string"
+	}
+	switch i.DefaultTagType {
+	case "string", "long", "float":
+	default:
+		return fmt.Errorf("invalid default_tag_type %q, must be one of string, long, float", i.DefaultTagType)
+	}
+	if i.TypeInference == "" {
+		i.TypeInference = "strict"
+	}
+	if _, ok := typeInferences[i.TypeInference]; !ok {
+		return fmt.Errorf("invalid type_inference %q, must be one of strict, numeric_as_float, all_string", i.TypeInference)
+	}
+	for _, key := range i.RequiredFields {
+		if key == "" {
+			return fmt.Errorf("config.RequiredFields must not hold empty keys")
+		}
+	}
+	for field, typ := range i.FieldTypes {
+		switch typ {
+		case "long", "float", "string", "boolean":
+		default:
+			return fmt.Errorf("invalid field_types type %q of field %s, must be one of long, float, string, boolean", typ, field)
+		}
+	}
+	return nil
+}
+
 func (i *Pipeline) Connect() error {
-	u, err := url.Parse(i.URL)
+	if err := i.stopWorkers(); err != nil {
+		return err
+	}
+	// the repo checked by connect may be created already
+	i.changesAfter = time.Time{}
+	if jitter := i.StartupJitter.Duration; jitter > 0 {
+		i.changesAfter = i.timeNow().Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	if err := i.connect(); err != nil {
+		return err
+	}
+	i.startKeepalive()
+	i.startExporter()
+	return nil
+}
+
+// connect builds the clients and resets the state of the writes.
+func (i *Pipeline) connect() error {
+	if err := i.Init(); err != nil {
+		return err
+	}
+	if err := i.newClients(); err != nil {
+		return err
+	}
+	i.limiter = client.NewLimiter(i.ControlPlaneRPS)
+	i.repoWriters = nil
+	i.exports = &exportState{}
+	i.schemaFailures = 0
+	i.schemaRetryAt = time.Time{}
+
+	if i.CheckRepoOnConnect {
+		return i.checkRepo()
+	}
+	return nil
+}
+
+// newClients builds the transports and the SDK clients, releasing the
+// transports built before. The clients of the writes are bound by the
+// deadline of the write in progress, those of the background work, see
+// backgroundClients, by timeout on every request.
+func (i *Pipeline) newClients() error {
+	if i.newClientsFunc != nil {
+		return i.newClientsFunc()
+	}
+	level, err := client.ParseLogLevel(i.LogLevel)
+	if err != nil {
+		return err
+	}
+	logLevel := sdkLogLevels[level]
+	tlsConfig, err := internal.GetTLSConfig(
+		i.TLSCert, i.TLSKey, i.TLSCA, i.InsecureSkipVerify)
 	if err != nil {
-		return fmt.Errorf("error parsing config.URL: %s", err)
+		return err
+	}
+	i.releaseTransports()
+	// the outputs set up alike share their connections
+	poolKey := client.PoolKey(i.HTTPProxy, i.TLSCA, i.TLSCert, i.TLSKey,
+		i.InsecureSkipVerify, i.ConnectTimeout.Duration, i.MaxIdleConns, i.MaxIdleConnsPerHost)
+	deadline := &client.Deadline{}
+	if i.IdempotentWrites && i.idempotency == nil {
+		i.idempotency = &client.IdempotencyKeys{}
+	}
+	httpConfig := client.HTTPConfig{
+		ContentEncoding:      i.ContentEncoding,
+		CompressionThreshold: i.CompressionThresholdBytes,
+		HTTPProxy:            i.HTTPProxy,
+		TLSConfig:            tlsConfig,
+		Deadline:             deadline,
+		DialTimeout:          i.ConnectTimeout.Duration,
+		MaxIdleConns:         i.MaxIdleConns,
+		MaxIdleConnsPerHost:  i.MaxIdleConnsPerHost,
+		PoolKey:              poolKey,
+		UserAgent:            i.UserAgent,
+		Headers:              i.HTTPHeaders,
+		SecurityToken:        i.token,
+		IdempotencyKeys:      i.idempotency,
 	}
-	if u.Scheme != "http" && u.Scheme != "https" {
-		return fmt.Errorf("config.URL scheme must be http(s), got %s", u.Scheme)
+	transport, err := client.NewTransport(httpConfig)
+	if err != nil {
+		return err
 	}
-	cfg := pipeline.NewConfig().
-		WithAccessKeySecretKey(i.AK, i.SK).
-		WithEndpoint(i.URL).
-		WithLogger(sdkbase.NewDefaultLogger()).
-		WithLoggerLevel(sdkbase.LogDebug).
-		WithResponseTimeout(i.Timeout.Duration)
+	i.transport = transport
+	i.deadline = deadline
 
-	// 生成client实例
-	client, err := pipeline.New(cfg)
+	httpConfig.Deadline = nil
+	httpConfig.RequestTimeout = i.Timeout.Duration
+	bgTransport, err := client.NewTransport(httpConfig)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	i.client = client
+	i.bgTransport = bgTransport
 
-	//生成tsdb client实例
-	tsdbCfg := pipeline.NewConfig().
-		WithAccessKeySecretKey(i.AK, i.SK).
-		WithEndpoint("https://tsdb.qiniu.com").
-		WithLogger(sdkbase.NewDefaultLogger()).
-		WithLoggerLevel(sdkbase.LogDebug).
-		WithResponseTimeout(i.Timeout.Duration)
+	sdkClients := func(transport http.RoundTripper) (pipeline.PipelineAPI, tsdbSdk.TsdbAPI, error) {
+		cfg := pipeline.NewConfig().
+			WithAccessKeySecretKey(i.ak, i.sk).
+			WithEndpoint(i.URL).
+			WithLogger(sdkbase.NewDefaultLogger()).
+			WithLoggerLevel(logLevel).
+			WithResponseTimeout(i.Timeout.Duration).
+			WithTransport(transport)
 
-	tsdbClient, err := tsdbSdk.New(tsdbCfg)
-	if err != nil {
-		log.Println(err)
+		// 生成client实例
+		c, err := pipeline.New(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		//生成tsdb client实例
+		tsdbCfg := pipeline.NewConfig().
+			WithAccessKeySecretKey(i.ak, i.sk).
+			WithEndpoint(i.tsdbEndpoint()).
+			WithLogger(sdkbase.NewDefaultLogger()).
+			WithLoggerLevel(logLevel).
+			WithResponseTimeout(i.Timeout.Duration).
+			WithTransport(transport)
+
+		tsdbClient, err := tsdbSdk.New(tsdbCfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, tsdbClient, nil
+	}
+	if i.client, i.tsdbClient, err = sdkClients(transport); err != nil {
+		return err
+	}
+	if i.bgClient, i.bgTsdbClient, err = sdkClients(bgTransport); err != nil {
 		return err
 	}
-	i.tsdbClient = tsdbClient
 
+	if i.LogdbRepo != "" {
+		logdbCfg := pipeline.NewConfig().
+			WithAccessKeySecretKey(i.ak, i.sk).
+			WithEndpoint(i.logdbEndpoint()).
+			WithLogger(sdkbase.NewDefaultLogger()).
+			WithLoggerLevel(logLevel).
+			WithResponseTimeout(i.Timeout.Duration).
+			WithTransport(transport)
+
+		logdbClient, err := logdb.New(logdbCfg)
+		if err != nil {
+			return err
+		}
+		i.logdbClient = logdbClient
+	}
 	return nil
 }
 
+// releaseTransports releases the transports of the clients, if any.
+func (i *Pipeline) releaseTransports() {
+	if i.transport != nil {
+		client.ReleaseTransport(i.transport)
+		i.transport = nil
+	}
+	if i.bgTransport != nil {
+		client.ReleaseTransport(i.bgTransport)
+		i.bgTransport = nil
+	}
+}
+
+// checkRepo makes sure that the repo exists, creating it when
+// auto_create_repo is set, so that a missing repo fails at startup rather
+// than on the first write.
+func (i *Pipeline) checkRepo() error {
+	_, err := i.repoSchema()
+	if err == nil {
+		return nil
+	}
+	if !client.IsRepoNotFound(err) {
+		return fmt.Errorf("check repo %s fail: %s", i.Repo, err)
+	}
+	if !i.AutoCreateRepo {
+		return fmt.Errorf("repo %s does not exist, create it or set auto_create_repo", i.Repo)
+	}
+	log.Printf("I! start to create pipeline repo %s", i.Repo)
+	if err := i.updateSchema(nil); err != nil {
+		return fmt.Errorf("create pipeline repo %s fail: %s", i.Repo, err)
+	}
+	return nil
+}
+
+// sdkLogLevels maps the log_level option to the Pandora SDK logger levels.
+var sdkLogLevels = map[client.LogLevel]sdkbase.LogLevelType{
+	client.LogDebug: sdkbase.LogDebug,
+	client.LogInfo:  sdkbase.LogInfo,
+	client.LogWarn:  sdkbase.LogWarn,
+	client.LogError: sdkbase.LogError,
+}
+
+// stopWorkers stops the keepalive and the exporter, and waits up to
+// shutdown_timeout for the ping in progress and the exports still queued.
+func (i *Pipeline) stopWorkers() error {
+	abort := make(chan struct{})
+	defer close(abort)
+	var timeout <-chan time.Time
+	if i.ShutdownTimeout.Duration > 0 {
+		timer := time.NewTimer(i.ShutdownTimeout.Duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	wait := func(done <-chan struct{}) error {
+		if done == nil {
+			return nil
+		}
+		select {
+		case <-done:
+			return nil
+		case <-timeout:
+			return fmt.Errorf("background work of repo %s still running after %s", i.Repo, i.ShutdownTimeout.Duration)
+		}
+	}
+	// the keepalive goes first, its reconnect uses the exporter
+	if err := wait(i.stopKeepalive()); err != nil {
+		return err
+	}
+	return wait(i.stopExporter(abort))
+}
+
 func (i *Pipeline) Close() error {
+	if err := i.stopWorkers(); err != nil {
+		// the clients are left to the work still running
+		return err
+	}
+	i.releaseTransports()
+	i.client = nil
+	i.tsdbClient = nil
+	i.bgClient = nil
+	i.bgTsdbClient = nil
+	i.repoWriters = nil
 	return nil
 }
 
@@ -101,200 +941,811 @@ func (i *Pipeline) Description() string {
 	return "Configuration for Pipeline server to send metrics to"
 }
 
-func convertTag(repoName string, tags tsdb.Tags) string {
-	result := ""
+// escaper escapes the characters delimiting pipeline records and values.
+var escaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func convertTag(repoName string, tags tsdb.Tags, replacement string) string {
+	var buf bytes.Buffer
 
 	for _, val := range tags {
-		result += fmt.Sprintf("%s_%s=%s\t", repoName, string(val.Key), string(val.Value))
+		writeKeyValue(&buf, repoName, string(val.Key), string(val.Value), replacement)
 	}
 
-	return result
+	return buf.String()
 }
 
-func convertField(repoName string, fields tsdb.Fields) string {
-	result := ""
+func convertField(repoName string, fields tsdb.Fields, replacement string) string {
+	var buf bytes.Buffer
 
 	for key, val := range fields {
-		result += fmt.Sprintf("%s_%s=%v\t", repoName, key, val)
+		writeKeyValue(&buf, repoName, key, formatValue(val), replacement)
 	}
 
-	return result
+	return buf.String()
 }
 
-// Choose a random server in the cluster to write to until a successful write
-// occurs, logging each unsuccessful. If all servers fail, return error.
+// writeKeyValue appends a "<repoName>_<key>=<value>\t" pair to buf, the
+// key sanitized as schemaKey does.
+func writeKeyValue(buf *bytes.Buffer, repoName, key, value, replacement string) {
+	writeSanitized(buf, repoName, replacement)
+	buf.WriteByte('_')
+	writeSanitized(buf, key, replacement)
+	buf.WriteByte('=')
+	escaper.WriteString(buf, value)
+	buf.WriteByte('\t')
+}
+
+// schemaKey returns the repo schema key of the key of the measurement,
+// "<measurement>_<key>", with the characters Pandora does not allow in
+// schema keys replaced by replacement.
+func schemaKey(measurement, key, replacement string) string {
+	if validKeyPart(measurement) && validKeyPart(key) {
+		return measurement + "_" + key
+	}
+	var buf bytes.Buffer
+	writeSanitized(&buf, measurement, replacement)
+	buf.WriteByte('_')
+	writeSanitized(&buf, key, replacement)
+	return buf.String()
+}
+
+// writeSanitized appends s to buf, its characters not allowed in schema
+// keys replaced by replacement.
+func writeSanitized(buf *bytes.Buffer, s, replacement string) {
+	if validKeyPart(s) {
+		buf.WriteString(s)
+		return
+	}
+	for _, c := range s {
+		if isKeyChar(c) {
+			buf.WriteRune(c)
+		} else {
+			buf.WriteString(replacement)
+		}
+	}
+}
+
+// validKeyPart reports whether s only holds characters allowed in schema
+// keys: letters, digits and underscores.
+func validKeyPart(s string) bool {
+	for _, c := range s {
+		if !isKeyChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isKeyChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// formatValue formats a field value the way fmt's %v verb does, without its
+// allocations for the common field types.
+func formatValue(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		// Cap uints above the maximum long value
+		if v > math.MaxInt64 {
+			v = math.MaxInt64
+		}
+		return strconv.FormatUint(v, 10)
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return strconv.FormatInt(math.MaxInt64, 10)
+		}
+		return strconv.FormatUint(uint64(v), 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (i *Pipeline) timeNow() time.Time {
+	if i.now != nil {
+		return i.now()
+	}
+	return time.Now()
+}
+
+// waitStartupJitter waits until the schema and export changes are allowed,
+// see startup_jitter, pausing deadline, that of the calls to make, if any.
+func (i *Pipeline) waitStartupJitter(deadline *client.Deadline) {
+	d := i.changesAfter.Sub(i.timeNow())
+	if d <= 0 {
+		return
+	}
+	log.Printf("D! delaying the schema changes of repo %s by %s, see startup_jitter", i.Repo, d)
+	// the wait does not count against the timeout of the write in progress
+	if deadline != nil {
+		if t := deadline.Get(); !t.IsZero() {
+			left := t.Sub(i.timeNow())
+			defer func() { deadline.Set(i.timeNow().Add(left)) }()
+		}
+	}
+	if i.sleep != nil {
+		i.sleep(d)
+	} else {
+		time.Sleep(d)
+	}
+}
+
+// convertTimestamp truncates a nanosecond timestamp to the given units.
+func convertTimestamp(ns int64, units string) int64 {
+	if d, ok := timestampDivisors[units]; ok {
+		return ns / d
+	}
+	return ns
+}
+
+// readMetrics drains r into a buffer of the given size. A single Read is
+// allowed to return fewer bytes than requested, so keep reading until the
+// buffer is full or the reader is exhausted.
+func readMetrics(r io.Reader, size int) ([]byte, error) {
+	p := make([]byte, size)
+	n, err := io.ReadFull(r, p)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return p[:n], nil
+}
+
+// Write posts the metrics to their repo, the value of their repo_tag or repo
+// when the tag is not set or missing. Up to write_concurrency repos are
+// written at a time, the errors of all of them are returned. The metrics of
+// the logdb_measurements are sent to the logdb_repo instead.
 func (i *Pipeline) Write(metrics []telegraf.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if k := i.keepalive; k != nil {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+	}
+	if i.deadline != nil && i.Timeout.Duration > 0 {
+		i.deadline.Set(i.timeNow().Add(i.Timeout.Duration))
+		defer i.deadline.Set(time.Time{})
+	}
+
+	metrics, logs := i.splitLogdb(metrics)
+	if len(logs) == 0 {
+		return i.writeRepos(metrics)
+	}
+	var errs client.Errors
+	if err := i.writeLogdb(logs); err != nil {
+		errs = append(errs, err)
+	}
+	if len(metrics) > 0 {
+		if err := i.writeRepos(metrics); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+// writeRepos writes the metrics to their repo, see Write.
+func (i *Pipeline) writeRepos(metrics []telegraf.Metric) error {
+	if i.RepoTag == "" && len(i.MeasurementRepos) == 0 {
+		return i.write(metrics)
+	}
+
+	// the writers are looked up before the repos are written in parallel
+	repos, byRepo := client.RouteMetrics(metrics, i.RepoTag, i.MeasurementRepos, i.Repo)
+	writers := make(map[string]*Pipeline, len(repos))
+	for _, repo := range repos {
+		writers[repo] = i.repoWriter(repo)
+	}
+	return client.ForEach(repos, i.WriteConcurrency, func(repo string) error {
+		return writers[repo].write(byRepo[repo])
+	})
+}
+
+// repoWriter returns the output writing to repo. It shares the clients and
+// the configuration of i, but keeps its own schema and export state.
+func (i *Pipeline) repoWriter(repo string) *Pipeline {
+	if repo == i.Repo {
+		return i
+	}
+	if w, ok := i.repoWriters[repo]; ok {
+		return w
+	}
+	if i.repoWriters == nil {
+		i.repoWriters = make(map[string]*Pipeline)
+	}
+	w := *i
+	w.Repo = repo
+	w.schemaCache = nil
+	w.exports = &exportState{}
+	w.schemaFailures = 0
+	w.schemaRetryAt = time.Time{}
+	w.repoWriters = nil
+	w.stats = nil
+	w.spill = nil
+	i.repoWriters[repo] = &w
+	return &w
+}
+
+// prepare applies name_prefix, float_nan_handling, drop_tags,
+// max_tag_values, default_tags, field_rename and field_include/field_exclude
+// to the metrics, leaving out those without fields and, with
+// drop_stale_points, those older than their retention, which are recorded in
+// stats.
+func (i *Pipeline) prepare(metrics []telegraf.Metric, stats *client.Stats) ([]telegraf.Metric, error) {
+	metrics = client.PrefixMetrics(metrics, i.NamePrefix)
+	if i.DropStalePoints {
+		var stale int
+		metrics, stale = client.DropStale(metrics, i.timeNow(), i.seriesRetention)
+		stats.RecordStale(stale)
+	}
+	before := len(metrics)
+	metrics, err := client.HandleNonFinite(metrics, i.FloatNaNHandling)
+	if err != nil {
+		return nil, err
+	}
+	metrics = client.DropFieldless(metrics)
+	metrics, err = client.DropTags(metrics, i.DropTags)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err = i.cardinality.Filter(metrics)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err = client.AddDefaultTags(metrics, i.DefaultTags)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err = client.RenameFields(metrics, i.FieldRename)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err = i.fieldFilter.Filter(metrics)
+	if err != nil {
+		return nil, err
+	}
+	stats.RecordDropped(before, len(metrics))
+	return metrics, nil
+}
+
+func (i *Pipeline) write(metrics []telegraf.Metric) error {
+	metrics, err := i.prepare(metrics, i.repoStats())
+	if err != nil {
+		return err
+	}
+	batches, oversized := splitBatches(metrics, i.MaxBatchMetrics, i.MaxBatchBytes)
+	for _, m := range oversized {
+		log.Printf("E! dropping a point of %s for repo %s, its %d bytes exceed max_batch_bytes",
+			m.Name(), i.Repo, m.Len())
+	}
+	i.repoStats().PointsDropped.Incr(int64(len(oversized)))
+	// a failing batch fails the write, the batches before it are written
+	// again with the next flush
+	for _, batch := range batches {
+		if err := i.writeBatch(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitBatches splits metrics into batches of at most maxMetrics metrics and
+// maxBytes bytes of line protocol, 0 meaning no limit, in order. The metrics
+// larger than maxBytes on their own are returned apart.
+func splitBatches(metrics []telegraf.Metric, maxMetrics, maxBytes int) (batches [][]telegraf.Metric, oversized []telegraf.Metric) {
+	var batch []telegraf.Metric
+	size := 0
+	for _, m := range metrics {
+		n := m.Len()
+		if maxBytes > 0 && n > maxBytes {
+			oversized = append(oversized, m)
+			continue
+		}
+		if len(batch) > 0 && (maxMetrics > 0 && len(batch) == maxMetrics || maxBytes > 0 && size+n > maxBytes) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, m)
+		size += n
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return
+}
+
+// writeBatch writes a batch of the metrics prepared for the repo.
+func (i *Pipeline) writeBatch(metrics []telegraf.Metric) error {
 	bufsize := 0
 	for _, m := range metrics {
 		bufsize += m.Len()
 	}
-	r := metric.NewReader(metrics)
-	p := make([]byte, bufsize)
-	_, err := r.Read(p)
+	p, err := readMetrics(metric.NewReader(metrics), bufsize)
 	if err != nil {
 		return err
 	}
 	pts, err := tsdb.ParsePoints(p)
 	if err != nil {
-		log.Printf("E! invalid points format", err)
+		err = fmt.Errorf("invalid points format for repo %s: %s", i.Repo, i.redactLine(err.Error()))
+		log.Printf("E! %s", err)
 		return err
 	}
-	// fmt.Println(string(p))
-	// fmt.Println(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>")
-	points := make(map[int64]tsdb.Points)
+	if i.SortPoints {
+		sort.Stable(tsdb.Points(pts))
+	}
 	for _, pt := range pts {
-		// fmt.Println(pt.String())
-		timestamp := pt.UnixNano()
-		if _, ok := points[timestamp]; !ok {
-			points[timestamp] = make(tsdb.Points, 0)
+		if i.debugMeasurement(string(pt.Name())) {
+			log.Printf("D! point of repo %s: %s", i.Repo, i.redactLine(pt.String()))
 		}
-		points[timestamp] = append(points[timestamp], pt)
-
 	}
+	buf, records, err := buildPipelineData(pts, i.TimestampKey, i.TimestampUnits, i.SanitizeReplacement)
+	if err != nil {
+		err = fmt.Errorf("invalid points for repo %s: %s", i.Repo, err)
+		log.Printf("E! %s", err)
+		return err
+	}
+	data := string(buf)
 
-	var data string
-	for timestamp, pts := range points {
-		for _, pt := range pts {
-			repoName := string(pt.Name())
-			data += convertTag(repoName, pt.Tags())
-			fields, _ := pt.Fields()
-			data += convertField(repoName, fields)
+	if i.DryRun {
+		logged, err := i.redactData(pts, data)
+		if err != nil {
+			return err
 		}
-		data += fmt.Sprintf("timestamp=%d\n", timestamp)
+		log.Printf("D! dry run, not posting to repo %s:\n%s", i.Repo, logged)
+		return nil
 	}
+	i.repoStats().RecordPayload(len(data), records)
 
 	// This will get set to nil if a successful write occurs
-	// fmt.Println(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>")
-	// fmt.Println(data)
-	if e := i.client.PostDataFromBytes(&pipeline.PostDataFromBytesInput{
-		RepoName: i.Repo,
-		Buffer:   []byte(data),
-	}); e != nil {
+	if sent, e := i.post(data); e != nil {
+		i.repoStats().WriteErrors.Incr(1)
 		log.Printf("E! Pandora Pipeline Output Error: %s", e)
-		if strings.Contains(e.Error(), "E18102") {
+		// every point is one record of data, those of the chunks posted
+		// are left out of the spill
+		if client.IsRetryable(e) && i.spillPoints(pts[strings.Count(data[:sent], "\n"):]) {
+			return nil
+		}
+		if client.IsRepoNotFound(e) {
 			log.Printf("E! repo %s does not exists", i.Repo)
 			// setting err to nil, otherwise we will keep retrying and points
 			// w/ conflicting types will get stuck in the buffer forever.
 			if i.AutoCreateRepo {
-				log.Println("I! start to create pipeline repo")
-				err = i.updateSchema(pts)
+				log.Printf("I! start to create pipeline repo %s", i.Repo)
+				err = i.retrySchemaUpdate(pts, e)
 				if err != nil {
-					fmt.Println(err)
+					log.Printf("E! create pipeline repo %s fail: %s", i.Repo, err)
 				}
 			} else {
 				err = nil
 			}
-		} else if strings.Contains(e.Error(), "E18111") {
-			log.Println("E! schema  does not match")
+		} else if client.IsSchemaMismatch(e) || client.IsFieldTypeConflict(e) {
+			log.Printf("E! schema of repo %s does not match", i.Repo)
+			i.invalidateSchema()
 			if i.AutoCreateRepo {
 				log.Printf("I! schema not match, updating...")
-				err = i.updateSchema(pts)
+				err = i.retrySchemaUpdate(pts, e)
 			}
-		}
-		// Log write failure
-	} else {
-		if time.Now().Unix()%60 < 11 {
-			err = i.updateExport(pts)
-			if err != nil {
-				fmt.Println(err)
+			if err == nil {
+				err = i.onFieldConflict(data[sent:], pts, e)
 			}
+		} else {
+			// the errors still failing after max_retries, and the others,
+			// go back to Telegraf, which writes the points again later
+			err = e
 		}
+	} else {
+		i.written(pts)
 		err = nil
 	}
 
 	return err
 }
 
-func getFieldType(val interface{}) string {
+// onFieldConflict applies on_field_conflict to the data of the points, whose
+// post failed with e as it does not match the schema, once the schema is
+// updated if need be, and returns the error of the write.
+func (i *Pipeline) onFieldConflict(data string, pts tsdb.Points, e error) error {
+	switch i.OnFieldConflict {
+	case "error":
+		log.Printf("E! points of repo %s do not match its schema, keeping them to retry them", i.Repo)
+		return e
+	case "retry_once":
+		log.Printf("W! points of repo %s do not match its schema, posting them again", i.Repo)
+		_, e = i.post(data)
+		if e == nil {
+			i.written(pts)
+			return nil
+		}
+		i.repoStats().WriteErrors.Incr(1)
+		log.Printf("E! Pandora Pipeline Output Error: %s", e)
+	}
+	log.Printf("E! points of repo %s do not match its schema, dropping them", i.Repo)
+	return nil
+}
+
+// written records the points written, replays the spilled points now that
+// the repo takes writes again and queues the sync of the exports of both.
+func (i *Pipeline) written(pts tsdb.Points) {
+	i.repoStats().PointsWritten.Incr(int64(len(pts)))
+	// the exports of the points replayed are synced along the others
+	i.queueExports(append(i.replaySpill(), pts...))
+}
+
+// buildPipelineData builds the data posted to a repo from the points, one
+// record per point holding its tags, fields and timestamp, along with the
+// number of records. Keys are sanitized with replacement and timestamps
+// written in timestampUnits under timestampKey.
+func buildPipelineData(points tsdb.Points, timestampKey, timestampUnits, replacement string) ([]byte, int, error) {
+	var buf bytes.Buffer
+	for _, pt := range points {
+		name := string(pt.Name())
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, 0, err
+		}
+		buf.WriteString(convertTag(name, pt.Tags(), replacement))
+		buf.WriteString(convertField(name, fields, replacement))
+		fmt.Fprintf(&buf, "%s=%d\n", timestampKey, convertTimestamp(pt.UnixNano(), timestampUnits))
+	}
+	return buf.Bytes(), len(points), nil
+}
+
+// post writes data to the repo, split at record boundaries into requests of
+// at most max_request_bytes. It stops at the first request failing, the
+// chunks posted before it are kept and their length is returned.
+func (i *Pipeline) post(data string) (int, error) {
+	stats := i.repoStats()
+	sent := 0
+	for _, chunk := range splitRecords(data, i.MaxRequestBytes) {
+		buf := []byte(chunk)
+		attempts := 0
+		size := i.inflight.Acquire(len(buf))
+		// every chunk is a batch of its own, its retries send its key
+		_, done := i.idempotency.Start(buf)
+		err := client.Retry(i.MaxRetries, i.RetryInterval.Duration, func() error {
+			attempts++
+			return i.client.PostDataFromBytes(&pipeline.PostDataFromBytesInput{
+				RepoName: i.Repo,
+				Buffer:   buf,
+			})
+		})
+		done()
+		i.inflight.Release(size)
+		stats.Retries.Incr(int64(attempts - 1))
+		if err != nil {
+			return sent, err
+		}
+		stats.BytesSent.Incr(int64(len(buf)))
+		sent += len(chunk)
+	}
+	return sent, nil
+}
+
+// retrySchemaUpdate updates the schema of the repo for the points, unless
+// updates are on hold after failing, in which case writeErr, the error of
+// the write that called for the update, is returned as is.
+func (i *Pipeline) retrySchemaUpdate(points tsdb.Points, writeErr error) error {
+	now := i.timeNow()
+	if now.Before(i.schemaRetryAt) {
+		log.Printf("W! schema update of repo %s on hold until %s", i.Repo, i.schemaRetryAt.Format(time.RFC3339))
+		return writeErr
+	}
+	err := i.updateSchema(points)
+	if err != nil {
+		i.schemaFailures++
+		i.schemaRetryAt = now.Add(schemaRetryBackoff(i.SchemaRetryInterval.Duration, i.schemaFailures))
+		return err
+	}
+	i.schemaFailures = 0
+	i.schemaRetryAt = time.Time{}
+	return nil
+}
+
+// maxSchemaRetryBackoff caps how long schema updates are on hold.
+const maxSchemaRetryBackoff = time.Hour
+
+// schemaRetryBackoff returns how long schema updates are on hold after
+// as many updates failed in a row: interval, doubled with every failure.
+func schemaRetryBackoff(interval time.Duration, failures int) time.Duration {
+	backoff := interval
+	for n := 1; n < failures && backoff < maxSchemaRetryBackoff; n++ {
+		backoff *= 2
+	}
+	if backoff > maxSchemaRetryBackoff {
+		backoff = maxSchemaRetryBackoff
+	}
+	return backoff
+}
+
+// repoSpill returns the spill of the repo, nil when spilling is disabled.
+func (i *Pipeline) repoSpill() *client.Spill {
+	if i.SpillDirectory == "" {
+		return nil
+	}
+	if i.spill == nil {
+		i.spill = client.NewSpill(filepath.Join(i.SpillDirectory, i.Repo), i.MaxSpillBytes)
+	}
+	return i.spill
+}
+
+// spillPoints keeps points that could not be posted in the spill directory
+// and reports whether they were kept. They are kept as points, one per
+// line, rather than as the data posted, so that the replay can sync their
+// exports.
+func (i *Pipeline) spillPoints(pts tsdb.Points) bool {
+	spill := i.repoSpill()
+	if spill == nil {
+		return false
+	}
+	var buf bytes.Buffer
+	for _, pt := range pts {
+		buf.WriteString(pt.String())
+		buf.WriteByte('\n')
+	}
+	if err := spill.Append(buf.Bytes()); err != nil {
+		log.Printf("E! spill points of repo %s fail: %s", i.Repo, err)
+		return false
+	}
+	log.Printf("W! spilled %d points of repo %s, they will be replayed on the next successful write", len(pts), i.Repo)
+	return true
+}
+
+// replaySpill posts the points spilled by the previous writes, oldest first,
+// and returns the points posted.
+func (i *Pipeline) replaySpill() tsdb.Points {
+	spill := i.repoSpill()
+	if spill == nil {
+		return nil
+	}
+	var replayed tsdb.Points
+	err := spill.Replay(func(payload []byte) error {
+		pts, err := tsdb.ParsePoints(payload)
+		if err != nil {
+			return fmt.Errorf("invalid spilled points: %s", err)
+		}
+		data, _, err := buildPipelineData(pts, i.TimestampKey, i.TimestampUnits, i.SanitizeReplacement)
+		if err != nil {
+			return fmt.Errorf("invalid spilled points: %s", err)
+		}
+		if _, err := i.post(string(data)); err != nil {
+			return err
+		}
+		replayed = append(replayed, pts...)
+		return nil
+	}, i.repoStats().RecordSpillRejected)
+	if err != nil {
+		log.Printf("E! replay spilled points of repo %s fail: %s", i.Repo, err)
+	}
+	return replayed
+}
+
+// debugMeasurement reports whether the points of the measurement are logged.
+func (i *Pipeline) debugMeasurement(name string) bool {
+	for _, m := range i.DebugMeasurements {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// repoStats returns the counters of the repo, registered on first use.
+func (i *Pipeline) repoStats() *client.Stats {
+	if i.stats == nil {
+		i.stats = client.NewStats("pipeline", i.Repo)
+	}
+	return i.stats
+}
+
+// splitRecords splits newline terminated records into chunks of at most max
+// bytes. A record longer than max makes a chunk on its own, and max <= 0
+// disables splitting.
+func splitRecords(data string, max int) []string {
+	if max <= 0 || len(data) <= max {
+		return []string{data}
+	}
 
+	var chunks []string
+	start, end := 0, 0
+	for end < len(data) {
+		next := len(data)
+		if n := strings.IndexByte(data[end:], '\n'); n >= 0 {
+			next = end + n + 1
+		}
+		if next-start > max && end > start {
+			chunks = append(chunks, data[start:end])
+			start = end
+		}
+		end = next
+	}
+	return append(chunks, data[start:])
+}
+
+// getFieldType returns the schema type of a field value, values of other
+// types are written formatted as strings.
+func getFieldType(val interface{}) string {
 	switch val.(type) {
-	case int, int16, int32, int64:
+	case int, int8, int16, int32, int64:
+		return "long"
+	case uint, uint8, uint16, uint32, uint64:
+		// uints above the maximum long value are capped by formatValue
 		return "long"
 	case float32, float64:
 		return "float"
-	case string:
-		return "string"
 	case bool:
 		return "boolean"
 	default:
 		return "string"
 	}
+}
+
+// typeInferences are the strategies of type_inference, returning the schema
+// type of a field value.
+var typeInferences = map[string]func(interface{}) string{
+	"strict": getFieldType,
+	// ints and floats written to the same field do not conflict
+	"numeric_as_float": func(val interface{}) string {
+		if typ := getFieldType(val); typ != "long" {
+			return typ
+		}
+		return "float"
+	},
+	"all_string": func(interface{}) string {
+		return "string"
+	},
+}
+
+// requiredField reports whether the schema key is one of required_fields.
+func (i *Pipeline) requiredField(key string) bool {
+	for _, required := range i.RequiredFields {
+		if key == required {
+			return true
+		}
+	}
+	return false
+}
 
-	return ""
+// fieldType returns the schema type of a field, the one set in field_types
+// or else the type of its value inferred by type_inference.
+func (i *Pipeline) fieldType(field string, val interface{}) string {
+	if typ, ok := i.FieldTypes[field]; ok {
+		return typ
+	}
+	if _, ok := val.(bool); ok && i.BoolAsString {
+		return "string"
+	}
+	infer, ok := typeInferences[i.TypeInference]
+	if !ok {
+		infer = getFieldType
+	}
+	return infer(val)
 }
 
-func extractSchemaFromPoints(points tsdb.Points) (tags []string, fields map[string]string) {
+func extractSchemaFromPoints(points tsdb.Points, fieldType func(string, interface{}) string, replacement string) (tags []string, fields map[string]string) {
 
 	tags = []string{}
 	fields = make(map[string]string)
 
+	seen := make(map[string]struct{})
 	for _, pt := range points {
 		for _, val := range pt.Tags() {
-			tags = append(tags, string(pt.Name())+"_"+string(val.Key))
+			key := schemaKey(string(pt.Name()), string(val.Key), replacement)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			tags = append(tags, key)
 		}
 		fs, _ := pt.Fields()
 		for key, val := range fs {
-			fields[string(pt.Name())+"_"+string(key)] = getFieldType(val)
+			fields[schemaKey(string(pt.Name()), key, replacement)] = fieldType(key, val)
 		}
 	}
 	return
 }
 
+// exportName renders the export_name_template for the given series.
+func (i *Pipeline) exportName(seriesName string) (string, error) {
+	if i.exportNameTmpl == nil {
+		tmpl, err := template.New("export_name").Parse(defaultExportNameTemplate)
+		if err != nil {
+			return "", err
+		}
+		i.exportNameTmpl = tmpl
+	}
+
+	var buf bytes.Buffer
+	err := i.exportNameTmpl.Execute(&buf, struct {
+		Series string
+		Repo   string
+	}{seriesName, i.Repo})
+	if err != nil {
+		return "", fmt.Errorf("error rendering export name for series %s: %s", seriesName, err)
+	}
+	return buf.String(), nil
+}
+
 //查看指定的export是否存在，如果不存在则创建；
 //如果存在则更新
-func (i *Pipeline) createOrUpdateExport(seriesName string, tags map[string]struct{}, fields map[string]struct{}) (err error) {
+func (i *Pipeline) createOrUpdateExport(c controlClients, seriesName string, tags map[string]struct{}, fields map[string]struct{}) (err error) {
+	i.waitStartupJitter(c.deadline)
 
-	err = i.tsdbClient.CreateSeries(&tsdbSdk.CreateSeriesInput{
-		RepoName:   i.Repo,
+	i.limiter.Wait()
+	err = c.tsdb.CreateSeries(&tsdbSdk.CreateSeriesInput{
+		RepoName:   i.tsdbRepo(),
 		SeriesName: seriesName,
-		Retention:  "7d",
+		Retention:  i.seriesRetention(seriesName),
 	})
-	if err != nil {
-		if !strings.Contains(err.Error(), "E6302") {
-			fmt.Printf("create series %s for repo %s fail %v", seriesName, i.Repo, err)
-			err = nil
-		}
+	if client.IsSeriesExists(err) {
+		log.Printf("D! series %s of repo %s already exists", seriesName, i.tsdbRepo())
+	} else if err != nil {
+		// the export would write to a series missing
+		log.Printf("E! create series %s for repo %s fail: %s", seriesName, i.tsdbRepo(), err)
+		return err
 	}
 
 	exportTagSpec := make(map[string]string)
 	for tag := range tags {
-		exportTagSpec[tag] = fmt.Sprintf("#%s_%s", seriesName, tag)
+		exportTagSpec[tag] = "#" + schemaKey(seriesName, tag, i.SanitizeReplacement)
 	}
 
 	exportFieldSpec := make(map[string]string)
 	for filed := range fields {
-		exportFieldSpec[filed] = fmt.Sprintf("#%s_%s", seriesName, filed)
+		exportFieldSpec[filed] = "#" + schemaKey(seriesName, filed, i.SanitizeReplacement)
 	}
 
-	err = i.client.CreateExport(&pipeline.CreateExportInput{
+	exportName, err := i.exportName(seriesName)
+	if err != nil {
+		return err
+	}
+
+	i.limiter.Wait()
+	err = c.pipeline.CreateExport(&pipeline.CreateExportInput{
 		RepoName:   i.Repo,
-		ExportName: fmt.Sprintf("export_%s_toTSDB", seriesName),
+		ExportName: exportName,
 		Type:       "tsdb",
-		Whence:     "oldest",
+		Whence:     i.ExportWhence,
 		Spec: &pipeline.ExportTsdbSpec{
-			DestRepoName: i.Repo,
+			DestRepoName: i.tsdbRepo(),
 			SeriesName:   seriesName,
-			Timestamp:    "#timestamp",
+			Timestamp:    "#" + i.TimestampKey,
 			Tags:         exportTagSpec,
 			Fields:       exportFieldSpec,
 		},
 	})
 	if err != nil { //出错误了
-		if strings.Contains(err.Error(), "E18301") { //已经存在
+		if client.IsExportExists(err) { //已经存在
 			//start to update
-			err = i.client.UpdateExport(&pipeline.UpdateExportInput{ //开始update
+			i.limiter.Wait()
+			err = c.pipeline.UpdateExport(&pipeline.UpdateExportInput{ //开始update
 				RepoName:   i.Repo,
-				ExportName: fmt.Sprintf("export_%s_toTSDB", seriesName),
+				ExportName: exportName,
 				Spec: &pipeline.ExportTsdbSpec{
-					DestRepoName: i.Repo,
+					DestRepoName: i.tsdbRepo(),
 					SeriesName:   seriesName,
-					Timestamp:    "#timestamp",
+					Timestamp:    "#" + i.TimestampKey,
 					Tags:         exportTagSpec,
 					Fields:       exportFieldSpec,
 				},
 			})
 			if err != nil {
-				fmt.Println(err)
+				log.Printf("E! update export %s fail: %s", exportName, err)
 			}
 		} else { //不是已经存在的错误，报错
 			return err
@@ -304,68 +1755,224 @@ func (i *Pipeline) createOrUpdateExport(seriesName string, tags map[string]struc
 	return
 }
 
-func (i *Pipeline) updateExport(points tsdb.Points) (err error) {
+// updateExport syncs the exports of the measurements of the points right
+// away, see syncExports.
+func (i *Pipeline) updateExport(points tsdb.Points) error {
+	if e := i.exporter; e != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+	}
+	return i.syncExports(i.writeClients(), pointKeys(points))
+}
 
-	measurements := make(map[string]struct {
-		tags   map[string]struct{}
-		fields map[string]struct{}
-	})
+// syncExports creates or updates the exports of the measurements bringing
+// tags or fields not exported yet. The keys exported for every measurement
+// only grow, so the exports keep the keys of earlier points too.
+func (i *Pipeline) syncExports(c controlClients, measurements map[string]*seriesKeys) (err error) {
+	if i.exports.keys == nil {
+		i.exports.keys = make(map[string]*seriesKeys)
+	}
+
+	for seriesName, added := range measurements {
+		keys := newSeriesKeys(i.exports.keys[seriesName])
+		keys.merge(added)
+		if !keys.grown {
+			continue
+		}
+		e := i.createOrUpdateExport(c, seriesName, keys.tags, keys.fields)
+		if e != nil {
+			log.Printf("E! create export for series %s fail: %s", seriesName, e)
+			err = e
+			continue
+		}
+		keys.grown = false
+		i.exports.keys[seriesName] = keys
+	}
+
+	return
+}
 
+// pointKeys returns the tags and fields of the points by measurement.
+func pointKeys(points tsdb.Points) map[string]*seriesKeys {
+	measurements := make(map[string]*seriesKeys)
 	for _, pt := range points {
 		ptName := string(pt.Name())
-		if _, ok := measurements[ptName]; !ok {
-			measurements[ptName] = struct {
-				tags   map[string]struct{}
-				fields map[string]struct{}
-			}{
-				tags:   make(map[string]struct{}),
-				fields: make(map[string]struct{}),
-			}
-			// measurements[ptName].tags = make(map[string]struct{})
-			// measurements[ptName].fields = make(map[string]struct{})
+		keys, ok := measurements[ptName]
+		if !ok {
+			keys = newSeriesKeys(nil)
+			measurements[ptName] = keys
 		}
 		for _, tag := range pt.Tags() {
-			measurements[ptName].tags[string(tag.Key)] = struct{}{}
+			keys.addTag(string(tag.Key))
 		}
 		fields, _ := pt.Fields()
 		for field := range fields {
-			measurements[ptName].fields[field] = struct{}{}
+			keys.addField(field)
 		}
+	}
+	return measurements
+}
+
+// seriesKeys are the tags and fields of a measurement.
+type seriesKeys struct {
+	tags   map[string]struct{}
+	fields map[string]struct{}
+	// whether keys were added since the copy
+	grown bool
+}
 
+// newSeriesKeys returns a copy of keys, which may be nil.
+func newSeriesKeys(keys *seriesKeys) *seriesKeys {
+	c := &seriesKeys{
+		tags:   make(map[string]struct{}),
+		fields: make(map[string]struct{}),
 	}
-	for seriesName, value := range measurements {
-		err = i.createOrUpdateExport(seriesName, value.tags, value.fields)
-		if err != nil {
-			fmt.Println(err)
+	if keys != nil {
+		for tag := range keys.tags {
+			c.tags[tag] = struct{}{}
+		}
+		for field := range keys.fields {
+			c.fields[field] = struct{}{}
 		}
 	}
+	return c
+}
 
-	return
+func (k *seriesKeys) addTag(tag string) {
+	if _, ok := k.tags[tag]; !ok {
+		k.tags[tag] = struct{}{}
+		k.grown = true
+	}
+}
 
+func (k *seriesKeys) addField(field string) {
+	if _, ok := k.fields[field]; !ok {
+		k.fields[field] = struct{}{}
+		k.grown = true
+	}
 }
 
-func (i *Pipeline) updateSchema(points tsdb.Points) error {
-	tags, fields := extractSchemaFromPoints(points)
+// merge adds the tags and fields of o.
+func (k *seriesKeys) merge(o *seriesKeys) {
+	for tag := range o.tags {
+		k.addTag(tag)
+	}
+	for field := range o.fields {
+		k.addField(field)
+	}
+}
+
+// repoSchema returns the schema of the repo, served from the cache while it
+// is younger than schema_cache_ttl.
+func (i *Pipeline) repoSchema() ([]pipeline.RepoSchemaEntry, error) {
+	if i.schemaCache != nil && i.timeNow().Sub(i.schemaCachedAt) < i.SchemaCacheTTL.Duration {
+		return i.schemaCache, nil
+	}
+
+	schema, err := i.CurrentSchema()
+	if err != nil {
+		return nil, err
+	}
+	i.cacheSchema(schema)
+	return schema, nil
+}
 
-	schema, err := i.client.GetRepo(&pipeline.GetRepoInput{
+// Probe checks, with a get of the repo, that the endpoint can be reached and
+// takes the credentials, telling the two failures apart. A missing repo
+// passes. It is meant for startup checks, after Connect.
+func (i *Pipeline) Probe() error {
+	if i.client == nil {
+		return fmt.Errorf("pipeline output for repo %s is not connected", i.Repo)
+	}
+	err := i.ping()
+	switch {
+	case err == nil:
+		return nil
+	case client.IsAuthError(err):
+		return fmt.Errorf("pipeline %s refused the credentials, check ak, sk and security_token: %s", i.URL, err)
+	case client.IsNetworkError(err):
+		return fmt.Errorf("pipeline %s cannot be reached, check url, http_proxy and the network: %s", i.URL, err)
+	}
+	return fmt.Errorf("probe of pipeline repo %s fail: %s", i.Repo, err)
+}
+
+// CurrentSchema fetches the schema of the repo from Pandora, bypassing and
+// leaving alone the schema cache. It helps diagnosing schema mismatches.
+func (i *Pipeline) CurrentSchema() ([]pipeline.RepoSchemaEntry, error) {
+	if i.client == nil {
+		return nil, fmt.Errorf("pipeline output for repo %s is not connected", i.Repo)
+	}
+	repo, err := i.client.GetRepo(&pipeline.GetRepoInput{
 		RepoName: i.Repo,
 	})
+	if err != nil {
+		return nil, err
+	}
+	if repo == nil || repo.Schema == nil {
+		// a repo without keys still has a known schema, which is cached
+		return []pipeline.RepoSchemaEntry{}, nil
+	}
+	return repo.Schema, nil
+}
+
+// controlClients are the clients of the export calls.
+type controlClients struct {
+	pipeline pipeline.PipelineAPI
+	tsdb     tsdbSdk.TsdbAPI
+	// deadline bounding the calls, nil when every call is bound on its own
+	deadline *client.Deadline
+}
+
+// writeClients returns the clients of the calls of the writes, bound by the
+// deadline of the write in progress.
+func (i *Pipeline) writeClients() controlClients {
+	return controlClients{pipeline: i.client, tsdb: i.tsdbClient, deadline: i.deadline}
+}
+
+// backgroundClients returns the clients of the calls of the exporter and the
+// keepalive, bound by timeout on every call rather than by the deadline of
+// the write in progress. They are the clients of the writes, without
+// deadline, when no background clients were built.
+func (i *Pipeline) backgroundClients() controlClients {
+	if i.bgClient == nil || i.bgTsdbClient == nil {
+		return controlClients{pipeline: i.client, tsdb: i.tsdbClient}
+	}
+	return controlClients{pipeline: i.bgClient, tsdb: i.bgTsdbClient}
+}
+
+func (i *Pipeline) cacheSchema(schema []pipeline.RepoSchemaEntry) {
+	i.schemaCache = schema
+	i.schemaCachedAt = i.timeNow()
+}
+
+func (i *Pipeline) invalidateSchema() {
+	i.schemaCache = nil
+}
+
+func (i *Pipeline) updateSchema(points tsdb.Points) error {
+	i.waitStartupJitter(i.deadline)
+	tags, fields := extractSchemaFromPoints(points, i.fieldType, i.SanitizeReplacement)
+
+	existing, err := i.repoSchema()
 	createRepo := false
 	if err != nil {
-		if strings.Contains(err.Error(), "E18102") {
-			createRepo = true
+		if !client.IsRepoNotFound(err) {
+			// the schema is unknown, updating it could drop columns
+			return fmt.Errorf("get pipeline repo %s fail: %s", i.Repo, err)
 		}
+		createRepo = true
+		existing = []pipeline.RepoSchemaEntry{}
 	}
 
 	schemas := make(map[string]string)
-	for _, schema := range schema.Schema {
+	for _, schema := range existing {
 		schemas[schema.Key] = schema.ValueType
 	}
 
 	//根据tags，fields更新schema
 	for _, tag := range tags {
 		if _, ok := schemas[tag]; !ok {
-			schemas[tag] = "string"
+			schemas[tag] = i.DefaultTagType
 		}
 	}
 
@@ -374,58 +1981,74 @@ func (i *Pipeline) updateSchema(points tsdb.Points) error {
 			schemas[field] = valType
 		}
 	}
-	if _, ok := schemas["timestamp"]; !ok {
-		schemas["timestamp"] = "long"
+	if _, ok := schemas[i.TimestampKey]; !ok {
+		schemas[i.TimestampKey] = "long"
 	}
 	//剔除原来的字段
-	for _, schema := range schema.Schema {
+	for _, schema := range existing {
 		delete(schemas, schema.Key)
 	}
 
 	target := make([]pipeline.RepoSchemaEntry, 0)
 	for field, valType := range schemas {
 		target = append(target, pipeline.RepoSchemaEntry{
-			Required:  false,
+			Required:  i.requiredField(field),
 			Key:       field,
 			ValueType: valType,
 		})
 	}
-	//log.Println("E! %v", target[])
+	newSchema := append(existing, target...)
 	if createRepo {
+		i.limiter.Wait()
 		err = i.client.CreateRepo(&pipeline.CreateRepoInput{
 			RepoName: i.Repo,
-			Region:   "nb",
-			Schema:   append(schema.Schema, target...),
+			Region:   i.Region,
+			Schema:   newSchema,
 		})
 		if err != nil {
-			fmt.Printf("create pipeline repo %s fail %v", i.Repo, err)
 			return err
 		}
-		fmt.Printf("create pipeline repo %s success", i.Repo)
+		log.Printf("I! create pipeline repo %s success", i.Repo)
+		i.repoStats().SchemaUpdates.Incr(1)
+		i.cacheSchema(newSchema)
 
-		err = i.tsdbClient.CreateRepo(&tsdbSdk.CreateRepoInput{
-			RepoName: i.Repo,
-			Region:   "nb",
-		})
-		if err != nil {
-			err = fmt.Errorf("create tsdb repo %s fail, %v", i.Repo, err.Error())
+		if i.AutoCreateTsdbRepo {
+			i.limiter.Wait()
+			err = i.tsdbClient.CreateRepo(&tsdbSdk.CreateRepoInput{
+				RepoName: i.tsdbRepo(),
+				Region:   i.Region,
+			})
+			if err != nil {
+				// the exports would write to a repo missing
+				return fmt.Errorf("create tsdb repo %s fail: %s", i.tsdbRepo(), err)
+			}
+			log.Printf("I! create tsdb repo %s success", i.tsdbRepo())
 		}
-		fmt.Printf("create tsdb repo %s success", i.Repo)
 
 		err = i.updateExport(points)
 		if err != nil {
-			fmt.Println(err)
+			log.Printf("E! sync exports of repo %s fail: %s", i.Repo, err)
 		}
 
 	} else {
-		err = i.client.UpdateRepo(&pipeline.UpdateRepoInput{
-			RepoName: i.Repo,
-			Schema:   append(schema.Schema, target...),
-		})
+		// the repo is only updated when the points bring new keys
+		if len(target) > 0 {
+			i.limiter.Wait()
+			err = i.client.UpdateRepo(&pipeline.UpdateRepoInput{
+				RepoName: i.Repo,
+				Schema:   newSchema,
+			})
+			if err != nil {
+				// exporting against the stale schema would fail anyway
+				return fmt.Errorf("update pipeline repo %s fail: %s", i.Repo, err)
+			}
+			i.repoStats().SchemaUpdates.Incr(1)
+			i.cacheSchema(newSchema)
+		}
 
 		err = i.updateExport(points)
 		if err != nil {
-			fmt.Println(err)
+			log.Printf("E! sync exports of repo %s fail: %s", i.Repo, err)
 			return err
 		}
 	}
@@ -434,7 +2057,36 @@ func (i *Pipeline) updateSchema(points tsdb.Points) error {
 }
 func newPipeline() *Pipeline {
 	return &Pipeline{
-		Timeout: internal.Duration{Duration: time.Second * 5},
+		Region:              "nb",
+		SeriesRetention:     defaultSeriesRetention,
+		ExportNameTemplate:  defaultExportNameTemplate,
+		ExportWhence:        "oldest",
+		TimestampUnits:      "ns",
+		TimestampKey:        "timestamp",
+		SanitizeReplacement: "_",
+		DefaultTagType:      "string",
+		TypeInference:       "strict",
+		CheckRepoOnConnect:  true,
+		AutoCreateTsdbRepo:  true,
+		SchemaCacheTTL:      internal.Duration{Duration: time.Minute * 5},
+		ExportSyncInterval:  internal.Duration{Duration: time.Second * 60},
+		SchemaRetryInterval: internal.Duration{Duration: time.Second * 30},
+		Timeout:             internal.Duration{Duration: time.Second * 5},
+		RetryInterval:       internal.Duration{Duration: time.Second},
+		ConnectTimeout:      internal.Duration{Duration: time.Second * 5},
+		MaxBatchBytes:       32 * 1024 * 1024,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		FloatNaNHandling:    "drop",
+		OnFieldConflict:     "drop",
+		ShutdownTimeout:     internal.Duration{Duration: time.Second * 10},
+		StartupJitter:       internal.Duration{Duration: time.Second * 5},
+		exports:             &exportState{},
+		UserAgent:           client.DefaultUserAgent,
+		WriteConcurrency:    4,
+		ControlPlaneRPS:     5,
+		MaxSpillBytes:       100 * 1024 * 1024,
+		TagValuesWindow:     internal.Duration{Duration: time.Hour},
 	}
 }
 
@@ -1,18 +1,38 @@
 package pipeline
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	tsdb "github.com/influxdata/influxdb/models"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	pandoraclient "github.com/influxdata/telegraf/plugins/outputs/pandora/client"
 	"github.com/influxdata/telegraf/testutil"
+	"github.com/influxdata/toml"
+	"github.com/qiniu/pandora-go-sdk/pipeline"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestHTTPConnectError_InvalidURL(t *testing.T) {
-	i := PandoraTSDB{
+	i := Pipeline{
 		URL: "htt://foobar:8089",
 	}
 
@@ -36,9 +56,11 @@ func TestHTTPError_DatabaseNotFound(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	i := PandoraTSDB{
+	i := Pipeline{
 		URL:  ts.URL,
 		Repo: "test",
+		AK:   "ak",
+		SK:   "sk",
 	}
 
 	err := i.Connect()
@@ -60,9 +82,11 @@ func TestHTTPError_FieldTypeConflict(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	i := PandoraTSDB{
+	i := Pipeline{
 		URL:  ts.URL,
 		Repo: "test",
+		AK:   "ak",
+		SK:   "sk",
 	}
 
 	err := i.Connect()
@@ -71,3 +95,2654 @@ func TestHTTPError_FieldTypeConflict(t *testing.T) {
 	require.NoError(t, err)
 	require.NoError(t, i.Close())
 }
+
+func TestConfigDecode(t *testing.T) {
+	i := newPipeline()
+	err := toml.Unmarshal([]byte(`
+url = "https://pipeline.qiniu.com"
+repo = "monitor"
+auto_create_repo = true
+`), i)
+	require.NoError(t, err)
+	require.True(t, i.AutoCreateRepo)
+}
+
+func TestConnectError_InvalidTsdbURL(t *testing.T) {
+	i := newTestPipeline()
+	i.TsdbURL = "htt://foobar:8089"
+
+	err := i.Connect()
+	require.Error(t, err)
+}
+
+func TestConnectError_InvalidSeriesRetention(t *testing.T) {
+	i := newTestPipeline()
+	i.SeriesRetention = "90d"
+
+	err := i.Connect()
+	require.Error(t, err)
+}
+
+func TestConnectError_InvalidContentEncoding(t *testing.T) {
+	i := newTestPipeline()
+	i.ContentEncoding = "br"
+
+	err := i.Connect()
+	require.Error(t, err)
+}
+
+func TestTsdbEndpoint(t *testing.T) {
+	i := newPipeline()
+	require.Equal(t, "https://tsdb.qiniu.com", i.tsdbEndpoint())
+
+	i.TsdbURL = "http://tsdb.example.com:8080"
+	require.Equal(t, "http://tsdb.example.com:8080", i.tsdbEndpoint())
+}
+
+func TestWrite_TsdbURLViaServer(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	tsdbServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer tsdbServer.Close()
+
+	i := newTestPipeline()
+	i.URL = ts.URL
+	i.TsdbURL = tsdbServer.URL
+	require.NoError(t, i.Connect())
+	defer i.Close()
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	// the exports queued are synced before Close returns
+	require.NoError(t, i.Close())
+
+	// the series of the export is created on the custom endpoint
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, paths)
+	require.Contains(t, strings.Join(paths, " "), "test1")
+}
+
+func TestCheckRepo(t *testing.T) {
+	client := newMockPipelineClient()
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	require.NoError(t, i.checkRepo())
+	require.Empty(t, client.createRepoInputs)
+
+	tests := []struct {
+		autoCreate bool
+		expectErr  bool
+	}{
+		{autoCreate: false, expectErr: true},
+		{autoCreate: true},
+	}
+	for _, tt := range tests {
+		client := newMockPipelineClient()
+		client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+		tsdbClient := newMockTsdbClient()
+
+		i := newTestPipeline()
+		i.AutoCreateRepo = tt.autoCreate
+		i.client = client
+		i.tsdbClient = tsdbClient
+
+		err := i.checkRepo()
+		if tt.expectErr {
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "repo test does not exist")
+			require.Empty(t, client.createRepoInputs)
+			continue
+		}
+		require.NoError(t, err)
+		require.Len(t, client.createRepoInputs, 1)
+		require.Equal(t, "test", client.createRepoInputs[0].RepoName)
+		require.Len(t, tsdbClient.createRepoInputs, 1)
+	}
+
+	client = newMockPipelineClient()
+	client.errs["GetRepo"] = errors.New("E18003: unauthorized")
+	i = newTestPipeline()
+	i.client = client
+	require.Error(t, i.checkRepo())
+}
+
+func TestCheckRepo_NoTsdbRepo(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+	tsdbClient := newMockTsdbClient()
+
+	i := newTestPipeline()
+	i.AutoCreateRepo = true
+	i.AutoCreateTsdbRepo = false
+	i.client = client
+	i.tsdbClient = tsdbClient
+
+	require.NoError(t, i.checkRepo())
+	require.Len(t, client.createRepoInputs, 1)
+	require.Equal(t, "test", client.createRepoInputs[0].RepoName)
+	require.Empty(t, tsdbClient.createRepoInputs)
+}
+
+func TestUpdateSchema_TsdbRepoFails(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+	tsdbClient := newMockTsdbClient()
+	tsdbClient.errs["CreateRepo"] = errors.New("E6003: invalid region")
+
+	i := newTestPipeline()
+	i.AutoCreateRepo = true
+	i.ControlPlaneRPS = 0
+	i.client = client
+	i.tsdbClient = tsdbClient
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 value=1 1000000000\n"))
+	require.NoError(t, err)
+	require.EqualError(t, i.updateSchema(pts), "create tsdb repo test fail: E6003: invalid region")
+	require.Len(t, client.createRepoInputs, 1)
+	require.Equal(t, 0, tsdbClient.count("CreateSeries"))
+	require.Equal(t, 0, client.count("CreateExport"))
+}
+
+func TestCurrentSchema(t *testing.T) {
+	i := newTestPipeline()
+	_, err := i.CurrentSchema()
+	require.Error(t, err)
+
+	client := newMockPipelineClient()
+	client.repoSchema = []pipeline.RepoSchemaEntry{
+		{Key: "cpu_host", ValueType: "string"},
+		{Key: "cpu_value", ValueType: "float"},
+		{Key: "timestamp", ValueType: "long"},
+	}
+	i.client = client
+
+	// the cached schema is stale, CurrentSchema reads it again
+	i.cacheSchema([]pipeline.RepoSchemaEntry{{Key: "timestamp", ValueType: "long"}})
+	schema, err := i.CurrentSchema()
+	require.NoError(t, err)
+	require.Equal(t, client.repoSchema, schema)
+	require.Equal(t, 1, client.count("GetRepo"))
+	require.Len(t, i.schemaCache, 1)
+
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+	_, err = i.CurrentSchema()
+	require.Error(t, err)
+}
+
+func TestRepoSchema_CacheTTL(t *testing.T) {
+	client := newMockPipelineClient()
+	client.repoSchema = []pipeline.RepoSchemaEntry{{Key: "timestamp", ValueType: "long"}}
+	now := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	i := newTestPipeline()
+	i.client = client
+	i.SchemaCacheTTL.Duration = time.Minute
+	i.now = func() time.Time { return now }
+
+	_, err := i.repoSchema()
+	require.NoError(t, err)
+	require.Equal(t, 1, client.count("GetRepo"))
+
+	// the schema is read again once schema_cache_ttl has passed
+	now = now.Add(59 * time.Second)
+	_, err = i.repoSchema()
+	require.NoError(t, err)
+	require.Equal(t, 1, client.count("GetRepo"))
+	now = now.Add(time.Second)
+	_, err = i.repoSchema()
+	require.NoError(t, err)
+	require.Equal(t, 2, client.count("GetRepo"))
+}
+
+func TestUpdateSchema_Region(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+	tsdbClient := newMockTsdbClient()
+
+	i := newPipeline()
+	i.Repo = "test"
+	i.Region = "z0"
+	i.client = client
+	i.tsdbClient = tsdbClient
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 value=1 1000000000\n"))
+	require.NoError(t, err)
+	require.NoError(t, i.updateSchema(pts))
+
+	require.Len(t, client.createRepoInputs, 1)
+	require.Equal(t, "z0", client.createRepoInputs[0].Region)
+	require.Len(t, tsdbClient.createRepoInputs, 1)
+	require.Equal(t, "z0", tsdbClient.createRepoInputs[0].Region)
+}
+
+func TestWrite_RetriesTransientErrors(t *testing.T) {
+	failures := 2
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts < failures {
+			attempts++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	i := newTestPipeline()
+	i.URL = ts.URL
+	i.Repo = "test"
+	i.MaxRetries = 3
+	i.RetryInterval.Duration = time.Millisecond
+
+	require.NoError(t, i.Connect())
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Equal(t, failures, attempts)
+	require.NoError(t, i.Close())
+}
+
+func TestWrite_RetriesExhaustedViaServer(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	i := newTestPipeline()
+	i.URL = ts.URL
+	i.Repo = "test"
+	i.MaxRetries = 2
+	i.RetryInterval.Duration = time.Millisecond
+
+	require.NoError(t, i.Connect())
+	require.Error(t, i.Write(testutil.MockMetrics()))
+	require.Equal(t, 3, attempts)
+	require.NoError(t, i.Close())
+}
+
+func TestWrite_RetriesExhausted(t *testing.T) {
+	unavailable := errors.New("status code: 503")
+	client := newMockPipelineClient()
+	client.postErrSeq = []error{unavailable, unavailable, unavailable}
+
+	i := newTestPipeline()
+	i.Repo = "retries_exhausted_test"
+	i.MaxRetries = 2
+	i.RetryInterval.Duration = time.Millisecond
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	// the points are left to Telegraf to write them again
+	require.Equal(t, unavailable, i.Write(testutil.MockMetrics()))
+	require.Equal(t, 3, client.count("PostDataFromBytes"))
+	require.Equal(t, int64(0), i.repoStats().PointsWritten.Get())
+
+	// as are the ones failing with an error not worth retrying
+	client.errs["PostDataFromBytes"] = errors.New("status code: 400")
+	require.Error(t, i.Write(testutil.MockMetrics()))
+	require.Equal(t, 4, client.count("PostDataFromBytes"))
+}
+
+func TestWrite_IdempotentWrites(t *testing.T) {
+	client := newMockPipelineClient()
+	client.postErrSeq = []error{errors.New("status code: 503")}
+
+	i := newTestPipeline()
+	i.Repo = "idempotent_writes_test"
+	i.MaxRetries = 1
+	i.RetryInterval.Duration = time.Millisecond
+	i.IdempotentWrites = true
+	require.NoError(t, i.Init())
+	i.idempotency = &pandoraclient.IdempotencyKeys{}
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	// the key the transport sends along each post, called with the mock
+	// locked
+	var keys []string
+	client.onCall = func(method string) {
+		if method == "PostDataFromBytes" {
+			keys = append(keys, i.idempotency.Key(client.posts[len(client.posts)-1]))
+		}
+	}
+
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+
+	// the retry sends the key of the first batch, the next batch, of the
+	// same bytes, a new one
+	require.Len(t, keys, 3)
+	require.NotEmpty(t, keys[0])
+	require.Equal(t, keys[0], keys[1])
+	require.NotEqual(t, keys[1], keys[2])
+	require.NotEmpty(t, keys[2])
+	require.Equal(t, "", i.idempotency.Key(client.posts[2]))
+}
+
+func TestConnectCloseConnect(t *testing.T) {
+	i := newTestPipeline()
+	i.Repo = "test"
+
+	require.NoError(t, i.Connect())
+	require.NoError(t, i.Close())
+	require.Nil(t, i.client)
+	require.Nil(t, i.transport)
+	require.Nil(t, i.bgTransport)
+	require.NoError(t, i.Connect())
+	require.NoError(t, i.Close())
+}
+
+func TestKeepalive_Reconnects(t *testing.T) {
+	stale := newMockPipelineClient()
+	stale.errs["GetRepo"] = errors.New("read tcp: connection reset by peer")
+	stale.errs["PostDataFromBytes"] = errors.New("read tcp: connection reset by peer")
+	fresh := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.KeepaliveInterval.Duration = 5 * time.Millisecond
+	i.ControlPlaneRPS = 0
+	require.NoError(t, i.Init())
+	i.client = stale
+	i.tsdbClient = newMockTsdbClient()
+	reconnected := make(chan struct{})
+	i.newClientsFunc = func() error {
+		i.client = fresh
+		close(reconnected)
+		return nil
+	}
+	i.startKeepalive()
+	defer i.Close()
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnection after failed pings")
+	}
+	require.Equal(t, keepaliveMaxFailures, stale.count("GetRepo"))
+
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Equal(t, 0, stale.count("PostDataFromBytes"))
+	require.Equal(t, 1, fresh.count("PostDataFromBytes"))
+
+	i = newTestPipeline()
+	i.KeepaliveInterval.Duration = -time.Second
+	require.EqualError(t, i.Init(), "config.KeepaliveInterval must not be negative, got -1s")
+}
+
+func TestKeepalive_ReconnectKeepsState(t *testing.T) {
+	stale := newMockPipelineClient()
+	stale.errs["GetRepo"] = errors.New("read tcp: connection reset by peer")
+	fresh := newMockPipelineClient()
+	fresh.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+
+	i := newTestPipeline()
+	i.Repo = "reconnect_test"
+	i.KeepaliveInterval.Duration = 5 * time.Millisecond
+	i.CheckRepoOnConnect = true
+	i.AutoCreateRepo = true
+	i.ControlPlaneRPS = 0
+	require.NoError(t, i.Init())
+	i.client = stale
+	i.tsdbClient = newMockTsdbClient()
+	stats := i.repoStats()
+	stats.PointsWritten.Incr(1)
+	other := i.repoWriter("other")
+	reconnected := make(chan struct{})
+	i.newClientsFunc = func() error {
+		i.client = fresh
+		close(reconnected)
+		return nil
+	}
+	i.startExporter()
+	i.startKeepalive()
+	defer i.Close()
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnection after failed pings")
+	}
+
+	// the write waits for the reconnect, which must neither check the repo
+	// nor reset the state of the writes
+	done := make(chan error, 1)
+	go func() { done <- i.Write(testutil.MockMetrics()) }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked after reconnecting")
+	}
+	require.Equal(t, 0, fresh.count("CreateRepo"))
+	require.True(t, i.repoStats() == stats)
+	require.Equal(t, int64(2), stats.PointsWritten.Get())
+	require.True(t, other.client == fresh)
+}
+
+func TestProbe(t *testing.T) {
+	i := newTestPipeline()
+	i.URL = "https://pipeline.example.com"
+	require.EqualError(t, i.Probe(), "pipeline output for repo test is not connected")
+
+	client := newMockPipelineClient()
+	i.client = client
+	require.NoError(t, i.Probe())
+
+	// a missing repo still shows working credentials
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+	require.NoError(t, i.Probe())
+
+	client.errs["GetRepo"] = errors.New("E401: bad token, status code: 401")
+	err := i.Probe()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "refused the credentials")
+
+	client.errs["GetRepo"] = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	err = i.Probe()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot be reached")
+
+	client.errs["GetRepo"] = errors.New("E18000: internal error")
+	require.EqualError(t, i.Probe(), "probe of pipeline repo test fail: E18000: internal error")
+}
+
+func TestConvertEscapesDelimiters(t *testing.T) {
+	pt, err := tsdb.NewPoint("log",
+		tsdb.NewTags(map[string]string{"path": `C:\tmp`}),
+		tsdb.Fields{"message": "a\tb\nc"},
+		time.Unix(1, 0))
+	require.NoError(t, err)
+
+	fields, err := pt.Fields()
+	require.NoError(t, err)
+	record := convertTag("log", pt.Tags(), "_") + convertField("log", fields, "_") + "timestamp=1000000000\n"
+
+	records := strings.Split(strings.TrimSuffix(record, "\n"), "\n")
+	require.Len(t, records, 1)
+	require.Equal(t, []string{
+		`log_path=C:\\tmp`,
+		`log_message=a\tb\nc`,
+		"timestamp=1000000000",
+	}, strings.Split(records[0], "\t"))
+}
+
+func TestWrite_OnFieldConflict(t *testing.T) {
+	conflict := errors.New("E18111: schema mismatch")
+	for _, tc := range []struct {
+		mode    string
+		errs    []error
+		posts   int
+		written int64
+		err     bool
+	}{
+		{"drop", []error{conflict}, 1, 0, false},
+		{"retry_once", []error{conflict}, 2, 1, false},
+		{"retry_once", []error{conflict, conflict}, 2, 0, false},
+		{"error", []error{conflict}, 1, 0, true},
+	} {
+		client := newMockPipelineClient()
+		client.postErrSeq = tc.errs
+
+		i := newTestPipeline()
+		i.Repo = "field_conflict_" + tc.mode
+		i.OnFieldConflict = tc.mode
+		require.NoError(t, i.Init())
+		i.client = client
+		i.tsdbClient = newMockTsdbClient()
+		written := i.repoStats().PointsWritten.Get()
+
+		err := i.Write(testutil.MockMetrics())
+		if tc.err {
+			require.Equal(t, conflict, err, tc.mode)
+		} else {
+			require.NoError(t, err, tc.mode)
+		}
+		require.Equal(t, tc.posts, client.count("PostDataFromBytes"), tc.mode)
+		require.Equal(t, tc.written, i.repoStats().PointsWritten.Get()-written, tc.mode)
+	}
+
+	i := newTestPipeline()
+	i.OnFieldConflict = "ignore"
+	require.EqualError(t, i.Init(), `invalid on_field_conflict "ignore", must be one of drop, retry_once, error`)
+}
+
+func TestBuildPipelineData(t *testing.T) {
+	pts, err := tsdb.ParsePoints([]byte(
+		"cpu,host=h1 usage=1.5,count=2i 1000000000\n" +
+			"mem,host=h1 used=10i 1000000000\n" +
+			"cpu,host=h1 usage=2.5,count=3i 2000000000\n" +
+			`log,path=C:\tmp message="a` + "\t" + `b",ok=true 2000000000` + "\n"))
+	require.NoError(t, err)
+
+	data, records, err := buildPipelineData(pts, "ts", "ms", "_")
+	require.NoError(t, err)
+	require.Equal(t, 4, records)
+
+	// every point makes a record of its own, in order, the points of cpu and
+	// mem at the same timestamp too
+	var keyValues [][]string
+	for _, record := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		kvs := strings.Split(record, "\t")
+		sort.Strings(kvs)
+		keyValues = append(keyValues, kvs)
+	}
+	require.Equal(t, [][]string{
+		{"cpu_count=2", "cpu_host=h1", "cpu_usage=1.5", "ts=1000"},
+		{"mem_host=h1", "mem_used=10", "ts=1000"},
+		{"cpu_count=3", "cpu_host=h1", "cpu_usage=2.5", "ts=2000"},
+		{`log_message=a\tb`, "log_ok=true", `log_path=C:\\tmp`, "ts=2000"},
+	}, keyValues)
+
+	data, records, err = buildPipelineData(nil, "ts", "ms", "_")
+	require.NoError(t, err)
+	require.Empty(t, data)
+	require.Equal(t, 0, records)
+}
+
+func TestWrite_SanitizesKeys(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["PostDataFromBytes"] = errors.New("E18102: repo does not exist")
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+
+	i := newTestPipeline()
+	i.AutoCreateRepo = true
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	m, err := metric.New("disk.io", map[string]string{"dev-name": "sda"},
+		map[string]interface{}{"read bytes": int64(1), "io.time": 2.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m}))
+
+	// the same keys in the record, the schema and the export
+	keys := []string{"disk_io_dev_name", "disk_io_read_bytes", "disk_io_io_time"}
+	require.Len(t, client.posts, 1)
+	for _, key := range keys {
+		require.Contains(t, string(client.posts[0]), key+"=")
+	}
+	schema := make(map[string]string)
+	for _, entry := range client.createRepoInputs[0].Schema {
+		schema[entry.Key] = entry.ValueType
+	}
+	require.Equal(t, map[string]string{
+		"disk_io_dev_name":   "string",
+		"disk_io_read_bytes": "long",
+		"disk_io_io_time":    "float",
+		"timestamp":          "long",
+	}, schema)
+	spec := client.createExportInputs[0].Spec.(*pipeline.ExportTsdbSpec)
+	require.Equal(t, "disk.io", spec.SeriesName)
+	require.Equal(t, map[string]string{"dev-name": "#disk_io_dev_name"}, spec.Tags)
+	require.Equal(t, map[string]string{
+		"read bytes": "#disk_io_read_bytes",
+		"io.time":    "#disk_io_io_time",
+	}, spec.Fields)
+}
+
+func TestSchemaKey(t *testing.T) {
+	require.Equal(t, "cpu_usage_idle", schemaKey("cpu", "usage_idle", "_"))
+	require.Equal(t, "disk_io_read_bytes", schemaKey("disk.io", "read bytes", "_"))
+	require.Equal(t, "net_if_rx_bytes", schemaKey("net", "if-rx.bytes", "_"))
+	require.Equal(t, "net_ifxrx", schemaKey("net", "if-rx", "x"))
+	require.Equal(t, "net_ifrx", schemaKey("net", "if-rx", ""))
+	require.Equal(t, "caf_x", schemaKey("café", "éx", ""))
+
+	i := newTestPipeline()
+	i.SanitizeReplacement = "-"
+	require.Error(t, i.Init())
+}
+
+func TestFormatValue(t *testing.T) {
+	for _, val := range []interface{}{"text", int64(-42), 3.14, 1e21, true, int32(7)} {
+		require.Equal(t, fmt.Sprintf("%v", val), formatValue(val))
+	}
+}
+
+func BenchmarkConvertField(b *testing.B) {
+	fields := make(tsdb.Fields)
+	for n := 0; n < 50; n++ {
+		fields[fmt.Sprintf("field_%d", n)] = float64(n)
+	}
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		convertField("cpu", fields, "_")
+	}
+}
+
+func TestReadMetrics_ShortReads(t *testing.T) {
+	metrics := testutil.MockMetrics()
+	bufsize := 0
+	for _, m := range metrics {
+		bufsize += m.Len()
+	}
+
+	p, err := readMetrics(iotest.OneByteReader(metric.NewReader(metrics)), bufsize)
+	require.NoError(t, err)
+	require.Equal(t, bufsize, len(p))
+	require.Equal(t, metrics[0].String(), string(p))
+}
+
+func TestConnectError_InvalidHTTPProxy(t *testing.T) {
+	i := newTestPipeline()
+	i.HTTPProxy = "proxy:3128"
+
+	err := i.Connect()
+	require.Error(t, err)
+}
+
+func TestConvertTimestamp(t *testing.T) {
+	ns := int64(1500000000123456789)
+	tests := []struct {
+		units    string
+		expected int64
+	}{
+		{"ns", 1500000000123456789},
+		{"us", 1500000000123456},
+		{"ms", 1500000000123},
+		{"s", 1500000000},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, convertTimestamp(ns, tt.units), tt.units)
+	}
+
+	// sub-unit precision is truncated, not rounded
+	require.Equal(t, int64(1), convertTimestamp(int64(1999*time.Millisecond), "s"))
+}
+
+func TestConnectError_InvalidTimestampUnits(t *testing.T) {
+	i := newTestPipeline()
+	i.TimestampUnits = "m"
+
+	err := i.Connect()
+	require.Error(t, err)
+}
+
+func TestExportNameTemplate(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.Repo = "monitor"
+	i.ExportNameTemplate = "{{.Repo}}_{{.Series}}_export"
+	require.NoError(t, i.Connect())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	name, err := i.exportName("cpu")
+	require.NoError(t, err)
+	require.Equal(t, "monitor_cpu_export", name)
+
+	require.NoError(t, i.createOrUpdateExport(i.writeClients(), "cpu", nil, nil))
+	require.Len(t, client.createExportInputs, 1)
+	require.Equal(t, "monitor_cpu_export", client.createExportInputs[0].ExportName)
+
+	client.errs["CreateExport"] = errors.New("E18301: export already exists")
+	require.NoError(t, i.createOrUpdateExport(i.writeClients(), "cpu", nil, nil))
+	require.Len(t, client.updateExportInputs, 1)
+	require.Equal(t, "monitor_cpu_export", client.updateExportInputs[0].ExportName)
+}
+
+func TestExportNameTemplate_Default(t *testing.T) {
+	i := newPipeline()
+	i.Repo = "monitor"
+
+	name, err := i.exportName("cpu")
+	require.NoError(t, err)
+	require.Equal(t, "export_cpu_toTSDB", name)
+}
+
+func TestConnectError_InvalidExportNameTemplate(t *testing.T) {
+	i := newTestPipeline()
+	i.ExportNameTemplate = "export_{{.Series"
+
+	err := i.Connect()
+	require.Error(t, err)
+}
+
+func TestUpdateSchema_CachesRepoSchema(t *testing.T) {
+	client := newMockPipelineClient()
+	client.repoSchema = []pipeline.RepoSchemaEntry{
+		{Key: "cpu_host", ValueType: "string"},
+	}
+
+	i := newPipeline()
+	i.Repo = "test"
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 value=1 1000000000\n"))
+	require.NoError(t, err)
+	require.NoError(t, i.updateSchema(pts))
+	pts, err = tsdb.ParsePoints([]byte("cpu,host=h1 idle=1 1000000000\n"))
+	require.NoError(t, err)
+	require.NoError(t, i.updateSchema(pts))
+	require.Equal(t, 1, client.count("GetRepo"))
+
+	i.invalidateSchema()
+	require.NoError(t, i.updateSchema(pts))
+	require.Equal(t, 2, client.count("GetRepo"))
+
+	i.SchemaCacheTTL.Duration = 0
+	require.NoError(t, i.updateSchema(pts))
+	require.Equal(t, 3, client.count("GetRepo"))
+}
+
+func TestWrite_NamePrefix(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newPipeline()
+	i.Repo = "test"
+	i.NamePrefix = "prod_"
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	metrics := testutil.MockMetrics()
+	require.NoError(t, i.Write(metrics))
+	require.Len(t, client.posts, 1)
+	require.Contains(t, string(client.posts[0]), "prod_test1_tag1=value1\t")
+	require.Contains(t, string(client.posts[0]), "prod_test1_value=1\t")
+	// the metrics handed to the output are left untouched
+	require.Equal(t, "test1", metrics[0].Name())
+
+	pts, err := tsdb.ParsePoints(pandoraclient.PrefixMetrics(metrics, "prod_")[0].Serialize())
+	require.NoError(t, err)
+	tags, fields := extractSchemaFromPoints(pts, newTestPipeline().fieldType, "_")
+	require.Equal(t, []string{"prod_test1_tag1"}, tags)
+	require.Equal(t, map[string]string{"prod_test1_value": "float"}, fields)
+}
+
+func TestUpdateSchema_SkipsUnchangedSchema(t *testing.T) {
+	client := newMockPipelineClient()
+	tsdbClient := newMockTsdbClient()
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = tsdbClient
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 value=1 1000000000\n"))
+	require.NoError(t, err)
+	require.NoError(t, i.updateSchema(pts))
+	require.Equal(t, 1, client.count("UpdateRepo"))
+	require.Equal(t, 1, client.count("CreateExport"))
+
+	// nothing new in the second batch, for the repo nor the export
+	require.NoError(t, i.updateSchema(pts))
+	require.Equal(t, 1, client.count("UpdateRepo"))
+	require.Equal(t, 1, client.count("CreateExport"))
+}
+
+func TestUpdateSchema_UpdateRepoError(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["UpdateRepo"] = errors.New("E18120: invalid schema")
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 value=1 1000000000\n"))
+	require.NoError(t, err)
+	err = i.updateSchema(pts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "E18120: invalid schema")
+	require.Equal(t, 0, client.count("CreateExport"))
+}
+
+func TestUpdateSchema_GetRepoError(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["GetRepo"] = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	i := newTestPipeline()
+	i.AutoCreateRepo = true
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 usage=0.5 1000000000\n"))
+	require.NoError(t, err)
+	require.EqualError(t, i.updateSchema(pts), "get pipeline repo test fail: read tcp: connection reset by peer")
+	require.Equal(t, 0, client.count("CreateRepo"))
+	require.Equal(t, 0, client.count("UpdateRepo"))
+	require.Equal(t, 0, client.count("CreateExport"))
+}
+
+func TestUpdateSchema_CreateRepo(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 usage=0.5 1000000000\n"))
+	require.NoError(t, err)
+	require.NoError(t, i.updateSchema(pts))
+	require.Len(t, client.createRepoInputs, 1)
+	require.Len(t, client.createRepoInputs[0].Schema, 3)
+	require.Equal(t, 0, client.count("UpdateRepo"))
+	require.Equal(t, client.createRepoInputs[0].Schema, i.schemaCache)
+}
+
+func TestUpdateSchema_NilRepo(t *testing.T) {
+	client := newMockPipelineClient()
+	client.nilRepo = true
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	schema, err := i.CurrentSchema()
+	require.NoError(t, err)
+	require.Empty(t, schema)
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 usage=0.5 1000000000\n"))
+	require.NoError(t, err)
+	require.NoError(t, i.updateSchema(pts))
+	require.Equal(t, 0, client.count("CreateRepo"))
+	require.Len(t, client.updateRepoInputs, 1)
+	require.Len(t, client.updateRepoInputs[0].Schema, 3)
+}
+
+func TestUpdateSchema_BoolAsString(t *testing.T) {
+	for _, boolAsString := range []bool{false, true} {
+		client := newMockPipelineClient()
+		client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+
+		i := newTestPipeline()
+		i.BoolAsString = boolAsString
+		i.client = client
+		i.tsdbClient = newMockTsdbClient()
+
+		pts, err := tsdb.ParsePoints([]byte("proc,host=h1 running=true 1000000000\n"))
+		require.NoError(t, err)
+		require.NoError(t, i.updateSchema(pts))
+
+		expected := "boolean"
+		if boolAsString {
+			expected = "string"
+		}
+		require.Len(t, client.createRepoInputs, 1)
+		types := make(map[string]string)
+		for _, entry := range client.createRepoInputs[0].Schema {
+			types[entry.Key] = entry.ValueType
+		}
+		require.Equal(t, expected, types["proc_running"], "bool_as_string=%v", boolAsString)
+
+		fields, err := pts[0].Fields()
+		require.NoError(t, err)
+		require.Equal(t, "proc_running=true\t", convertField("proc", fields, "_"))
+	}
+}
+
+func TestUpdateSchema_FieldTypes(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+
+	i := newTestPipeline()
+	i.FieldTypes = map[string]string{"usage": "float"}
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	// an integer value comes first, the field still is a float
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 usage=1i,count=2i 1000000000\n"))
+	require.NoError(t, err)
+	require.NoError(t, i.updateSchema(pts))
+
+	require.Len(t, client.createRepoInputs, 1)
+	types := make(map[string]string)
+	for _, entry := range client.createRepoInputs[0].Schema {
+		types[entry.Key] = entry.ValueType
+	}
+	require.Equal(t, "float", types["cpu_usage"])
+	require.Equal(t, "long", types["cpu_count"])
+
+	i = newTestPipeline()
+	i.FieldTypes = map[string]string{"usage": "double"}
+	require.EqualError(t, i.Init(), `invalid field_types type "double" of field usage, must be one of long, float, string, boolean`)
+}
+
+func TestUpdateSchema_TypeInference(t *testing.T) {
+	tests := []struct {
+		typeInference string
+		expected      map[string]string
+	}{
+		{"strict", map[string]string{
+			"mix_count": "long", "mix_usage": "float", "mix_up": "boolean", "mix_state": "string"}},
+		{"numeric_as_float", map[string]string{
+			"mix_count": "float", "mix_usage": "float", "mix_up": "boolean", "mix_state": "string"}},
+		{"all_string", map[string]string{
+			"mix_count": "string", "mix_usage": "string", "mix_up": "string", "mix_state": "string"}},
+	}
+	for _, tt := range tests {
+		client := newMockPipelineClient()
+		client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+
+		i := newTestPipeline()
+		i.TypeInference = tt.typeInference
+		require.NoError(t, i.Init())
+		i.client = client
+		i.tsdbClient = newMockTsdbClient()
+
+		pts, err := tsdb.ParsePoints([]byte(`mix,host=h1 count=2i,usage=0.5,up=true,state="ok" 1000000000` + "\n"))
+		require.NoError(t, err)
+		require.NoError(t, i.updateSchema(pts))
+
+		require.Len(t, client.createRepoInputs, 1)
+		types := make(map[string]string)
+		for _, entry := range client.createRepoInputs[0].Schema {
+			if _, ok := tt.expected[entry.Key]; ok {
+				types[entry.Key] = entry.ValueType
+			}
+		}
+		require.Equal(t, tt.expected, types, tt.typeInference)
+	}
+
+	i := newTestPipeline()
+	i.TypeInference = "loose"
+	require.EqualError(t, i.Init(), `invalid type_inference "loose", must be one of strict, numeric_as_float, all_string`)
+}
+
+func TestWrite_StartupJitter(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		now    = time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+		sleeps []time.Duration
+	)
+	pc := newMockPipelineClient()
+	pc.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+	pc.errs["PostDataFromBytes"] = errors.New("E18102: repo does not exist")
+
+	i := newTestPipeline()
+	i.AutoCreateRepo = true
+	i.StartupJitter.Duration = 10 * time.Second
+	i.ControlPlaneRPS = 0
+	i.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	i.sleep = func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+	i.newClientsFunc = func() error {
+		i.client = pc
+		i.tsdbClient = newMockTsdbClient()
+		i.deadline = &pandoraclient.Deadline{}
+		return nil
+	}
+	require.NoError(t, i.Connect())
+	defer i.Close()
+	// the time left to the repo creation, jittered past the write timeout
+	var left time.Duration
+	pc.onCall = func(method string) {
+		if method == "CreateRepo" {
+			left = i.deadline.Get().Sub(i.timeNow())
+		}
+	}
+
+	i.Write(testutil.MockMetrics())
+	require.Len(t, pc.createRepoInputs, 1)
+	mu.Lock()
+	require.Len(t, sleeps, 1)
+	require.True(t, sleeps[0] > 0 && sleeps[0] < 10*time.Second, "slept %s", sleeps[0])
+	mu.Unlock()
+	require.Equal(t, i.Timeout.Duration, left)
+
+	// only the first changes wait
+	require.NoError(t, i.createOrUpdateExport(i.writeClients(), "cpu", nil, nil))
+	mu.Lock()
+	require.Len(t, sleeps, 1)
+	mu.Unlock()
+
+	i = newTestPipeline()
+	i.StartupJitter.Duration = -time.Second
+	require.EqualError(t, i.Init(), "config.StartupJitter must not be negative, got -1s")
+}
+
+func TestConnect_StartupJitter(t *testing.T) {
+	var slept time.Duration
+	client := newMockPipelineClient()
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+
+	i := newTestPipeline()
+	i.CheckRepoOnConnect = true
+	i.AutoCreateRepo = true
+	i.StartupJitter.Duration = 10 * time.Second
+	i.ControlPlaneRPS = 0
+	i.sleep = func(d time.Duration) { slept += d }
+	i.newClientsFunc = func() error {
+		i.client = client
+		i.tsdbClient = newMockTsdbClient()
+		return nil
+	}
+	client.onCall = func(method string) {
+		if method == "CreateRepo" {
+			require.True(t, slept > 0, "repo created before the jitter")
+		}
+	}
+
+	// the repo missing at startup is created once the jitter is over
+	require.NoError(t, i.Connect())
+	defer i.Close()
+	require.Len(t, client.createRepoInputs, 1)
+	require.True(t, slept > 0 && slept < 10*time.Second, "slept %s", slept)
+}
+
+func TestUpdateSchema_RequiredFields(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+
+	i := newTestPipeline()
+	i.RequiredFields = []string{"cpu_usage", "timestamp"}
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,host=h1 usage=0.5,idle=0.5 1000000000\n"))
+	require.NoError(t, err)
+	require.NoError(t, i.updateSchema(pts))
+
+	require.Len(t, client.createRepoInputs, 1)
+	required := make(map[string]bool)
+	for _, entry := range client.createRepoInputs[0].Schema {
+		required[entry.Key] = entry.Required
+	}
+	require.Equal(t, map[string]bool{
+		"cpu_host":  false,
+		"cpu_usage": true,
+		"cpu_idle":  false,
+		"timestamp": true,
+	}, required)
+
+	i = newTestPipeline()
+	i.RequiredFields = []string{""}
+	require.EqualError(t, i.Init(), "config.RequiredFields must not hold empty keys")
+}
+
+func TestWrite_TimestampKey(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+	client.errs["PostDataFromBytes"] = errors.New("E18102: repo does not exist")
+
+	i := newTestPipeline()
+	i.TimestampKey = "ts"
+	i.AutoCreateRepo = true
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	require.NoError(t, i.Init())
+
+	m, err := metric.New("cpu", nil, map[string]interface{}{"timestamp": int64(5)}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m}))
+
+	require.Equal(t, "cpu_timestamp=5\tts=1000000000\n", string(client.posts[0]))
+
+	require.Len(t, client.createRepoInputs, 1)
+	types := make(map[string]string)
+	for _, entry := range client.createRepoInputs[0].Schema {
+		types[entry.Key] = entry.ValueType
+	}
+	require.Equal(t, map[string]string{"cpu_timestamp": "long", "ts": "long"}, types)
+
+	require.Len(t, client.createExportInputs, 1)
+	spec := client.createExportInputs[0].Spec.(*pipeline.ExportTsdbSpec)
+	require.Equal(t, "#ts", spec.Timestamp)
+	require.Equal(t, map[string]string{"timestamp": "#cpu_timestamp"}, spec.Fields)
+}
+
+func TestGetFieldType(t *testing.T) {
+	tests := []struct {
+		val      interface{}
+		expected string
+	}{
+		{int(1), "long"},
+		{int8(1), "long"},
+		{int16(1), "long"},
+		{int32(1), "long"},
+		{int64(1), "long"},
+		{uint(1), "long"},
+		{uint8(1), "long"},
+		{uint16(1), "long"},
+		{uint32(1), "long"},
+		{uint64(1), "long"},
+		{uint64(math.MaxInt64), "long"},
+		{uint64(math.MaxInt64) + 1, "long"},
+		{float32(1), "float"},
+		{float64(1), "float"},
+		{true, "boolean"},
+		{"value", "string"},
+		{[]byte("value"), "string"},
+		{nil, "string"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, getFieldType(tt.val), "%T(%v)", tt.val, tt.val)
+	}
+}
+
+func TestFormatValue_CapsUint64(t *testing.T) {
+	require.Equal(t, "9223372036854775807", formatValue(uint64(math.MaxInt64)))
+	require.Equal(t, "9223372036854775807", formatValue(uint64(math.MaxInt64)+1))
+	require.Equal(t, "9223372036854775807", formatValue(uint64(math.MaxUint64)))
+	require.Equal(t, "42", formatValue(uint(42)))
+}
+
+func TestWrite_ExportSyncInterval(t *testing.T) {
+	client := newMockPipelineClient()
+	start := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+
+	i := newPipeline()
+	i.Repo = "test"
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	i.now = func() time.Time { return now }
+
+	for n, offset := range []time.Duration{0, 30, 59, 61, 90, 120, 125} {
+		now = start.Add(offset * time.Second)
+		// a new field every time, so that every sync has an export to update
+		m, err := metric.New("cpu", map[string]string{"host": "h1"},
+			map[string]interface{}{fmt.Sprintf("f%d", n): 1.0}, now)
+		require.NoError(t, err)
+		require.NoError(t, i.Write([]telegraf.Metric{m}))
+	}
+	// synced at +0s, +61s and +125s
+	require.Equal(t, 3, len(client.createExportInputs))
+}
+
+func TestWrite_ExportsInBackground(t *testing.T) {
+	client := newMockPipelineClient()
+	client.exportBlock = make(chan struct{})
+
+	i := newTestPipeline()
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	i.startExporter()
+
+	written := make(chan error, 1)
+	go func() {
+		written <- i.Write(testutil.MockMetrics())
+	}()
+	select {
+	case err := <-written:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write waited for the exports")
+	}
+	require.Equal(t, 1, client.count("PostDataFromBytes"))
+
+	// the exports queued are synced before Close returns
+	close(client.exportBlock)
+	require.NoError(t, i.Close())
+	require.Equal(t, 1, client.count("CreateExport"))
+}
+
+func TestWrite_BackgroundClients(t *testing.T) {
+	client := newMockPipelineClient()
+	bg := newMockPipelineClient()
+	bgTsdb := newMockTsdbClient()
+
+	i := newTestPipeline()
+	i.Repo = "background_test"
+	i.ControlPlaneRPS = 0
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	i.bgClient = bg
+	i.bgTsdbClient = bgTsdb
+	i.startExporter()
+
+	// the pings of the keepalive are not bound by the deadline of a write
+	require.NoError(t, i.ping())
+	require.Equal(t, 1, bg.count("GetRepo"))
+	require.Equal(t, 0, client.count("GetRepo"))
+
+	// nor are the exports synced after the write
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.NoError(t, i.Close())
+	require.Equal(t, 1, client.count("PostDataFromBytes"))
+	require.Equal(t, 0, client.count("CreateExport"))
+	require.Equal(t, 1, bg.count("CreateExport"))
+	require.Equal(t, 1, bgTsdb.count("CreateSeries"))
+}
+
+func TestClose_StopsWorkers(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	i := newTestPipeline()
+	i.KeepaliveInterval.Duration = time.Millisecond
+	i.ControlPlaneRPS = 0
+	require.NoError(t, i.Init())
+	i.client = newMockPipelineClient()
+	i.tsdbClient = newMockTsdbClient()
+	i.startKeepalive()
+	i.startExporter()
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.NoError(t, i.Close())
+	require.Nil(t, i.keepalive)
+	require.Nil(t, i.exporter)
+
+	// goroutines exiting may still be counted for a moment
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.True(t, runtime.NumGoroutine() <= before,
+		"%d goroutines left running, %d before", runtime.NumGoroutine(), before)
+}
+
+func TestClose_ShutdownTimeout(t *testing.T) {
+	client := newMockPipelineClient()
+	client.exportBlock = make(chan struct{})
+
+	i := newTestPipeline()
+	i.ShutdownTimeout.Duration = 50 * time.Millisecond
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	i.startExporter()
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- i.Close()
+	}()
+	select {
+	case err := <-closed:
+		require.EqualError(t, err, "background work of repo test still running after 50ms")
+	case <-time.After(5 * time.Second):
+		t.Fatal("close waited past shutdown_timeout")
+	}
+	close(client.exportBlock)
+
+	i = newTestPipeline()
+	i.ShutdownTimeout.Duration = -time.Second
+	require.EqualError(t, i.Init(), "config.ShutdownTimeout must not be negative, got -1s")
+}
+
+func TestWrite_SchemaRetryInterval(t *testing.T) {
+	client := newMockPipelineClient()
+	client.repoSchema = []pipeline.RepoSchemaEntry{
+		{Key: "timestamp", ValueType: "long"},
+	}
+	writeErr := errors.New("E18111: schema does not match")
+	client.errs["PostDataFromBytes"] = writeErr
+	client.errs["UpdateRepo"] = errors.New("E403: permission denied")
+	start := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+
+	i := newTestPipeline()
+	i.AutoCreateRepo = true
+	i.SchemaRetryInterval.Duration = time.Minute
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	i.now = func() time.Time { return now }
+
+	tests := []struct {
+		offset  time.Duration
+		updates int
+		held    bool
+	}{
+		// failed at +0s, on hold for 1m
+		{0, 1, false},
+		{30 * time.Second, 1, true},
+		// failed again at +61s, on hold for 2m
+		{61 * time.Second, 2, false},
+		{150 * time.Second, 2, true},
+		{180 * time.Second, 2, true},
+		{182 * time.Second, 3, false},
+	}
+	for _, tt := range tests {
+		now = start.Add(tt.offset)
+		err := i.Write(testutil.MockMetrics())
+		require.Error(t, err)
+		require.Equal(t, tt.updates, client.count("UpdateRepo"), "at +%s", tt.offset)
+		if tt.held {
+			// the write error is returned while updates are on hold
+			require.Equal(t, writeErr, err)
+		}
+	}
+
+	// a successful update starts over
+	delete(client.errs, "UpdateRepo")
+	now = start.Add(time.Hour)
+	i.Write(testutil.MockMetrics())
+	require.Equal(t, 4, client.count("UpdateRepo"))
+	require.Equal(t, 0, i.schemaFailures)
+	require.True(t, i.schemaRetryAt.IsZero())
+}
+
+func TestSchemaRetryBackoff(t *testing.T) {
+	require.Equal(t, time.Duration(0), schemaRetryBackoff(0, 3))
+	require.Equal(t, time.Minute, schemaRetryBackoff(time.Minute, 1))
+	require.Equal(t, 4*time.Minute, schemaRetryBackoff(time.Minute, 3))
+	require.Equal(t, time.Hour, schemaRetryBackoff(time.Minute, 100))
+}
+
+func TestUpdateExport_OnlyGrownSeries(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["CreateExport"] = errors.New("E18301: export already exists")
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	parse := func(data string) tsdb.Points {
+		pts, err := tsdb.ParsePoints([]byte(data))
+		require.NoError(t, err)
+		return pts
+	}
+
+	require.NoError(t, i.updateExport(parse("cpu,host=h1 idle=1 1000000000\nmem,host=h1 used=1 1000000000\n")))
+	require.Equal(t, 2, client.count("CreateExport"))
+
+	// cpu and mem are unchanged, only disk is new
+	require.NoError(t, i.updateExport(parse("cpu,host=h1 idle=2 2000000000\nmem used=2 2000000000\ndisk,host=h1 free=1 2000000000\n")))
+	require.Equal(t, 3, client.count("CreateExport"))
+	require.Equal(t, "disk", client.createExportInputs[2].Spec.(*pipeline.ExportTsdbSpec).SeriesName)
+
+	// a new cpu field updates the cpu export, with the keys seen before
+	require.NoError(t, i.updateExport(parse("cpu,host=h1 busy=1 3000000000\n")))
+	require.Equal(t, 4, client.count("CreateExport"))
+	require.Equal(t, 4, client.count("UpdateExport"))
+	spec := client.updateExportInputs[3].Spec.(*pipeline.ExportTsdbSpec)
+	require.Equal(t, "cpu", spec.SeriesName)
+	require.Equal(t, "#cpu_idle", spec.Fields["idle"])
+	require.Equal(t, "#cpu_busy", spec.Fields["busy"])
+	require.Equal(t, "#cpu_host", spec.Tags["host"])
+
+	// a failed sync is tried again
+	client.errs["CreateExport"] = errors.New("E500: internal error")
+	require.Error(t, i.updateExport(parse("mem,host=h1 free=1 4000000000\n")))
+	delete(client.errs, "CreateExport")
+	require.NoError(t, i.updateExport(parse("mem,host=h1 free=1 5000000000\n")))
+	require.Equal(t, 6, client.count("CreateExport"))
+}
+
+func TestCreateOrUpdateExport_SeriesExists(t *testing.T) {
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetFlags(0)
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetFlags(flags)
+		log.SetOutput(os.Stderr)
+	}()
+
+	client := newMockPipelineClient()
+	tsdbClient := newMockTsdbClient()
+	tsdbClient.errs["CreateSeries"] = errors.New("E6302: series already exists")
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = tsdbClient
+	require.NoError(t, i.createOrUpdateExport(i.writeClients(), "cpu", nil, nil))
+	require.Equal(t, 1, client.count("CreateExport"))
+	require.Equal(t, "D! series cpu of repo test already exists\n", buf.String())
+}
+
+func TestCreateOrUpdateExport(t *testing.T) {
+	tests := []struct {
+		name            string
+		createSeriesErr error
+		createErr       error
+		updateErr       error
+		expectErr       bool
+		expectUpdate    bool
+		seriesFails     bool
+	}{
+		{name: "created"},
+		{
+			name:            "series exists",
+			createSeriesErr: errors.New("E6302: series already exists"),
+		},
+		{
+			name:            "series error",
+			createSeriesErr: errors.New("E6301: repo does not exist"),
+			expectErr:       true,
+			seriesFails:     true,
+		},
+		{
+			name:         "export exists",
+			createErr:    errors.New("E18301: export already exists"),
+			expectUpdate: true,
+		},
+		{
+			name:         "update fails",
+			createErr:    errors.New("E18301: export already exists"),
+			updateErr:    errors.New("E18305: invalid export spec"),
+			expectErr:    true,
+			expectUpdate: true,
+		},
+		{
+			name:      "create fails",
+			createErr: errors.New("E18300: internal error"),
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		client := newMockPipelineClient()
+		client.errs["CreateExport"] = tt.createErr
+		client.errs["UpdateExport"] = tt.updateErr
+		tsdbClient := newMockTsdbClient()
+		tsdbClient.errs["CreateSeries"] = tt.createSeriesErr
+
+		i := newPipeline()
+		i.Repo = "test"
+		i.client = client
+		i.tsdbClient = tsdbClient
+
+		err := i.createOrUpdateExport(i.writeClients(), "cpu",
+			map[string]struct{}{"host": {}},
+			map[string]struct{}{"value": {}})
+		if tt.expectErr {
+			require.Error(t, err, tt.name)
+		} else {
+			require.NoError(t, err, tt.name)
+		}
+
+		require.Len(t, tsdbClient.createSeriesInputs, 1, tt.name)
+		require.Equal(t, "cpu", tsdbClient.createSeriesInputs[0].SeriesName, tt.name)
+		if tt.seriesFails {
+			require.Equal(t, 0, client.count("CreateExport"), tt.name)
+			continue
+		}
+		require.Equal(t, 1, client.count("CreateExport"), tt.name)
+
+		spec := client.createExportInputs[0].Spec.(*pipeline.ExportTsdbSpec)
+		require.Equal(t, map[string]string{"host": "#cpu_host"}, spec.Tags, tt.name)
+		require.Equal(t, map[string]string{"value": "#cpu_value"}, spec.Fields, tt.name)
+
+		if tt.expectUpdate {
+			require.Equal(t, 1, client.count("UpdateExport"), tt.name)
+			require.Equal(t, "export_cpu_toTSDB", client.updateExportInputs[0].ExportName, tt.name)
+		} else {
+			require.Equal(t, 0, client.count("UpdateExport"), tt.name)
+		}
+	}
+}
+
+func TestCreateOrUpdateExport_TsdbRepo(t *testing.T) {
+	client := newMockPipelineClient()
+	client.errs["CreateExport"] = errors.New("E18301: export already exists")
+	tsdbClient := newMockTsdbClient()
+
+	i := newTestPipeline()
+	i.TsdbRepo = "test_tsdb"
+	i.client = client
+	i.tsdbClient = tsdbClient
+
+	require.NoError(t, i.createOrUpdateExport(i.writeClients(), "cpu", nil, nil))
+	require.Equal(t, "test_tsdb", tsdbClient.createSeriesInputs[0].RepoName)
+	require.Equal(t, "test", client.createExportInputs[0].RepoName)
+	spec := client.createExportInputs[0].Spec.(*pipeline.ExportTsdbSpec)
+	require.Equal(t, "test_tsdb", spec.DestRepoName)
+	spec = client.updateExportInputs[0].Spec.(*pipeline.ExportTsdbSpec)
+	require.Equal(t, "test_tsdb", spec.DestRepoName)
+}
+
+func TestCreateOrUpdateExport_Whence(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.ExportWhence = "newest"
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	require.NoError(t, i.Init())
+
+	require.NoError(t, i.createOrUpdateExport(i.writeClients(), "cpu", nil, nil))
+	require.Equal(t, "newest", client.createExportInputs[0].Whence)
+
+	i.ExportWhence = "latest"
+	require.Error(t, i.Init())
+}
+
+func TestCreateOrUpdateExport_RetentionOverrides(t *testing.T) {
+	tsdbClient := newMockTsdbClient()
+
+	i := newTestPipeline()
+	i.RetentionOverrides = map[string]string{"cpu": "30d", "mem": "1d"}
+	i.client = newMockPipelineClient()
+	i.tsdbClient = tsdbClient
+	require.NoError(t, i.Init())
+
+	for _, series := range []string{"cpu", "mem", "disk"} {
+		require.NoError(t, i.createOrUpdateExport(i.writeClients(), series, nil, nil))
+	}
+	retentions := make(map[string]string)
+	for _, input := range tsdbClient.createSeriesInputs {
+		retentions[input.SeriesName] = input.Retention
+	}
+	require.Equal(t, map[string]string{"cpu": "30d", "mem": "1d", "disk": "7d"}, retentions)
+
+	i.RetentionOverrides["mem"] = "31d"
+	require.Error(t, i.Init())
+}
+
+func TestExtractSchemaFromPoints_DedupesTags(t *testing.T) {
+	var buf bytes.Buffer
+	for n := 0; n < 100; n++ {
+		fmt.Fprintf(&buf, "cpu,host=h%d,dc=nb value=%d %d\n", n%3, n, 1000000000+n)
+	}
+	buf.WriteString("mem,host=h1 used=1i 1000000000\n")
+
+	pts, err := tsdb.ParsePoints(buf.Bytes())
+	require.NoError(t, err)
+
+	tags, fields := extractSchemaFromPoints(pts, newTestPipeline().fieldType, "_")
+	require.Len(t, tags, 3)
+	require.Contains(t, tags, "cpu_host")
+	require.Contains(t, tags, "cpu_dc")
+	require.Contains(t, tags, "mem_host")
+	require.Equal(t, map[string]string{"cpu_value": "float", "mem_used": "long"}, fields)
+}
+
+func newTestPipeline() *Pipeline {
+	i := newPipeline()
+	i.URL = "https://pipeline.qiniu.com"
+	i.Repo = "test"
+	i.AK = "ak"
+	i.SK = "sk"
+	// tests connecting to unreachable endpoints would fail the check
+	i.CheckRepoOnConnect = false
+	i.StartupJitter.Duration = 0
+	return i
+}
+
+func TestInit(t *testing.T) {
+	i := newTestPipeline()
+	i.URL = " https://pipeline.qiniu.com/ "
+	require.NoError(t, i.Init())
+	require.Equal(t, "https://pipeline.qiniu.com", i.URL)
+	i.URL = "http://[::1]:8080"
+	require.NoError(t, i.Init())
+
+	tests := []struct {
+		field  string
+		modify func(*Pipeline)
+	}{
+		{"URL", func(i *Pipeline) { i.URL = "" }},
+		{"URL", func(i *Pipeline) { i.URL = "ftp://pipeline.qiniu.com" }},
+		{"URL", func(i *Pipeline) { i.URL = "http://::1:8080" }},
+		{"Repo", func(i *Pipeline) { i.Repo = "" }},
+		{"AK", func(i *Pipeline) { i.AK = "" }},
+		{"SK", func(i *Pipeline) { i.SK = "" }},
+		{"Timeout", func(i *Pipeline) { i.Timeout.Duration = -time.Second }},
+		{"ConnectTimeout", func(i *Pipeline) { i.ConnectTimeout.Duration = -time.Second }},
+		{"MaxBatchMetrics", func(i *Pipeline) { i.MaxBatchMetrics = -1 }},
+		{"MaxBatchBytes", func(i *Pipeline) { i.MaxBatchBytes = -1 }},
+		{"MaxIdleConns", func(i *Pipeline) { i.MaxIdleConns = -1 }},
+		{"MaxIdleConnsPerHost", func(i *Pipeline) { i.MaxIdleConnsPerHost = -1 }},
+	}
+	for _, tt := range tests {
+		i := newTestPipeline()
+		tt.modify(i)
+		err := i.Init()
+		require.Error(t, err, tt.field)
+		require.Contains(t, err.Error(), "config."+tt.field)
+	}
+}
+
+func TestInit_CredentialsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	akFile := filepath.Join(dir, "ak")
+	require.NoError(t, ioutil.WriteFile(akFile, []byte("file_ak\n"), 0600))
+	os.Setenv("PIPELINE_TEST_SK", "env_sk")
+	defer os.Unsetenv("PIPELINE_TEST_SK")
+
+	i := newTestPipeline()
+	i.AK = ""
+	i.AKFile = akFile
+	i.SK = "$PIPELINE_TEST_SK"
+	require.NoError(t, i.Init())
+	require.Equal(t, "file_ak", i.ak)
+	require.Equal(t, "env_sk", i.sk)
+
+	i.AKFile = filepath.Join(dir, "missing")
+	require.Error(t, i.Init())
+}
+
+func TestWrite_LogsWithLevel(t *testing.T) {
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetFlags(0)
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetFlags(flags)
+		log.SetOutput(os.Stderr)
+	}()
+
+	client := newMockPipelineClient()
+	client.errs["PostDataFromBytes"] = errors.New("E18102: repo does not exist")
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+	tsdbClient := newMockTsdbClient()
+	tsdbClient.errs["CreateSeries"] = errors.New("E6301: repo does not exist")
+
+	i := newTestPipeline()
+	i.AutoCreateRepo = true
+	i.client = client
+	i.tsdbClient = tsdbClient
+
+	// the series could not be created, the points are kept to try again
+	require.EqualError(t, i.Write(testutil.MockMetrics()), "E6301: repo does not exist")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.NotEmpty(t, lines)
+	for _, line := range lines {
+		require.Regexp(t, `^[DIWE]! `, line)
+	}
+	require.Contains(t, buf.String(), "I! create pipeline repo test success")
+	require.Contains(t, buf.String(), "E! create series test1 for repo test fail")
+}
+
+// malformedMetric serializes to a line that is not valid line protocol.
+type malformedMetric struct {
+	telegraf.Metric
+	line string
+}
+
+func (m malformedMetric) Len() int {
+	return len(m.line)
+}
+
+func (m malformedMetric) Serialize() []byte {
+	return []byte(m.line)
+}
+
+func (m malformedMetric) SerializeTo(dst []byte) int {
+	return copy(dst, m.line)
+}
+
+func TestWrite_InvalidPoints(t *testing.T) {
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetFlags(0)
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetFlags(flags)
+		log.SetOutput(os.Stderr)
+	}()
+
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	m, err := metric.New("cpu", nil, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	err = i.Write([]telegraf.Metric{malformedMetric{m, "cpu value=\"unterminated 1\n"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid points format for repo test: ")
+	require.True(t, len(err.Error()) > len("invalid points format for repo test: "))
+	require.Contains(t, buf.String(), "E! "+err.Error())
+	require.Empty(t, client.posts)
+}
+
+func TestWrite_RedactFields(t *testing.T) {
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetFlags(0)
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetFlags(flags)
+		log.SetOutput(os.Stderr)
+	}()
+
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.DebugMeasurements = []string{"login"}
+	i.RedactFields = []string{"password"}
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	m, err := metric.New("login", map[string]string{"host": "h1"},
+		map[string]interface{}{"password": "s3cret", "attempts": int64(1)}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m}))
+
+	require.Contains(t, buf.String(), `password="REDACTED"`)
+	require.Contains(t, buf.String(), "attempts=1i")
+	require.NotContains(t, buf.String(), "s3cret")
+	// the real value is posted
+	require.Len(t, client.posts, 1)
+	require.Contains(t, string(client.posts[0]), "login_password=s3cret\t")
+
+	buf.Reset()
+	i.DryRun = true
+	require.NoError(t, i.Write([]telegraf.Metric{m}))
+	require.Contains(t, buf.String(), "login_password=REDACTED\t")
+	require.NotContains(t, buf.String(), "s3cret")
+
+	// errors quoting the points are redacted too
+	_, err = tsdb.ParsePoints([]byte("login,host=h1 attempts=1i,password=\"s3\\\"cret\" bogus\n"))
+	require.Error(t, err)
+	require.Equal(t, `unable to parse 'login,host=h1 attempts=1i,password="REDACTED" bogus': bad timestamp`,
+		i.redactLine(err.Error()))
+}
+
+func TestWrite_DebugMeasurements(t *testing.T) {
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetFlags(0)
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetFlags(flags)
+		log.SetOutput(os.Stderr)
+	}()
+
+	m1, err := metric.New("nginx", map[string]string{"host": "h1"}, map[string]interface{}{"requests": int64(1)}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": "h1"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+
+	i := newTestPipeline()
+	i.client = newMockPipelineClient()
+	i.tsdbClient = newMockTsdbClient()
+	require.NoError(t, i.Write([]telegraf.Metric{m1, m2}))
+	require.NotContains(t, buf.String(), "D! ")
+
+	i.DebugMeasurements = []string{"nginx"}
+	require.NoError(t, i.Write([]telegraf.Metric{m1, m2}))
+	require.Contains(t, buf.String(), "D! point of repo test: nginx,host=h1 requests=1i 1000000000")
+	require.NotContains(t, buf.String(), "cpu,host=h1")
+}
+
+func TestWrite_DryRun(t *testing.T) {
+	client := newMockPipelineClient()
+	tsdbClient := newMockTsdbClient()
+
+	i := newTestPipeline()
+	i.DryRun = true
+	i.AutoCreateRepo = true
+	i.client = client
+	i.tsdbClient = tsdbClient
+
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Empty(t, client.calls)
+	require.Empty(t, tsdbClient.calls)
+}
+
+func TestSplitRecords(t *testing.T) {
+	data := "a=1\ttimestamp=1\nb=22\ttimestamp=2\nc=333\ttimestamp=3\n"
+	require.Equal(t, []string{data}, splitRecords(data, 0))
+	require.Equal(t, []string{data}, splitRecords(data, len(data)))
+	require.Equal(t, []string{
+		"a=1\ttimestamp=1\nb=22\ttimestamp=2\n",
+		"c=333\ttimestamp=3\n",
+	}, splitRecords(data, 40))
+	// records larger than the limit are not broken up
+	require.Equal(t, []string{
+		"a=1\ttimestamp=1\n",
+		"b=22\ttimestamp=2\n",
+		"c=333\ttimestamp=3\n",
+	}, splitRecords(data, 4))
+}
+
+func TestWrite_MaxRequestBytes(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.MaxRequestBytes = 64
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	var metrics []telegraf.Metric
+	for n := 0; n < 10; n++ {
+		m, err := metric.New("cpu",
+			map[string]string{"host": "h1"},
+			map[string]interface{}{"value": float64(n)},
+			time.Unix(int64(n), 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+
+	require.True(t, len(client.posts) > 1)
+	records := 0
+	for _, post := range client.posts {
+		require.True(t, len(post) <= 64, string(post))
+		require.True(t, bytes.HasSuffix(post, []byte("\n")), string(post))
+		records += bytes.Count(post, []byte("\n"))
+	}
+	require.Equal(t, 10, records)
+}
+
+func TestWrite_MaxBatch(t *testing.T) {
+	newMetric := func(value interface{}) telegraf.Metric {
+		m, err := metric.New("cpu",
+			map[string]string{"host": "h1"},
+			map[string]interface{}{"value": value},
+			time.Unix(1, 0))
+		require.NoError(t, err)
+		return m
+	}
+	var metrics []telegraf.Metric
+	for n := 0; n < 10; n++ {
+		metrics = append(metrics, newMetric(float64(n)))
+	}
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.MaxBatchMetrics = 4
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	require.NoError(t, i.Write(metrics))
+	require.Len(t, client.posts, 3)
+	require.Equal(t, 4, bytes.Count(client.posts[0], []byte("\n")))
+	require.Equal(t, 2, bytes.Count(client.posts[2], []byte("\n")))
+
+	// a metric larger than max_batch_bytes on its own is dropped
+	client = newMockPipelineClient()
+	i = newTestPipeline()
+	i.MaxBatchBytes = 2 * metrics[0].Len()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	huge := newMetric(strings.Repeat("x", 1024*1024))
+	require.NoError(t, i.Write(append([]telegraf.Metric{huge}, metrics...)))
+	require.Len(t, client.posts, 5)
+	records := 0
+	for _, post := range client.posts {
+		require.NotContains(t, string(post), "xxx")
+		records += bytes.Count(post, []byte("\n"))
+	}
+	require.Equal(t, 10, records)
+	require.Equal(t, int64(1), i.repoStats().PointsDropped.Get())
+
+	// a failing batch fails the write
+	client = newMockPipelineClient()
+	client.errs["PostDataFromBytes"] = errors.New("E18111: schema does not match")
+	i = newTestPipeline()
+	i.MaxBatchMetrics = 4
+	i.OnFieldConflict = "error"
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	require.EqualError(t, i.Write(metrics), "E18111: schema does not match")
+	require.Len(t, client.posts, 1)
+}
+
+func TestWrite_SortPoints(t *testing.T) {
+	newMetrics := func() []telegraf.Metric {
+		var metrics []telegraf.Metric
+		for n, sec := range []int64{3, 1, 2, 1} {
+			m, err := metric.New("cpu",
+				map[string]string{"host": "h1"},
+				map[string]interface{}{"value": float64(n)},
+				time.Unix(sec, 0))
+			require.NoError(t, err)
+			metrics = append(metrics, m)
+		}
+		return metrics
+	}
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	require.NoError(t, i.Write(newMetrics()))
+	require.Equal(t, []string{
+		"cpu_host=h1\tcpu_value=0\ttimestamp=3000000000",
+		"cpu_host=h1\tcpu_value=1\ttimestamp=1000000000",
+		"cpu_host=h1\tcpu_value=2\ttimestamp=2000000000",
+		"cpu_host=h1\tcpu_value=3\ttimestamp=1000000000",
+	}, strings.Split(strings.TrimSuffix(string(client.posts[0]), "\n"), "\n"))
+
+	client = newMockPipelineClient()
+	i.client = client
+	i.SortPoints = true
+	require.NoError(t, i.Write(newMetrics()))
+	// points at the same time keep their order
+	require.Equal(t, []string{
+		"cpu_host=h1\tcpu_value=1\ttimestamp=1000000000",
+		"cpu_host=h1\tcpu_value=3\ttimestamp=1000000000",
+		"cpu_host=h1\tcpu_value=2\ttimestamp=2000000000",
+		"cpu_host=h1\tcpu_value=0\ttimestamp=3000000000",
+	}, strings.Split(strings.TrimSuffix(string(client.posts[0]), "\n"), "\n"))
+}
+
+func TestWrite_Spill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := newMockPipelineClient()
+	client.errs["PostDataFromBytes"] = errors.New("pandora error: StatusCode=503, ErrorMessage=service unavailable")
+
+	i := newTestPipeline()
+	i.SpillDirectory = dir
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	// the failed write is spilled rather than left in the buffer
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, client.posts, 1)
+	spilled := string(client.posts[0])
+	files, err := ioutil.ReadDir(filepath.Join(dir, "test"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// and replayed once a write succeeds
+	delete(client.errs, "PostDataFromBytes")
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, client.posts, 3)
+	require.Equal(t, spilled, string(client.posts[2]))
+	files, err = ioutil.ReadDir(filepath.Join(dir, "test"))
+	require.NoError(t, err)
+	require.Len(t, files, 0)
+}
+
+func TestWrite_SpillExports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := newMockPipelineClient()
+	client.errs["PostDataFromBytes"] = errors.New("pandora error: StatusCode=503, ErrorMessage=service unavailable")
+
+	i := newTestPipeline()
+	i.Repo = "spill_exports_test"
+	i.SpillDirectory = dir
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	disk, err := metric.New("disk", map[string]string{"path": "/"},
+		map[string]interface{}{"used": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{disk}))
+	require.Len(t, client.createExportInputs, 0)
+
+	// the series only found in the spilled points is exported once they are
+	// replayed
+	delete(client.errs, "PostDataFromBytes")
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	require.Len(t, client.posts, 3)
+	require.Equal(t, string(client.posts[0]), string(client.posts[2]))
+	var series []string
+	for _, input := range client.createExportInputs {
+		series = append(series, input.Spec.(*pipeline.ExportTsdbSpec).SeriesName)
+	}
+	sort.Strings(series)
+	require.Equal(t, []string{"disk", "test1"}, series)
+}
+
+func TestWrite_SpillPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := newMockPipelineClient()
+	client.postErrSeq = []error{nil, errors.New("pandora error: StatusCode=503, ErrorMessage=service unavailable")}
+
+	i := newTestPipeline()
+	i.Repo = "spill_partial_test"
+	i.SpillDirectory = dir
+	i.MaxRequestBytes = 1
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	var metrics []telegraf.Metric
+	for n := 0; n < 2; n++ {
+		m, err := metric.New("cpu", map[string]string{}, map[string]interface{}{"value": float64(n)}, time.Unix(int64(n), 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+	require.Len(t, client.posts, 2)
+
+	// only the point of the chunk failing is spilled, and replayed
+	require.NoError(t, i.Write(metrics[:1]))
+	require.Len(t, client.posts, 4)
+	require.Equal(t, string(client.posts[1]), string(client.posts[3]))
+}
+
+func TestWrite_SpillUnavailable(t *testing.T) {
+	f, err := ioutil.TempFile("", "pipeline")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	unavailable := errors.New("pandora error: StatusCode=503, ErrorMessage=service unavailable")
+	client := newMockPipelineClient()
+	client.errs["PostDataFromBytes"] = unavailable
+
+	// without spill_directory the failed write is left in the buffer
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	require.Equal(t, unavailable, i.Write(testutil.MockMetrics()))
+
+	// as it is when it cannot be spilled
+	i = newTestPipeline()
+	i.SpillDirectory = f.Name()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	require.Equal(t, unavailable, i.Write(testutil.MockMetrics()))
+	require.Len(t, client.posts, 2)
+}
+
+func TestWrite_PayloadStats(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.Repo = "payload_stats_test"
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	var metrics []telegraf.Metric
+	for n := 0; n < 3; n++ {
+		m, err := metric.New("cpu", map[string]string{"host": "h1"},
+			map[string]interface{}{"value": float64(n)}, time.Unix(int64(n), 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+	require.NoError(t, i.Write(metrics[:1]))
+	require.Len(t, client.posts, 2)
+
+	stats := i.repoStats()
+	first, second := len(client.posts[0]), len(client.posts[1])
+	require.Equal(t, int64(first+second)/2, stats.PayloadBytes.Get())
+	require.Equal(t, int64(2), stats.PayloadRecords.Get())
+	require.Equal(t, int64(first), stats.PayloadBytesMax.Get())
+}
+
+func TestWrite_DefaultTags(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.DefaultTags = map[string]string{"dc": "nb", "cluster": "c1"}
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	m1, err := metric.New("cpu", map[string]string{"host": "h1"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("mem", map[string]string{"host": "h1", "dc": "sh"}, map[string]interface{}{"value": 2.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m1, m2}))
+
+	require.Len(t, client.posts, 1)
+	data := string(client.posts[0])
+	for _, kv := range []string{"cpu_dc=nb\t", "cpu_cluster=c1\t", "mem_dc=sh\t", "mem_cluster=c1\t"} {
+		require.Contains(t, data, kv)
+	}
+	require.NotContains(t, data, "mem_dc=nb")
+}
+
+func TestWrite_DropTags(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.DropTags = []string{"pid"}
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	m, err := metric.New("cpu", map[string]string{"host": "h1", "pid": "42"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m}))
+
+	require.Len(t, client.posts, 1)
+	require.Contains(t, string(client.posts[0]), "cpu_host=h1\t")
+	require.NotContains(t, string(client.posts[0]), "pid")
+
+	require.Len(t, client.createExportInputs, 1)
+	spec := client.createExportInputs[0].Spec.(*pipeline.ExportTsdbSpec)
+	require.Equal(t, map[string]string{"host": "#cpu_host"}, spec.Tags)
+}
+
+func TestWrite_FieldRename(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.FieldRename = map[string]string{"load.1": "load1"}
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	m, err := metric.New("system", map[string]string{"host": "h1"}, map[string]interface{}{"load.1": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m}))
+
+	require.Len(t, client.posts, 1)
+	require.Contains(t, string(client.posts[0]), "system_load1=1\t")
+	require.NotContains(t, string(client.posts[0]), "load.1")
+
+	require.Len(t, client.createExportInputs, 1)
+	spec := client.createExportInputs[0].Spec.(*pipeline.ExportTsdbSpec)
+	require.Equal(t, map[string]string{"load1": "#system_load1"}, spec.Fields)
+}
+
+func TestWrite_FieldInclude(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	// fields are matched by their new name
+	i.FieldRename = map[string]string{"load.1": "load1"}
+	i.FieldInclude = []string{"load*"}
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	m1, err := metric.New("system", map[string]string{"host": "h1"},
+		map[string]interface{}{"load.1": 1.0, "uptime": int64(10)}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("system", map[string]string{"host": "h1"},
+		map[string]interface{}{"uptime": int64(20)}, time.Unix(2, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m1, m2}))
+
+	require.Len(t, client.posts, 1)
+	require.Equal(t, "system_host=h1\tsystem_load1=1\ttimestamp=1000000000\n", string(client.posts[0]))
+
+	require.Len(t, client.createExportInputs, 1)
+	spec := client.createExportInputs[0].Spec.(*pipeline.ExportTsdbSpec)
+	require.Equal(t, map[string]string{"load1": "#system_load1"}, spec.Fields)
+}
+
+func TestWrite_FieldExclude(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.FieldExclude = []string{"uptime*"}
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	m, err := metric.New("system", map[string]string{"host": "h1"},
+		map[string]interface{}{"load1": 1.0, "uptime": int64(10), "uptime_format": "1 day"}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m}))
+
+	require.Len(t, client.posts, 1)
+	require.NotContains(t, string(client.posts[0]), "uptime")
+
+	require.Len(t, client.createExportInputs, 1)
+	spec := client.createExportInputs[0].Spec.(*pipeline.ExportTsdbSpec)
+	require.Equal(t, map[string]string{"load1": "#system_load1"}, spec.Fields)
+}
+
+// tagsOnlyMetric is a metric left without fields, which metric.New refuses
+// to build.
+type tagsOnlyMetric struct {
+	telegraf.Metric
+}
+
+func (m tagsOnlyMetric) Fields() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func TestWrite_Empty(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	require.NoError(t, i.Write(nil))
+	require.NoError(t, i.Write([]telegraf.Metric{}))
+	require.Empty(t, client.posts)
+}
+
+func TestWrite_SkipsPointsWithoutFields(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	m1, err := metric.New("cpu", map[string]string{"host": "h1"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m2, err := metric.New("mem", map[string]string{"host": "h1"}, map[string]interface{}{"value": 2.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+
+	// nothing is posted for a batch of points without fields
+	require.NoError(t, i.Write([]telegraf.Metric{tagsOnlyMetric{m2}}))
+	require.Empty(t, client.posts)
+
+	require.NoError(t, i.Write([]telegraf.Metric{m1, tagsOnlyMetric{m2}}))
+	require.Len(t, client.posts, 1)
+	require.Contains(t, string(client.posts[0]), "cpu_value=1\t")
+	require.NotContains(t, string(client.posts[0]), "mem")
+}
+
+func TestWrite_RepoTag(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.RepoTag = "tenant"
+	// a single writer keeps the order of the posts across repos
+	i.WriteConcurrency = 1
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	var metrics []telegraf.Metric
+	for _, tenant := range []string{"a", "b", "a", ""} {
+		tags := map[string]string{"host": "h1"}
+		if tenant != "" {
+			tags["tenant"] = tenant
+		}
+		m, err := metric.New("cpu", tags,
+			map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+
+	require.Equal(t, 3, client.count("PostDataFromBytes"))
+	var repos []string
+	for _, input := range client.postInputs {
+		repos = append(repos, input.RepoName)
+		require.NotContains(t, string(input.Buffer), "tenant")
+	}
+	require.Equal(t, []string{"a", "b", "test"}, repos)
+	require.Equal(t, 2, strings.Count(string(client.postInputs[0].Buffer), "cpu_host=h1"))
+	// the metrics handed to the output are left untouched
+	require.True(t, metrics[0].HasTag("tenant"))
+}
+
+func TestWrite_MeasurementRepos(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.MeasurementRepos = map[string]string{"cpu": "hosts", "mem": "hosts", "syslog": "logs"}
+	// a single writer keeps the order of the posts across repos
+	i.WriteConcurrency = 1
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	var metrics []telegraf.Metric
+	for _, name := range []string{"cpu", "syslog", "mem", "disk"} {
+		m, err := metric.New(name, map[string]string{"host": "h1"},
+			map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+
+	require.Equal(t, 3, client.count("PostDataFromBytes"))
+	var repos []string
+	for _, input := range client.postInputs {
+		repos = append(repos, input.RepoName)
+	}
+	require.Equal(t, []string{"hosts", "logs", "test"}, repos)
+	require.Contains(t, string(client.postInputs[0].Buffer), "cpu_host=h1")
+	require.Contains(t, string(client.postInputs[0].Buffer), "mem_host=h1")
+	require.Contains(t, string(client.postInputs[1].Buffer), "syslog_host=h1")
+	require.Contains(t, string(client.postInputs[2].Buffer), "disk_host=h1")
+}
+
+func TestWrite_Logdb(t *testing.T) {
+	client := newMockPipelineClient()
+	logdbClient := &mockLogdbClient{}
+
+	i := newTestPipeline()
+	i.LogdbRepo = "logs"
+	i.LogdbMeasurements = []string{"sys*"}
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	i.logdbClient = logdbClient
+
+	m1, err := metric.New("syslog", map[string]string{"host": "h1", "app.name": "sshd"},
+		map[string]interface{}{"message": "accepted", "severity": int64(6)}, time.Unix(1, 5))
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": "h1"},
+		map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{m1, m2}))
+
+	require.Len(t, logdbClient.inputs, 1)
+	require.Equal(t, "logs", logdbClient.inputs[0].RepoName)
+	require.Equal(t, []map[string]interface{}{{
+		"measurement": "syslog",
+		"host":        "h1",
+		"app_name":    "sshd",
+		"message":     "accepted",
+		"severity":    int64(6),
+		"timestamp":   "1970-01-01T00:00:01.000000005Z",
+	}}, []map[string]interface{}(logdbClient.inputs[0].Logs))
+
+	require.Equal(t, 1, client.count("PostDataFromBytes"))
+	data := string(client.postInputs[0].Buffer)
+	require.Contains(t, data, "cpu_value=1")
+	require.NotContains(t, data, "syslog")
+
+	// a failing send does not hold back the repo
+	logdbClient.sendErr = errors.New("E18000: repo does not exist")
+	err = i.Write([]telegraf.Metric{m1, m2})
+	require.EqualError(t, err, "send logs to logdb repo logs fail: E18000: repo does not exist")
+	require.Equal(t, 2, client.count("PostDataFromBytes"))
+
+	i = newTestPipeline()
+	i.LogdbRepo = "logs"
+	require.EqualError(t, i.Init(), "config.LogdbMeasurements must be set along config.LogdbRepo")
+}
+
+func TestWrite_RepoTagConcurrency(t *testing.T) {
+	client := newMockPipelineClient()
+	client.postErrs["r2"] = errors.New("E18102: repo does not exist")
+	client.postErrs["r4"] = errors.New("E18102: repo does not exist")
+	client.errs["GetRepo"] = errors.New("E18102: repo does not exist")
+	client.errs["CreateRepo"] = errors.New("E18000: create repo denied")
+
+	i := newTestPipeline()
+	i.RepoTag = "tenant"
+	i.AutoCreateRepo = true
+	i.WriteConcurrency = 3
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	var metrics []telegraf.Metric
+	for n := 0; n < 6; n++ {
+		for _, value := range []float64{1, 2} {
+			m, err := metric.New("cpu",
+				map[string]string{"tenant": fmt.Sprintf("r%d", n)},
+				map[string]interface{}{"value": value}, time.Unix(int64(value), 0))
+			require.NoError(t, err)
+			metrics = append(metrics, m)
+		}
+	}
+	err := i.Write(metrics)
+	require.Error(t, err)
+	require.Equal(t, 2, strings.Count(err.Error(), "E18000"))
+	require.Equal(t, 2, client.count("CreateRepo"))
+
+	// every repo got its points despite the failing ones
+	posts := make(map[string]string)
+	for _, input := range client.postInputs {
+		posts[input.RepoName] += string(input.Buffer)
+	}
+	require.Len(t, posts, 6)
+	for repo, data := range posts {
+		require.Equal(t, 2, strings.Count(data, "cpu_value="), repo)
+	}
+}
+
+func TestUpdateSchema_DefaultTagType(t *testing.T) {
+	client := newMockPipelineClient()
+	client.repoSchema = []pipeline.RepoSchemaEntry{
+		{Key: "timestamp", ValueType: "long"},
+	}
+
+	i := newTestPipeline()
+	i.DefaultTagType = "long"
+	require.NoError(t, i.Init())
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	pts, err := tsdb.ParsePoints([]byte("cpu,core=1 value=1 1000000000\n"))
+	require.NoError(t, err)
+	require.NoError(t, i.updateSchema(pts))
+
+	require.Len(t, client.updateRepoInputs, 1)
+	types := make(map[string]string)
+	for _, entry := range client.updateRepoInputs[0].Schema {
+		types[entry.Key] = entry.ValueType
+	}
+	require.Equal(t, "long", types["cpu_core"])
+	require.Equal(t, "float", types["cpu_value"])
+}
+
+func TestInitError_InvalidDefaultTagType(t *testing.T) {
+	i := newTestPipeline()
+	i.DefaultTagType = "boolean"
+	require.Error(t, i.Init())
+}
+
+func TestWrite_FloatNaNHandling(t *testing.T) {
+	m, err := metric.New("cpu", map[string]string{"host": "h1"},
+		map[string]interface{}{"idle": math.NaN(), "user": math.Inf(1), "value": 1.0},
+		time.Unix(1, 0))
+	require.NoError(t, err)
+
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{"drop", "cpu_host=h1\tcpu_value=1\ttimestamp=1000000000\n"},
+		{"zero", "cpu_host=h1\tcpu_idle=0\tcpu_user=0\tcpu_value=1\ttimestamp=1000000000\n"},
+	}
+	for _, tt := range tests {
+		client := newMockPipelineClient()
+		i := newTestPipeline()
+		i.FloatNaNHandling = tt.mode
+		i.client = client
+		i.tsdbClient = newMockTsdbClient()
+
+		require.NoError(t, i.Write([]telegraf.Metric{m}), tt.mode)
+		require.Len(t, client.posts, 1, tt.mode)
+		record := strings.Split(strings.TrimSuffix(string(client.posts[0]), "\n"), "\t")
+		expected := strings.Split(strings.TrimSuffix(tt.expected, "\n"), "\t")
+		require.ElementsMatch(t, expected, record, tt.mode)
+	}
+
+	client := newMockPipelineClient()
+	i := newTestPipeline()
+	i.FloatNaNHandling = "error"
+	i.client = client
+	require.Error(t, i.Write([]telegraf.Metric{m}))
+	require.Empty(t, client.posts)
+}
+
+func TestWrite_NaNOnlyPointDropped(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.Repo = "dropped_test"
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	nan, err := metric.New("cpu", map[string]string{"host": "h1"},
+		map[string]interface{}{"idle": math.NaN()}, time.Unix(1, 0))
+	require.NoError(t, err)
+	m, err := metric.New("cpu", map[string]string{"host": "h1"},
+		map[string]interface{}{"idle": 1.0}, time.Unix(2, 0))
+	require.NoError(t, err)
+	require.NoError(t, i.Write([]telegraf.Metric{nan, m}))
+
+	require.Len(t, client.posts, 1)
+	require.Equal(t, "cpu_host=h1\tcpu_idle=1\ttimestamp=2000000000\n", string(client.posts[0]))
+	require.Equal(t, int64(1), i.repoStats().PointsDropped.Get())
+
+	// nothing is posted when all points are dropped
+	require.NoError(t, i.Write([]telegraf.Metric{nan}))
+	require.Len(t, client.posts, 1)
+	require.Equal(t, int64(2), i.repoStats().PointsDropped.Get())
+}
+
+func TestWrite_DropStalePoints(t *testing.T) {
+	client := newMockPipelineClient()
+	now := time.Date(2017, time.January, 31, 0, 0, 0, 0, time.UTC)
+
+	i := newTestPipeline()
+	i.Repo = "stale_test"
+	i.DropStalePoints = true
+	i.RetentionOverrides = map[string]string{"mem": "30d"}
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+	i.now = func() time.Time { return now }
+
+	var metrics []telegraf.Metric
+	for _, p := range []struct {
+		name string
+		age  time.Duration
+	}{
+		{"cpu", time.Minute},
+		{"cpu", 365 * 24 * time.Hour},
+		{"mem", 8 * 24 * time.Hour},
+		{"cpu", 8 * 24 * time.Hour},
+	} {
+		m, err := metric.New(p.name, map[string]string{"host": "h1"},
+			map[string]interface{}{"value": 1.0}, now.Add(-p.age))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, i.Write(metrics))
+
+	// series_retention is 7d, 30d for mem
+	require.Len(t, client.posts, 1)
+	records := strings.Split(strings.TrimSuffix(string(client.posts[0]), "\n"), "\n")
+	require.Len(t, records, 2)
+	require.Contains(t, records[0], "cpu_value=1")
+	require.Contains(t, records[1], "mem_value=1")
+	require.Equal(t, int64(2), i.repoStats().PointsDropped.Get())
+}
+
+func TestWrite_Stats(t *testing.T) {
+	client := newMockPipelineClient()
+
+	i := newTestPipeline()
+	i.Repo = "stats_test"
+	i.client = client
+	i.tsdbClient = newMockTsdbClient()
+
+	require.NoError(t, i.Write(testutil.MockMetrics()))
+	stats := i.repoStats()
+	require.Equal(t, int64(1), stats.PointsWritten.Get())
+	require.Equal(t, int64(len(client.posts[0])), stats.BytesSent.Get())
+	require.Equal(t, int64(0), stats.WriteErrors.Get())
+
+	client.errs["PostDataFromBytes"] = errors.New("E18111: schema does not match")
+	i.Write(testutil.MockMetrics())
+	require.Equal(t, int64(1), stats.PointsWritten.Get())
+	require.Equal(t, int64(1), stats.WriteErrors.Get())
+	require.Equal(t, "internal_pandora", stats.PointsWritten.Name())
+	require.Equal(t, map[string]string{"output": "pipeline", "repo": "stats_test"}, stats.PointsWritten.Tags())
+}
+
+func TestWrite_UserAgentViaServer(t *testing.T) {
+	var userAgents []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.UserAgent())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	i := newTestPipeline()
+	i.URL = ts.URL
+	i.UserAgent = "telegraf-test"
+	require.NoError(t, i.Connect())
+	i.Write(testutil.MockMetrics())
+	require.NoError(t, i.Close())
+
+	require.NotEmpty(t, userAgents)
+	for _, userAgent := range userAgents {
+		require.Equal(t, "telegraf-test", userAgent)
+	}
+}
+
+func TestWrite_HTTPHeadersViaServer(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		tenants []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tenants = append(tenants, r.Header.Get("X-Tenant-Id"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	i := newTestPipeline()
+	i.URL = ts.URL
+	i.HTTPHeaders = map[string]string{"X-Tenant-Id": "t1"}
+	// the repo check makes a request when connecting
+	i.CheckRepoOnConnect = true
+	require.NoError(t, i.Init())
+	require.NoError(t, i.Connect())
+	connectRequests := len(tenants)
+	require.NotZero(t, connectRequests)
+	i.Write(testutil.MockMetrics())
+	require.NoError(t, i.Close())
+
+	require.True(t, len(tenants) > connectRequests)
+	for _, tenant := range tenants {
+		require.Equal(t, "t1", tenant)
+	}
+
+	i = newTestPipeline()
+	i.HTTPHeaders = map[string]string{"Authorization": "Bearer x"}
+	require.Error(t, i.Init())
+}
+
+func TestWrite_SecurityTokenFileViaServer(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		tokens []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("X-Security-Token"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "pandora")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("token1\n"), 0600))
+
+	i := newTestPipeline()
+	i.URL = ts.URL
+	i.SecurityTokenFile = path
+	require.NoError(t, i.Connect())
+	i.Write(testutil.MockMetrics())
+	require.NotEmpty(t, tokens)
+	require.Equal(t, "token1", tokens[len(tokens)-1])
+
+	// the token is renewed before it expires
+	require.NoError(t, ioutil.WriteFile(path, []byte("token2\n"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	i.Write(testutil.MockMetrics())
+	require.NoError(t, i.Close())
+	require.Equal(t, "token2", tokens[len(tokens)-1])
+}
+
+func TestWrite_DeadlineViaServer(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	i := newTestPipeline()
+	i.URL = ts.URL
+	i.Timeout.Duration = 100 * time.Millisecond
+	i.MaxRetries = 3
+	i.RetryInterval.Duration = time.Millisecond
+	require.NoError(t, i.Connect())
+
+	start := time.Now()
+	i.Write(testutil.MockMetrics())
+	require.True(t, time.Since(start) < time.Second, "took %s", time.Since(start))
+	require.NoError(t, i.Close())
+}
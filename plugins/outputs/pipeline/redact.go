@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	tsdb "github.com/influxdata/influxdb/models"
+)
+
+// redactedValue replaces the values of the redact_fields in the logs.
+const redactedValue = "REDACTED"
+
+// compileRedactFields builds the regexp matching the redact_fields, with the
+// value they are set to, in line protocol.
+func compileRedactFields(fields []string) (*regexp.Regexp, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if f == "" {
+			return nil, fmt.Errorf("config.RedactFields must not hold empty field names")
+		}
+		keys = append(keys, regexp.QuoteMeta(escapeKey(f)))
+	}
+	// a value is either a quoted string or runs up to the next field or the
+	// timestamp
+	return regexp.Compile(`([ ,](?:` + strings.Join(keys, "|") + `)=)("(?:[^"\\]|\\.)*"|[^, \n]*)`)
+}
+
+// escapeKey escapes a key as in line protocol.
+func escapeKey(key string) string {
+	return strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).Replace(key)
+}
+
+// redactLine masks the values of the redact_fields in s, which holds points
+// in line protocol, e.g. their serialization or an error quoting them.
+func (i *Pipeline) redactLine(s string) string {
+	if i.redactRe == nil {
+		return s
+	}
+	return i.redactRe.ReplaceAllString(s, `${1}"`+redactedValue+`"`)
+}
+
+// redactData returns data, built from pts, with the values of the
+// redact_fields masked, for logging it.
+func (i *Pipeline) redactData(pts tsdb.Points, data string) (string, error) {
+	if len(i.RedactFields) == 0 {
+		return data, nil
+	}
+	redacted := make(tsdb.Points, 0, len(pts))
+	for _, pt := range pts {
+		fields, err := pt.Fields()
+		if err != nil {
+			return "", err
+		}
+		for _, f := range i.RedactFields {
+			if _, ok := fields[f]; ok {
+				fields[f] = redactedValue
+			}
+		}
+		p, err := tsdb.NewPoint(string(pt.Name()), pt.Tags(), fields, pt.Time())
+		if err != nil {
+			return "", err
+		}
+		redacted = append(redacted, p)
+	}
+	buf, _, err := buildPipelineData(redacted, i.TimestampKey, i.TimestampUnits, i.SanitizeReplacement)
+	return string(buf), err
+}